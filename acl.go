@@ -0,0 +1,102 @@
+package icmp_tun
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ACL filters peers by node-id. A nil ACL permits everything.
+type ACL struct {
+	allow map[uint32]bool
+	deny  map[uint32]bool
+}
+
+// empty allow list allows all node-ids not denied
+func NewACL(allow []uint32, deny []uint32) *ACL {
+	acl := &ACL{allow: map[uint32]bool{}, deny: map[uint32]bool{}}
+	for _, id := range allow {
+		acl.allow[id] = true
+	}
+	for _, id := range deny {
+		acl.deny[id] = true
+	}
+	return acl
+}
+
+func (acl *ACL) Permit(id uint32) bool {
+	if acl == nil {
+		return true
+	}
+	if acl.deny[id] {
+		return false
+	}
+	return len(acl.allow) == 0 || acl.allow[id]
+}
+
+// returns a new ACL with id added to or removed from the deny list
+func (acl *ACL) WithDeny(id uint32, deny bool) *ACL {
+	denied := acl.Denied()
+	if deny {
+		denied = append(denied, id)
+	} else {
+		for i, v := range denied {
+			if v == id {
+				denied = append(denied[:i], denied[i+1:]...)
+				break
+			}
+		}
+	}
+	return NewACL(acl.Allowed(), denied)
+}
+
+func (acl *ACL) Allowed() []uint32 {
+	if acl == nil {
+		return nil
+	}
+	return sortedIDs(acl.allow)
+}
+
+func (acl *ACL) Denied() []uint32 {
+	if acl == nil {
+		return nil
+	}
+	return sortedIDs(acl.deny)
+}
+
+func (acl *ACL) Equal(other *ACL) bool {
+	return uint32sEqual(acl.Allowed(), other.Allowed()) && uint32sEqual(acl.Denied(), other.Denied())
+}
+
+func (acl *ACL) String() string {
+	return fmt.Sprintf("allow:%s deny:%s", formatIDs(acl.Allowed()), formatIDs(acl.Denied()))
+}
+
+func formatIDs(ids []uint32) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = fmt.Sprintf("0x%08X", id)
+	}
+	return "[" + strings.Join(strs, ",") + "]"
+}
+
+func sortedIDs(m map[uint32]bool) []uint32 {
+	ids := make([]uint32, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func uint32sEqual(a []uint32, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
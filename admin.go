@@ -0,0 +1,296 @@
+package icmp_tun
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PeerInfo struct {
+	ID string `json:"id"`
+	// the node id of Remote the peer talks to
+	Endpoint string `json:"endpoint,omitempty"`
+	IP       string `json:"ip"`
+	ICMPID   uint16 `json:"icmp_id"`
+	ICMPSeq  uint16 `json:"icmp_seq"`
+	// the UDP socket of this peer and where it sends to
+	Socket string `json:"socket,omitempty"`
+	Target string `json:"target,omitempty"`
+	// mappings of Local, Socket and Target are of channel 0
+	Channels []ChannelInfo `json:"channels,omitempty"`
+	// traffic
+	UpPackets   uint64 `json:"up_packets"`
+	UpBytes     uint64 `json:"up_bytes"`
+	DownPackets uint64 `json:"down_packets"`
+	DownBytes   uint64 `json:"down_bytes"`
+	// of the received direction
+	Stats    StatsSnapshot `json:"stats"`
+	LastSeen time.Time     `json:"last_seen"`
+	Verbose  bool          `json:"verbose"`
+}
+
+// ChannelInfo describes a mapping of Local
+type ChannelInfo struct {
+	Channel uint8 `json:"channel"`
+	// the listener and its client
+	Socket string `json:"socket,omitempty"`
+	Client string `json:"client,omitempty"`
+}
+
+// AdminTarget is implemented by Local and Remote
+type AdminTarget interface {
+	Peers() []PeerInfo
+	DumpConfig() map[string]interface{}
+	SetPeerVerbose(id uint32, on bool) bool
+}
+
+// implemented by Local and Remote, level is nil if not adjustable
+type adminLogLevel interface {
+	LogLevelVar() *slog.LevelVar
+}
+
+// implemented by Local and Remote, capture is nil if not configured
+type adminCapture interface {
+	CaptureControl() *Capture
+}
+
+// implemented by Remote only
+type adminPeerManager interface {
+	KickPeer(ctx context.Context, id uint32) bool
+	BanNode(ctx context.Context, id uint32, ban bool) error
+}
+
+// AdminHandler serves:
+//
+//	GET  /peers
+//	GET  /config
+//	POST /verbose?id=ID&on=true|false
+//	GET  /loglevel, POST /loglevel?level=LEVEL
+//	GET  /capture, POST /capture?on=true|false
+//	POST /kick?id=ID
+//	POST /ban?id=ID, POST /unban?id=ID
+func AdminHandler(ctx context.Context, target AdminTarget) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, req *http.Request) {
+		adminReply(w, http.StatusOK, target.Peers())
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, req *http.Request) {
+		adminReply(w, http.StatusOK, target.DumpConfig())
+	})
+	mux.HandleFunc("/verbose", adminPost(func(w http.ResponseWriter, id uint32, req *http.Request) {
+		on, err := strconv.ParseBool(req.FormValue("on"))
+		if err != nil {
+			adminError(w, http.StatusBadRequest, errors.Wrap(err, "on"))
+			return
+		}
+		if !target.SetPeerVerbose(id, on) {
+			adminError(w, http.StatusNotFound, errors.New("peer not found"))
+			return
+		}
+		logInfo(ctx, "admin: verbose", nodeAttr("peer", id), "on", on)
+		adminReply(w, http.StatusOK, "ok")
+	}))
+
+	if ll, ok := target.(adminLogLevel); ok && ll.LogLevelVar() != nil {
+		lv := ll.LogLevelVar()
+		mux.HandleFunc("/loglevel", func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPost {
+				level, err := ParseLogLevel(req.FormValue("level"))
+				if err != nil {
+					adminError(w, http.StatusBadRequest, err)
+					return
+				}
+				lv.Set(level)
+				logInfo(ctx, "admin: log level", "level", LevelName(level))
+			}
+			adminReply(w, http.StatusOK, LevelName(lv.Level()))
+		})
+	}
+
+	if ac, ok := target.(adminCapture); ok && ac.CaptureControl() != nil {
+		capture := ac.CaptureControl()
+		mux.HandleFunc("/capture", func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPost {
+				on, err := strconv.ParseBool(req.FormValue("on"))
+				if err != nil {
+					adminError(w, http.StatusBadRequest, errors.Wrap(err, "on"))
+					return
+				}
+				capture.SetEnabled(on)
+				logInfo(ctx, "admin: capture", "on", on)
+			}
+			adminReply(w, http.StatusOK, map[string]bool{"enabled": capture.Enabled()})
+		})
+	}
+
+	pm, ok := target.(adminPeerManager)
+	if !ok {
+		return mux
+	}
+	mux.HandleFunc("/kick", adminPost(func(w http.ResponseWriter, id uint32, req *http.Request) {
+		if !pm.KickPeer(ctx, id) {
+			adminError(w, http.StatusNotFound, errors.New("peer not found"))
+			return
+		}
+		logInfo(ctx, "admin: kicked", nodeAttr("peer", id))
+		adminReply(w, http.StatusOK, "ok")
+	}))
+	ban := func(on bool) http.HandlerFunc {
+		return adminPost(func(w http.ResponseWriter, id uint32, req *http.Request) {
+			if err := pm.BanNode(ctx, id, on); err != nil {
+				adminError(w, http.StatusInternalServerError, err)
+				return
+			}
+			logInfo(ctx, "admin: ban", nodeAttr("peer", id), "on", on)
+			adminReply(w, http.StatusOK, "ok")
+		})
+	}
+	mux.HandleFunc("/ban", ban(true))
+	mux.HandleFunc("/unban", ban(false))
+	return mux
+}
+
+func adminPost(h func(w http.ResponseWriter, id uint32, req *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			adminError(w, http.StatusMethodNotAllowed, errors.New("POST required"))
+			return
+		}
+		id, err := parseNodeIDStrict(req.FormValue("id"))
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		h(w, id, req)
+	}
+}
+
+func adminReply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func adminError(w http.ResponseWriter, code int, err error) {
+	adminReply(w, code, map[string]string{"error": err.Error()})
+}
+
+// unix socket if addr contains a '/', tcp otherwise
+func isUnixAddr(addr string) bool {
+	return strings.Contains(addr, "/")
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// tcp is for local clients only, and requires a token
+func checkAdminAddr(addr string, token string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "admin addr")
+	}
+	if !isLoopbackHost(host) {
+		return errors.Errorf("admin addr %q: not a loopback address", addr)
+	}
+	if token == "" {
+		return errors.Errorf("admin addr %q: a token is required for tcp", addr)
+	}
+	return nil
+}
+
+// rejects requests without the bearer token, or with a Host other than loopback,
+// so web pages can not reach the API by DNS rebinding or cross site requests
+func adminAuth(token string, h http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if !isLoopbackHost(host) {
+			adminError(w, http.StatusForbidden, errors.Errorf("host not allowed: %q", req.Host))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			adminError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// ServeAdmin serves AdminHandler on addr until ctx is done.
+// a unix socket is protected by its file mode, a tcp addr requires the bearer token.
+func ServeAdmin(ctx context.Context, addr string, token string, target AdminTarget) error {
+	var ln net.Listener
+	var err error
+	if isUnixAddr(addr) {
+		_ = os.Remove(addr) // stale socket
+		ln, err = net.Listen("unix", addr)
+		if err == nil {
+			defer os.Remove(addr)
+			err = os.Chmod(addr, 0o600)
+		}
+	} else if err = checkAdminAddr(addr, token); err == nil {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "admin listen")
+	}
+
+	h := AdminHandler(ctx, target)
+	if !isUnixAddr(addr) {
+		h = adminAuth(token, h)
+	}
+	srv := &http.Server{Handler: h}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	logInfo(ctx, "serving admin", "addr", addr)
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// sends the bearer token
+type adminTransport struct {
+	http.RoundTripper
+	token string
+}
+
+func (t adminTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// AdminClient returns a client and the base url for addr and token of ServeAdmin
+func AdminClient(addr string, token string) (*http.Client, string) {
+	if !isUnixAddr(addr) {
+		return &http.Client{Transport: adminTransport{http.DefaultTransport, token}}, "http://" + addr
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		},
+	}
+	return &http.Client{Transport: transport}, "http://unix"
+}
@@ -0,0 +1,141 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeAdminTarget struct {
+	verbose map[uint32]bool
+	level   slog.LevelVar
+}
+
+func (f *fakeAdminTarget) LogLevelVar() *slog.LevelVar {
+	return &f.level
+}
+
+func (f *fakeAdminTarget) Peers() []PeerInfo {
+	return []PeerInfo{{ID: nodeLabel(1)}}
+}
+
+func (f *fakeAdminTarget) DumpConfig() map[string]interface{} {
+	return map[string]interface{}{"target": "1.1.1.1:53"}
+}
+
+func (f *fakeAdminTarget) SetPeerVerbose(id uint32, on bool) bool {
+	if id != 1 {
+		return false
+	}
+	f.verbose[id] = on
+	return true
+}
+
+func TestAdminHandler(t *testing.T) {
+	target := &fakeAdminTarget{verbose: map[uint32]bool{}}
+	h := AdminHandler(context.Background(), target)
+
+	do := func(method string, url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/peers")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"id": "0x00000001"`)
+
+	rec = do(http.MethodGet, "/config")
+	assert.Contains(t, rec.Body.String(), `"target": "1.1.1.1:53"`)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/verbose?id=1&on=true").Code)
+	assert.True(t, target.verbose[1])
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/verbose?id=2&on=true").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/verbose?id=x&on=true").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/verbose?id=rand&on=true").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/verbose?id=ip&on=true").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/verbose?id=0x1&on=false").Code)
+	assert.False(t, target.verbose[1])
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, "/verbose?id=1&on=true").Code)
+
+	// log level
+	assert.Contains(t, do(http.MethodGet, "/loglevel").Body.String(), `"INFO"`)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/loglevel?level=notice").Code)
+	assert.Equal(t, LevelNotice, target.level.Level())
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/loglevel?level=xxx").Code)
+
+	// not supported by target
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/kick?id=1").Code)
+}
+
+func TestServeAdmin_Loopback(t *testing.T) {
+	assert.NoError(t, checkAdminAddr("127.0.0.1:9000", "t"))
+	assert.NoError(t, checkAdminAddr("[::1]:9000", "t"))
+	assert.NoError(t, checkAdminAddr("localhost:9000", "t"))
+	assert.Error(t, checkAdminAddr(":9000", "t"))
+	assert.Error(t, checkAdminAddr("0.0.0.0:9000", "t"))
+	assert.Error(t, checkAdminAddr("192.168.1.1:9000", "t"))
+	assert.Error(t, checkAdminAddr("example.com:9000", "t"))
+	assert.Error(t, checkAdminAddr("127.0.0.1", "t"))
+	assert.Error(t, checkAdminAddr("127.0.0.1:9000", ""))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	target := &fakeAdminTarget{verbose: map[uint32]bool{}}
+	err := ServeAdmin(ctx, "0.0.0.0:0", "t", target)
+	assert.ErrorContains(t, err, "not a loopback address")
+	err = ServeAdmin(ctx, "127.0.0.1:0", "", target)
+	assert.ErrorContains(t, err, "token is required")
+	assert.NoError(t, ServeAdmin(ctx, "127.0.0.1:0", "t", target))
+}
+
+func TestAdminAuth(t *testing.T) {
+	target := &fakeAdminTarget{verbose: map[uint32]bool{}}
+	h := adminAuth("secret", AdminHandler(context.Background(), target))
+
+	do := func(host string, auth string) int {
+		req := httptest.NewRequest(http.MethodGet, "/peers", nil)
+		req.Host = host
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, do("127.0.0.1:9000", "Bearer secret"))
+	assert.Equal(t, http.StatusOK, do("localhost:9000", "Bearer secret"))
+	assert.Equal(t, http.StatusOK, do("[::1]:9000", "Bearer secret"))
+	assert.Equal(t, http.StatusUnauthorized, do("127.0.0.1:9000", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("127.0.0.1:9000", "Bearer wrong"))
+	// dns rebinding
+	assert.Equal(t, http.StatusForbidden, do("evil.example.com:9000", "Bearer secret"))
+
+	// the client sends the token
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	for token, code := range map[string]int{"secret": http.StatusOK, "wrong": http.StatusUnauthorized} {
+		client, base := AdminClient(strings.TrimPrefix(srv.URL, "http://"), token)
+		resp, err := client.Get(base + "/peers")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, code, resp.StatusCode)
+	}
+}
+
+func TestParseNodeIDStrict(t *testing.T) {
+	for s, want := range map[string]uint32{"1": 1, "0x1F": 0x1f, "0Xff": 0xff, "4294967295": 0xffffffff} {
+		id, err := parseNodeIDStrict(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, id, s)
+	}
+	for _, s := range []string{"", "0", "0x", "rand", "ip", "1.2.3.4", "010x", "0o7", "1_000", "4294967296", "-1"} {
+		_, err := parseNodeIDStrict(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,209 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"net"
+)
+
+// packets per syscall
+const kBatchSize = 16
+
+// enough for any IPv4 packet plus the tunnel headers
+const kPacketBufSize = 64*1024 + 256
+
+// reads and writes packets in batches with recvmmsg/sendmmsg on linux
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn net.PacketConn) batchConn {
+	switch c := conn.(type) {
+	case *net.IPConn:
+		return rawBatchConn{ipv4.NewPacketConn(c)}
+	case *net.UDPConn:
+		return ipv4.NewPacketConn(c)
+	default:
+		return singleBatchConn{conn}
+	}
+}
+
+// strips the IPv4 header like IPConn.ReadFrom
+type rawBatchConn struct {
+	*ipv4.PacketConn
+}
+
+func (c rawBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, err := c.PacketConn.ReadBatch(ms, flags)
+	for i := 0; i < n; i++ {
+		ms[i].N = stripIPv4Header(ms[i].Buffers[0], ms[i].N)
+	}
+	return n, err
+}
+
+// one packet per call, for conns without batch support
+type singleBatchConn struct {
+	net.PacketConn
+}
+
+func (c singleBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, addr, err := c.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].NN, ms[0].Addr = n, 0, addr
+	return 1, nil
+}
+
+func (c singleBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	_, err := c.WriteTo(ms[0].Buffers[0], ms[0].Addr)
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func batchSizeOrDefault(size int) int {
+	if size <= 0 {
+		return kBatchSize
+	}
+	return size
+}
+
+// batchReader holds a pooled buffer for each packet of the batch.
+// batched reads start with small buffers and switch to full size ones once a packet is truncated.
+type batchReader struct {
+	conn    batchConn
+	msgs    []ipv4.Message
+	bufs    [][]byte
+	bufSize int
+}
+
+// oobSize > 0 for control messages, e.g. SO_TIMESTAMPNS
+func newBatchReader(conn net.PacketConn, size int, oobSize int) *batchReader {
+	r := &batchReader{conn: newBatchConn(conn), msgs: make([]ipv4.Message, size), bufs: make([][]byte, size)}
+	r.bufSize = kPacketBufSize
+	if _, single := r.conn.(singleBatchConn); !single && size > 1 && kMsgTrunc != 0 {
+		r.bufSize = kSmallBufSize
+	}
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{nil}
+		if oobSize > 0 {
+			r.msgs[i].OOB = make([]byte, oobSize)
+		}
+	}
+	return r
+}
+
+// reads at least one packet into bufs[i][off:], the data is bufs[i][off:off+msgs[i].N]
+func (r *batchReader) read(ctx context.Context, off int) (int, error) {
+	for {
+		for i := range r.msgs {
+			if r.bufs[i] != nil && cap(r.bufs[i]) < r.bufSize {
+				putBuf(r.bufs[i])
+				r.bufs[i] = nil
+			}
+			if r.bufs[i] == nil {
+				r.bufs[i] = getBuf(r.bufSize)
+			}
+			r.msgs[i].Buffers[0] = r.bufs[i][off:]
+		}
+		n, err := r.conn.ReadBatch(r.msgs, 0)
+		if err != nil {
+			return 0, err
+		}
+		if n = r.dropTruncated(ctx, n); n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// moves the truncated packets after the others, returns the number of the others
+func (r *batchReader) dropTruncated(ctx context.Context, n int) int {
+	kept := 0
+	for i := 0; i < n; i++ {
+		if r.msgs[i].Flags&kMsgTrunc != 0 {
+			continue
+		}
+		r.msgs[i], r.msgs[kept] = r.msgs[kept], r.msgs[i]
+		r.bufs[i], r.bufs[kept] = r.bufs[kept], r.bufs[i]
+		kept++
+	}
+	if kept < n && r.bufSize < kPacketBufSize {
+		logWarn(ctx, "packets truncated, reading with full size buffers", "dropped", n-kept, "size", r.bufSize)
+		r.bufSize = kPacketBufSize
+	}
+	return kept
+}
+
+// returns the buffers to the pool until the next read()
+func (r *batchReader) release() {
+	for i, buf := range r.bufs {
+		if buf != nil {
+			putBuf(buf)
+			r.bufs[i] = nil
+			r.msgs[i].Buffers[0] = nil
+		}
+	}
+}
+
+// batchWriter queues packets until flush(), the packets are not copied
+type batchWriter struct {
+	conn batchConn
+	msgs []ipv4.Message
+	n    int
+}
+
+func newBatchWriter(conn net.PacketConn, size int) *batchWriter {
+	w := &batchWriter{conn: newBatchConn(conn), msgs: make([]ipv4.Message, size)}
+	for i := range w.msgs {
+		w.msgs[i].Buffers = [][]byte{nil}
+	}
+	return w
+}
+
+func (w *batchWriter) add(pkt []byte, addr net.Addr) {
+	w.msgs[w.n].Buffers[0] = pkt
+	w.msgs[w.n].Addr = addr
+	w.n++
+}
+
+// writes the queued packets, done is called for each packet in order
+func (w *batchWriter) flush(done func(i int, err error)) {
+	for i := 0; i < w.n; {
+		n, err := w.conn.WriteBatch(w.msgs[i:w.n], 0)
+		if n < 0 {
+			n = 0
+		}
+		for j := i; j < i+n; j++ {
+			done(j, nil)
+		}
+		i += n
+		if err == nil && n == 0 {
+			err = errors.New("no packet written")
+		}
+		if err != nil && i < w.n {
+			// the first unsent packet failed
+			done(i, err)
+			i++
+		}
+	}
+	for i := 0; i < w.n; i++ {
+		w.msgs[i].Buffers[0] = nil
+		w.msgs[i].Addr = nil
+	}
+	w.n = 0
+}
+
+// an encoded ICMP packet in batchWriter, for logging after written
+type queuedICMP struct {
+	size    int // of data
+	pktid   uint32
+	icmpseq uint16
+	encoded []byte
+}
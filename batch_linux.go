@@ -0,0 +1,6 @@
+package icmp_tun
+
+import "golang.org/x/sys/unix"
+
+// set in ipv4.Message.Flags if the packet did not fit the buffer
+const kMsgTrunc = unix.MSG_TRUNC
@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package icmp_tun
+
+// truncation is not reported on other platforms, reads always use full size buffers
+const kMsgTrunc = 0
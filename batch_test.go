@@ -0,0 +1,191 @@
+package icmp_tun
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+	"net"
+	"testing"
+	"time"
+)
+
+// writes 2 packets per call, fails on packets starting with 'x'
+type fakeBatchConn struct {
+	written []string
+}
+
+func (c *fakeBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (c *fakeBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	for i := range ms {
+		if i == 2 {
+			return i, nil
+		}
+		if ms[i].Buffers[0][0] == 'x' {
+			if i == 0 {
+				return -1, errors.New("bad packet")
+			}
+			return i, nil
+		}
+		c.written = append(c.written, string(ms[i].Buffers[0]))
+	}
+	return len(ms), nil
+}
+
+func TestBatchWriter_Flush(t *testing.T) {
+	conn := &fakeBatchConn{}
+	w := &batchWriter{conn: conn, msgs: make([]ipv4.Message, 8)}
+	for i := range w.msgs {
+		w.msgs[i].Buffers = [][]byte{nil}
+	}
+
+	pkts := []string{"a", "b", "c", "x", "d", "x"}
+	for _, pkt := range pkts {
+		w.add([]byte(pkt), nil)
+	}
+	var done []int
+	var failed []int
+	w.flush(func(i int, err error) {
+		done = append(done, i)
+		if err != nil {
+			failed = append(failed, i)
+		}
+	})
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5}, done)
+	assert.Equal(t, []int{3, 5}, failed)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, conn.written)
+	assert.Equal(t, 0, w.n)
+}
+
+// writes nothing without an error
+type stuckBatchConn struct{ fakeBatchConn }
+
+func (c *stuckBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	return 0, nil
+}
+
+func TestBatchWriter_FlushNothingWritten(t *testing.T) {
+	w := &batchWriter{conn: &stuckBatchConn{}, msgs: make([]ipv4.Message, 4)}
+	for i := range w.msgs {
+		w.msgs[i].Buffers = [][]byte{nil}
+	}
+	w.add([]byte("a"), nil)
+	w.add([]byte("b"), nil)
+	var failed []int
+	w.flush(func(i int, err error) {
+		if err != nil {
+			failed = append(failed, i)
+		}
+	})
+	assert.Equal(t, []int{0, 1}, failed)
+}
+
+// reads the sizes of the batch, truncated by the buffer size
+type sizedBatchConn struct {
+	fakeBatchConn
+	sizes []int
+}
+
+func (c *sizedBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n := 0
+	for ; n < len(ms) && len(c.sizes) > 0; n++ {
+		size := c.sizes[0]
+		c.sizes = c.sizes[1:]
+		ms[n].N, ms[n].Flags = size, 0
+		if buf := ms[n].Buffers[0]; size > len(buf) {
+			ms[n].N, ms[n].Flags = len(buf), kMsgTrunc
+		}
+		ms[n].Buffers[0][0] = byte(size)
+	}
+	return n, nil
+}
+
+func TestBatchReader_Truncated(t *testing.T) {
+	if kMsgTrunc == 0 {
+		t.Skip("truncation not reported")
+	}
+	conn := &sizedBatchConn{sizes: []int{10, 5000, 20, 6000, 30}}
+	r := &batchReader{conn: conn, msgs: make([]ipv4.Message, 4), bufs: make([][]byte, 4), bufSize: kSmallBufSize}
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{nil}
+	}
+	defer r.release()
+	ctx := context.Background()
+
+	// the truncated packets are dropped
+	n, err := r.read(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	assert.Equal(t, []byte{10, 20}, []byte{r.bufs[0][0], r.bufs[1][0]})
+	assert.Equal(t, 20, r.msgs[1].N)
+
+	// then read with full size buffers
+	n, err = r.read(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	assert.Equal(t, 30, r.msgs[0].N)
+	assert.Equal(t, kPacketBufSize, cap(r.bufs[0]))
+}
+
+func TestBatchReader_Single(t *testing.T) {
+	h := NewSimNet(1).Host("10.0.0.1")
+	rx, err := h.ListenUDP("10.0.0.1:1000")
+	require.NoError(t, err)
+	tx, err := h.ListenUDP("")
+	require.NoError(t, err)
+
+	_, err = tx.WriteTo([]byte("hello"), rx.LocalAddr())
+	require.NoError(t, err)
+	r := newBatchReader(rx, 4, 0)
+	n, err := r.read(context.Background(), 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	assert.Equal(t, "hello", string(r.bufs[0][10:10+r.msgs[0].N]))
+	assert.Equal(t, tx.LocalAddr(), r.msgs[0].Addr)
+}
+
+// forwarding bursts of kBatchSize packets on loopback, compares with one packet per syscall
+func benchmarkLoopback(b *testing.B, batch bool) {
+	rx, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(b, err)
+	defer rx.Close()
+	tx, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(b, err)
+	defer tx.Close()
+
+	r := newBatchReader(rx, kBatchSize, 0)
+	w := newBatchWriter(tx, kBatchSize)
+	if !batch {
+		r.conn, w.conn = singleBatchConn{rx}, singleBatchConn{tx}
+	}
+	_ = rx.SetReadDeadline(time.Now().Add(time.Minute))
+
+	pkt := make([]byte, 64)
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += kBatchSize {
+		for i := 0; i < kBatchSize; i++ {
+			w.add(pkt, rx.LocalAddr())
+		}
+		w.flush(func(i int, err error) {
+			require.NoError(b, err)
+		})
+		for got := 0; got < kBatchSize; {
+			n, err := r.read(context.Background(), 0)
+			require.NoError(b, err)
+			got += n
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+func BenchmarkLoopback_Single(b *testing.B) {
+	benchmarkLoopback(b, false)
+}
+
+func BenchmarkLoopback_Batch(b *testing.B) {
+	benchmarkLoopback(b, true)
+}
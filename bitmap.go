@@ -35,6 +35,9 @@ func NewRingBitmap(bitSize uint32) *RingBitmap {
 func (bm *RingBitmap) Clear() {
 	bm.last = kBitmapEmpty
 	bm.first = kBitmapEmpty
+	for i := range bm.data {
+		bm.data[i] = 0
+	}
 }
 
 func (bm *RingBitmap) Init(bitSize uint32) {
@@ -45,6 +48,26 @@ func (bm *RingBitmap) Last() uint32 {
 	return bm.last
 }
 
+func (bm *RingBitmap) Size() uint32 {
+	return bm.mask + 1
+}
+
+// seq is set and not out of the window
+func (bm *RingBitmap) Has(seq uint32) bool {
+	if bm.first == kBitmapEmpty {
+		return false
+	}
+	if bm.last-seq > bm.mask {
+		// after last, or too old
+		return false
+	}
+	if bm.first != kBitmapFull && seq-bm.first >= 1<<31 {
+		// before first
+		return false
+	}
+	return bm.data[(seq&bm.mask)/32]&(1<<(seq%32)) != 0
+}
+
 // [lo, hi]
 func (bm *RingBitmap) Count(lo uint32, hi uint32) (ones uint32, total uint32) {
 	if bm.first == kBitmapEmpty {
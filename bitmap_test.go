@@ -108,3 +108,31 @@ func TestRingBitmap_Set_Skip(t *testing.T) {
 	assert.Equal(t, uint32(6), c)
 	assert.Equal(t, uint32(32+32+32+9+1), s)
 }
+
+func TestRingBitmap_Has(t *testing.T) {
+	bitsize := uint32(64)
+	bm := NewRingBitmap(bitsize)
+	assert.False(t, bm.Has(0))
+
+	bm.Set(100)
+	bm.Set(102)
+	assert.True(t, bm.Has(100))
+	assert.False(t, bm.Has(101))
+	assert.True(t, bm.Has(102))
+	assert.False(t, bm.Has(103))
+	assert.False(t, bm.Has(99))
+
+	// out of window
+	bm.Set(130)
+	bm.Set(160)
+	bm.Set(100 + bitsize)
+	assert.False(t, bm.Has(100))
+	assert.True(t, bm.Has(100+bitsize))
+
+	// cleared
+	bm.Clear()
+	assert.False(t, bm.Has(100+bitsize))
+	bm.Set(50)
+	bm.Set(40)
+	assert.False(t, bm.Has(45))
+}
@@ -0,0 +1,70 @@
+package icmp_tun
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"net"
+)
+
+// classic BPF filters of raw ICMP sockets, packets start with the IPv4 header.
+// unwanted ICMP packets are dropped by the kernel instead of being decoded.
+
+// bytes to keep of accepted packets
+const kBPFAccept = 256 * 1024
+
+// echo replies from raddr with our ICMP id
+func localBPF(raddr net.IP, icmpID uint16) []bpf.Instruction {
+	return []bpf.Instruction{
+		// src ip
+		bpf.LoadAbsolute{Off: 12, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: binary.BigEndian.Uint32(raddr.To4()), SkipTrue: 5},
+		// X = IP header length
+		bpf.LoadMemShift{Off: 0},
+		// type
+		bpf.LoadIndirect{Off: 0, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: ICMPTypeEchoReply, SkipTrue: 2},
+		// id
+		bpf.LoadIndirect{Off: 4, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(icmpID), SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: kBPFAccept},
+	}
+}
+
+// echo requests with at least minSize bytes of ICMP
+func remoteBPF(minSize uint32) []bpf.Instruction {
+	return []bpf.Instruction{
+		// X = IP header length
+		bpf.LoadMemShift{Off: 0},
+		// type
+		bpf.LoadIndirect{Off: 0, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: ICMPTypeEcho, SkipTrue: 4},
+		// ICMP size
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.ALUOpX{Op: bpf.ALUOpSub},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: minSize, SkipTrue: 1},
+		bpf.RetConstant{Val: kBPFAccept},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+// the smallest packet of the tunnel
+func tunnelMinSize(obfs Obfuscator) uint32 {
+	return uint32(ICMPEchoHeaderSize + obfs.HeaderSize() + kTunHeaderSize)
+}
+
+// attaches the filter to raw sockets. other conns are skipped:
+// ping sockets are filtered by the kernel and the simulated ones are not real.
+func attachBPF(conn net.PacketConn, prog []bpf.Instruction) error {
+	ipconn, ok := conn.(*net.IPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		return errors.Wrap(err, "assemble bpf")
+	}
+	return errors.Wrap(ipv4.NewPacketConn(ipconn).SetBPF(raw), "attach bpf")
+}
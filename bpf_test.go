@@ -0,0 +1,56 @@
+package icmp_tun
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+	"net"
+	"testing"
+)
+
+func testICMP(icmpType uint8, id uint16, size int) []byte {
+	icmp := make([]byte, size)
+	icmp[0] = icmpType
+	icmp[4] = byte(id >> 8)
+	icmp[5] = byte(id)
+	return icmp
+}
+
+func bpfAccepts(t *testing.T, prog []bpf.Instruction, pkt []byte) bool {
+	vm, err := bpf.NewVM(prog)
+	require.NoError(t, err)
+	n, err := vm.Run(pkt)
+	require.NoError(t, err)
+	return n > 0
+}
+
+func TestLocalBPF(t *testing.T) {
+	remote, other, self := net.IPv4(1, 2, 3, 4), net.IPv4(1, 2, 3, 5), net.IPv4(10, 0, 0, 1)
+	prog := localBPF(remote, 0x1234)
+
+	assert.True(t, bpfAccepts(t, prog, ipv4Packet(1, remote, self, testICMP(ICMPTypeEchoReply, 0x1234, 64))))
+	assert.False(t, bpfAccepts(t, prog, ipv4Packet(1, other, self, testICMP(ICMPTypeEchoReply, 0x1234, 64))))
+	assert.False(t, bpfAccepts(t, prog, ipv4Packet(1, remote, self, testICMP(ICMPTypeEchoReply, 0x1235, 64))))
+	assert.False(t, bpfAccepts(t, prog, ipv4Packet(1, remote, self, testICMP(ICMPTypeEcho, 0x1234, 64))))
+	assert.False(t, bpfAccepts(t, prog, ipv4Packet(1, remote, self, testICMP(3, 0x1234, 64)))) // unreachable
+
+	// with IP options
+	pkt := ipv4Packet(1, remote, self, append(make([]byte, 4), testICMP(ICMPTypeEchoReply, 0x1234, 64)...))
+	pkt[0] = 0x46
+	assert.True(t, bpfAccepts(t, prog, pkt))
+}
+
+func TestRemoteBPF(t *testing.T) {
+	local, self := net.IPv4(10, 0, 0, 1), net.IPv4(1, 2, 3, 4)
+	min := tunnelMinSize(NewSM64CRC32ObfsWithKey(1))
+	prog := remoteBPF(min)
+
+	assert.True(t, bpfAccepts(t, prog, ipv4Packet(1, local, self, testICMP(ICMPTypeEcho, 1, int(min)))))
+	assert.False(t, bpfAccepts(t, prog, ipv4Packet(1, local, self, testICMP(ICMPTypeEcho, 1, int(min)-1))))
+	assert.False(t, bpfAccepts(t, prog, ipv4Packet(1, local, self, testICMP(ICMPTypeEchoReply, 1, int(min)))))
+
+	// normal pings when echo is enabled
+	prog = remoteBPF(0)
+	assert.True(t, bpfAccepts(t, prog, ipv4Packet(1, local, self, testICMP(ICMPTypeEcho, 1, 8))))
+	assert.False(t, bpfAccepts(t, prog, ipv4Packet(1, local, self, testICMP(ICMPTypeEchoReply, 1, 8))))
+}
@@ -0,0 +1,165 @@
+package icmp_tun
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// channels: datagrams of several UDP listeners of Local share the tunnel, the channel in the
+// cmd field of data packets names the service of Remote they go to. channel 0 is Local.Local
+// and Remote.Target.
+
+// Mapping is another UDP listener of Local, carried to the service of Remote on Channel
+type Mapping struct {
+	Listen  string
+	Channel uint8
+}
+
+// Service is a target of Remote for the mappings of locals on Channel
+type Service struct {
+	Channel uint8
+	Name    string
+	Target  string
+}
+
+func (s Service) String() string {
+	return fmt.Sprintf("%d:%s=%s", s.Channel, s.Name, s.Target)
+}
+
+// a UDP listener of Local and its client
+type clientChannel struct {
+	ch     uint8
+	lconn  socket         // to client
+	pcaddr unsafe.Pointer // client addr: *net.UDPAddr
+	// rate limit of the client
+	uplimit RateLimiter
+}
+
+func (c *clientChannel) init(ch uint8, listen string, network Network, noReopen bool) {
+	name, what := "client", "local"
+	if ch != 0 {
+		name, what = fmt.Sprintf("client:%d", ch), fmt.Sprintf("mapping %d", ch)
+	}
+	c.ch = ch
+	c.pcaddr = nil
+	c.lconn.init(name, noReopen, func() (*sockConn, error) {
+		conn, err := network.ListenUDP(listen)
+		if err != nil {
+			return nil, errors.Wrap(err, "listen on "+what)
+		}
+		return &sockConn{PacketConn: conn}, nil
+	})
+}
+
+func (c *clientChannel) info() ChannelInfo {
+	info := ChannelInfo{Channel: c.ch}
+	if sc := c.lconn.get(); sc != nil {
+		info.Socket = sc.LocalAddr().String()
+	}
+	if caddr := (*net.UDPAddr)(atomic.LoadPointer(&c.pcaddr)); caddr != nil {
+		info.Client = caddr.String()
+	}
+	return info
+}
+
+// opens the listeners of l.Mappings after channel 0
+func (l *Local) openChannels(ctx context.Context, network Network) error {
+	l.chans = []*clientChannel{&l.clientChannel}
+	for _, m := range l.Mappings {
+		c := &clientChannel{}
+		c.init(m.Channel, m.Listen, network, l.NoReopen)
+		sc, err := c.lconn.open()
+		if err != nil {
+			l.closeChannels(ctx)
+			return err
+		}
+		c.lconn.set(sc)
+		logInfo(ctx, "mapping", "addr", sc.LocalAddr().String(), "channel", m.Channel)
+		l.chans = append(l.chans, c)
+	}
+	return nil
+}
+
+func (l *Local) closeChannels(ctx context.Context) {
+	for _, c := range l.chans {
+		c.lconn.close(ctx)
+	}
+}
+
+// nil if not mapped
+func (l *Local) channel(ch uint8) *clientChannel {
+	for _, c := range l.chans {
+		if c.ch == ch {
+			return c
+		}
+	}
+	return nil
+}
+
+// resolves the targets of Target and services by channel
+func resolveServices(errs *OptionErrors, taddr *net.UDPAddr, services []Service) map[uint8]*net.UDPAddr {
+	targets := map[uint8]*net.UDPAddr{}
+	if taddr != nil {
+		targets[0] = taddr
+	}
+	for i, s := range services {
+		prefix := fmt.Sprintf("Services[%d].", i)
+		if s.Channel == 0 {
+			errs.add(prefix+"Channel", "0 is Target")
+			continue
+		}
+		if targets[s.Channel] != nil {
+			errs.add(prefix+"Channel", "duplicated: %d", s.Channel)
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", s.Target)
+		if err != nil {
+			errs.add(prefix+"Target", "%v", err)
+			continue
+		} else if addr.Port == 0 {
+			errs.add(prefix+"Target", "no port: %q", s.Target)
+			continue
+		}
+		// replies are dispatched to channels by the target addr
+		for ch, other := range targets {
+			if other.IP.Equal(addr.IP) && other.Port == addr.Port {
+				errs.add(prefix+"Target", "duplicated with channel %d: %v", ch, addr)
+			}
+		}
+		targets[s.Channel] = addr
+	}
+	return targets
+}
+
+// the channel of a reply from addr
+func (c *remoteConf) channelOf(addr *net.UDPAddr) (uint8, bool) {
+	for ch, taddr := range c.targets {
+		if taddr.IP.Equal(addr.IP) && taddr.Port == addr.Port {
+			return ch, true
+		}
+	}
+	return 0, false
+}
+
+func formatMappings(mappings []Mapping) string {
+	strs := make([]string, len(mappings))
+	for i, m := range mappings {
+		strs[i] = fmt.Sprintf("%s=%d", m.Listen, m.Channel)
+	}
+	return "[" + strings.Join(strs, ",") + "]"
+}
+
+func formatServices(services []Service) string {
+	strs := make([]string, len(services))
+	for i, s := range services {
+		strs[i] = s.String()
+	}
+	sort.Strings(strs)
+	return "[" + strings.Join(strs, ",") + "]"
+}
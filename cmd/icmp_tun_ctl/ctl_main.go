@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/account-login/icmp_tun"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+const usage = `usage: %s [-admin ADDR] [-token TOKEN] COMMAND [ARGS]
+
+commands:
+  peers             list peers
+  config            dump current config
+  verbose ID on|off toggle verbose log of a peer
+  loglevel [LEVEL]  show or set log level
+  capture [on|off]  show or toggle pcap capture
+  kick ID           remove a peer (remote only)
+  ban ID            deny a node id until the next reload (remote only)
+  unban ID          undo ban (remote only)
+
+options:
+`
+
+func cmain() int {
+	admin := flag.String("admin", "/run/icmp_tun.sock", "admin unix socket path or address")
+	token := flag.String("token", os.Getenv("ICMP_TUN_ADMIN_TOKEN"), "admin token of an address, default $ICMP_TUN_ADMIN_TOKEN")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		return 1
+	}
+
+	// build request
+	method, path, query := http.MethodGet, "", url.Values{}
+	switch cmd := args[0]; {
+	case (cmd == "peers" || cmd == "config") && len(args) == 1:
+		path = "/" + cmd
+	case (cmd == "kick" || cmd == "ban" || cmd == "unban") && len(args) == 2:
+		method, path = http.MethodPost, "/"+cmd
+		query.Set("id", args[1])
+	case cmd == "loglevel" && len(args) == 1:
+		path = "/loglevel"
+	case cmd == "loglevel" && len(args) == 2:
+		method, path = http.MethodPost, "/loglevel"
+		query.Set("level", args[1])
+	case cmd == "capture" && len(args) == 1:
+		path = "/capture"
+	case cmd == "capture" && len(args) == 2:
+		method, path = http.MethodPost, "/capture"
+		query.Set("on", fmt.Sprint(args[1] == "on" || args[1] == "true" || args[1] == "1"))
+	case cmd == "verbose" && len(args) == 3:
+		method, path = http.MethodPost, "/verbose"
+		query.Set("id", args[1])
+		query.Set("on", fmt.Sprint(args[2] == "on" || args[2] == "true" || args[2] == "1"))
+	default:
+		flag.Usage()
+		return 1
+	}
+
+	// do request
+	client, base := icmp_tun.AdminClient(*admin, *token)
+	req, err := http.NewRequest(method, base+path+"?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 3
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(cmain())
+}
@@ -3,76 +3,182 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/account-login/icmp_tun"
-	"gopkg.in/account-login/ctxlog.v2"
-	"log"
+	"github.com/account-login/icmp_tun/cmd/internal/cli"
+	"log/slog"
 	"os"
-	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func main() {
-	// logging
-	log.SetFlags(log.Flags() | log.Lmicroseconds)
+type options struct {
+	cli.Options
+	local        string
+	remote       string
+	reverse      string
+	keepalive    time.Duration
+	mappings     cli.StringList
+	localID      string
+	remoteID     string
+	rateLimit    float64
+	unprivileged bool
+}
+
+// s is listen=channel, e.g. "127.0.0.1:51820=2"
+func parseMappings(opts *options) ([]icmp_tun.Mapping, error) {
+	var mappings []icmp_tun.Mapping
+	for _, s := range opts.mappings {
+		listen, ch, ok := strings.Cut(s, "=")
+		n, err := strconv.ParseUint(ch, 0, 8)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid map: %q", s)
+		}
+		mappings = append(mappings, icmp_tun.Mapping{Listen: listen, Channel: uint8(n)})
+	}
+	return mappings, nil
+}
+
+func newFlagSet(handling flag.ErrorHandling) (*flag.FlagSet, *options) {
+	opts := &options{}
+	fs := flag.NewFlagSet(os.Args[0], handling)
+	opts.AddFlags(fs)
+	fs.StringVar(&opts.local, "local", "127.0.0.1:5353", "local UDP listener")
+	fs.StringVar(&opts.remote, "remote", "1.2.3.4", "remote ip")
+	fs.Var(&opts.mappings, "map",
+		"listen=channel, another UDP listener to the -service of the remote on channel 1-255, repeatable")
+	fs.StringVar(&opts.reverse, "reverse", "", "UDP target of reverse forwarding from the remote, empty to disable")
+	fs.DurationVar(&opts.keepalive, "keepalive-interval", 0,
+		"interval of echo requests for the remote to reply on, default 1s with -reverse, negative to disable")
+	fs.StringVar(&opts.localID, "local-id", "", "local node ID")
+	fs.StringVar(&opts.remoteID, "remote-id", "", "remote node ID")
+	fs.Float64Var(&opts.rateLimit, "rate-limit", 0, "packets per second for each direction")
+	fs.BoolVar(&opts.unprivileged, "unprivileged", false, "use ping socket without root if allowed by net.ipv4.ping_group_range, fall back to raw socket")
+	return fs, opts
+}
+
+func parseOptions(args []string, handling flag.ErrorHandling) (*options, error) {
+	return cli.Parse(args, func() (*flag.FlagSet, *options) { return newFlagSet(handling) })
+}
+
+func localConfig(opts *options) (c icmp_tun.LocalConfig) {
+	c.Remote = opts.remote
+	c.RateLimit = opts.rateLimit
+	c.Obfuscator = opts.Obfuscator()
+	return c
+}
+
+func reload(ctx context.Context, local *icmp_tun.Local, initial *options, lf *icmp_tun.LogFile) {
+	cli.ReopenLog(ctx, lf)
+
+	opts, err := parseOptions(os.Args[1:], flag.ContinueOnError)
+	if err != nil {
+		slog.ErrorContext(ctx, "reload", "err", err)
+		return
+	}
+	opts.Reload(ctx, &initial.Options)
+
+	// not reloadable
+	if opts.local != initial.local {
+		slog.WarnContext(ctx, "reload: changing local requires restart")
+	}
+	if strings.Join(opts.mappings, " ") != strings.Join(initial.mappings, " ") {
+		slog.WarnContext(ctx, "reload: changing map requires restart")
+	}
+	if opts.reverse != initial.reverse || opts.keepalive != initial.keepalive {
+		slog.WarnContext(ctx, "reload: changing reverse or keepalive-interval requires restart")
+	}
+	if opts.localID != initial.localID || opts.remoteID != initial.remoteID {
+		slog.WarnContext(ctx, "reload: changing node id requires restart")
+	}
+	if opts.unprivileged != initial.unprivileged {
+		slog.WarnContext(ctx, "reload: changing unprivileged requires restart")
+	}
+
+	changes, err := local.Reload(ctx, localConfig(opts))
+	if err != nil {
+		slog.ErrorContext(ctx, "reload", "err", err)
+		return
+	}
+	slog.Log(ctx, icmp_tun.LevelNotice, "reloaded", "changes", len(changes))
+}
 
+func cmain() int {
 	// ctx
 	ctx := context.Background()
 
 	// args
-	local := icmp_tun.Local{}
-	flag.StringVar(&local.Local, "local", "127.0.0.1:5353", "local UDP listener")
-	flag.StringVar(&local.Remote, "remote", "1.2.3.4", "remote ip")
-	flag.BoolVar(&local.Verbose, "verbose", false, "verbose log")
-	localIDArg := flag.String("local-id", "", "local node ID")
-	remoteIDArg := flag.String("remote-id", "", "remote node ID")
-	noObfsArg := flag.Bool("no-obfs", false, "disable obfuscation")
-	logFileArg := flag.String("log", "", "log file")
-	flag.Parse()
+	opts, err := parseOptions(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		slog.ErrorContext(ctx, "options", "err", err)
+		return 1
+	}
 
 	// log
-	if *logFileArg != "" {
-		f, err := os.OpenFile(*logFileArg, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-		if err == nil {
-			log.SetOutput(f)
-		}
-		// leak f
+	lf, err := cli.SetupLog(&opts.Options)
+	if err != nil {
+		slog.ErrorContext(ctx, "log", "err", err)
+		return 1
+	}
+	if lf != nil {
+		defer lf.Close()
 	}
 
 	// node-id
-	local.LocalID = icmp_tun.ParseNodeID(ctx, *localIDArg)
-	local.RemoteID = icmp_tun.ParseNodeID(ctx, *remoteIDArg)
+	local := icmp_tun.Local{
+		Local: opts.local, LocalConfig: localConfig(opts), ShutdownTimeout: opts.ShutdownTimeout,
+		Reverse: opts.reverse, KeepaliveInterval: opts.keepalive,
+		ProbeInterval: opts.ProbeInterval, ReportInterval: opts.ReportInterval,
+		KernelTimestamp: opts.KernelTimestamp, Unprivileged: opts.unprivileged, NoBPF: opts.NoBPF,
+		NoReopen: opts.NoReopen, BatchSize: opts.BatchSize,
+		LogLevel: &cli.LogLevel,
+	}
+	local.LocalID = icmp_tun.ParseNodeID(ctx, opts.localID)
+	local.RemoteID = icmp_tun.ParseNodeID(ctx, opts.remoteID)
 	if local.LocalID == 0 || local.RemoteID == 0 {
-		ctxlog.Errorf(ctx, "invalid node id [local-id:%v][remote-id:%v]", *localIDArg, *remoteIDArg)
-		os.Exit(1)
-		return
+		slog.ErrorContext(ctx, "invalid node id", "local_id", opts.localID, "remote_id", opts.remoteID)
+		return 1
+	}
+	local.StatsWindows, err = icmp_tun.ParseStatsWindows(opts.StatsWindows)
+	if err != nil {
+		slog.ErrorContext(ctx, "options", "err", err)
+		return 1
+	}
+	local.Mappings, err = parseMappings(opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "options", "err", err)
+		return 1
 	}
 
-	// obfs
-	if *noObfsArg {
-		local.Obfuscator = icmp_tun.NilObfs{}
-	} else {
-		local.Obfuscator = icmp_tun.NewSM64CRC32Obfs()
+	// pcap
+	local.Capture, err = opts.OpenCapture()
+	if err != nil {
+		slog.ErrorContext(ctx, "pcap", "err", err)
+		return 1
+	}
+	if local.Capture != nil {
+		defer local.Capture.Close()
 	}
 
-	// sigint
-	ctx, cancel := context.WithCancel(ctx)
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
-	go func() {
-		<-sigint
-		ctxlog.Noticef(ctx, "sigint received, stopping")
-		cancel()
-	}()
+	// signals, metrics, admin
+	ctx = cli.HandleSignals(ctx, &opts.Options, nil, func() { reload(ctx, &local, opts, lf) })
+	cli.Serve(ctx, &opts.Options, &local)
 
 	// log
-	ctxlog.Infof(ctx, "starting with [local-id:0x%08X][remote-id:0x%08X] [ngoroutine:%v]",
-		local.LocalID, local.RemoteID, runtime.NumGoroutine())
+	slog.InfoContext(ctx, "starting", "local_id", fmt.Sprintf("0x%08X", local.LocalID),
+		"remote_id", fmt.Sprintf("0x%08X", local.RemoteID), "ngoroutine", runtime.NumGoroutine())
 
 	// run
 	if err := local.Run(ctx); err != nil && err != context.Canceled {
-		ctxlog.Errorf(ctx, "run: %v", err)
-		os.Exit(2)
-		return
+		slog.ErrorContext(ctx, "run", "err", err)
+		return 2
 	}
-	ctxlog.Noticef(ctx, "stopped [ngoroutine:%v]", runtime.NumGoroutine())
+	slog.Log(ctx, icmp_tun.LevelNotice, "stopped", "ngoroutine", runtime.NumGoroutine())
+	return 0
+}
+
+func main() {
+	os.Exit(cmain())
 }
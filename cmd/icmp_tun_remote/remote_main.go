@@ -3,114 +3,359 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/account-login/icmp_tun"
-	"gopkg.in/account-login/ctxlog.v2"
-	"log"
+	"github.com/account-login/icmp_tun/cmd/internal/cli"
+	"io"
+	"log/slog"
 	"os"
-	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func disablePing(ctx context.Context) func() {
 	key := "net.ipv4.icmp_echo_ignore_all"
 	origin, err := icmp_tun.SysctlGet(key)
 	if err != nil {
-		ctxlog.Errorf(ctx, "SysctlGet: %v", err)
+		slog.ErrorContext(ctx, "SysctlGet", "err", err)
 		return nil
 	}
 
 	if i, err := strconv.Atoi(strings.TrimSpace(string(origin))); err != nil || i != 0 {
-		ctxlog.Infof(ctx, "ping already disabled: %s = %s", key, origin)
+		slog.InfoContext(ctx, "ping already disabled", "key", key, "value", strings.TrimSpace(string(origin)))
 		return nil
 	}
 
 	err = icmp_tun.SysctlSet(key, ([]byte)("1\n"))
 	if err != nil {
-		ctxlog.Errorf(ctx, "disable ping: SysctlSet: %v", err)
+		slog.ErrorContext(ctx, "disable ping: SysctlSet", "err", err)
 		return nil
 	}
 
-	ctxlog.Infof(ctx, "disabled ping [key:%s]", key)
+	slog.InfoContext(ctx, "disabled ping", "key", key)
 	return func() {
 		err = icmp_tun.SysctlSet(key, origin)
 		if err != nil {
-			ctxlog.Errorf(ctx, "re-enable ping: SysctlSet: %v", err)
+			slog.ErrorContext(ctx, "re-enable ping: SysctlSet", "err", err)
 		} else {
-			ctxlog.Infof(ctx, "re-enabled ping [key:%s]", key)
+			slog.InfoContext(ctx, "re-enabled ping", "key", key)
 		}
 	}
 }
 
-func cmain() int {
-	// logging
-	log.SetFlags(log.Flags() | log.Lmicroseconds)
+type options struct {
+	cli.Options
+	target       string
+	nodeID       string
+	allow        string
+	deny         string
+	relay        string
+	services     cli.StringList
+	rateLimit    float64
+	takeOverPing bool
+	workers      int
+	maxPeers     int
+	idleTimeout  time.Duration
+	endpoints    cli.StringList
+	reverse      cli.StringList
+}
+
+// options of -endpoint, the others apply to all endpoints
+var kEndpointOptions = map[string]bool{
+	"node-id": true, "target": true, "no-obfs": true, "key": true,
+	"allow": true, "deny": true, "rate-limit": true, "max-peers": true,
+	"relay": true, "service": true,
+}
+
+// s is space separated name=value options, e.g. "node-id=3 target=127.0.0.1:53 key=secret"
+func parseEndpoint(ctx context.Context, s string) (ep icmp_tun.Endpoint, err error) {
+	var args []string
+	for _, field := range strings.Fields(s) {
+		name, _, _ := strings.Cut(field, "=")
+		if !kEndpointOptions[name] {
+			return ep, fmt.Errorf("endpoint %q: unknown option %q", s, name)
+		}
+		args = append(args, "-"+field)
+	}
+	fs, opts := newFlagSet(flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err = fs.Parse(args); err != nil {
+		return ep, fmt.Errorf("endpoint %q: %v", s, err)
+	}
+
+	ep.NodeId = icmp_tun.ParseNodeID(ctx, opts.nodeID)
+	if ep.NodeId == 0 {
+		return ep, fmt.Errorf("endpoint %q: invalid node-id", s)
+	}
+	ep.MaxPeers = opts.maxPeers
+	ep.RemoteConfig, err = remoteConfig(ctx, opts)
+	return ep, err
+}
+
+func parseEndpoints(ctx context.Context, opts *options) ([]icmp_tun.Endpoint, error) {
+	var eps []icmp_tun.Endpoint
+	for _, s := range opts.endpoints {
+		ep, err := parseEndpoint(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		eps = append(eps, ep)
+	}
+	return eps, nil
+}
+
+// s is channel:name=target, e.g. "2:wireguard=10.0.0.5:51820"
+func parseService(s string) (svc icmp_tun.Service, err error) {
+	left, target, ok := strings.Cut(s, "=")
+	ch, name, _ := strings.Cut(left, ":")
+	n, perr := strconv.ParseUint(ch, 0, 8)
+	if !ok || perr != nil {
+		return svc, fmt.Errorf("invalid service: %q", s)
+	}
+	return icmp_tun.Service{Channel: uint8(n), Name: name, Target: target}, nil
+}
+
+// s is listen=local-id, e.g. "0.0.0.0:2222=10.0.0.2"
+func parseReverse(ctx context.Context, opts *options) ([]icmp_tun.ReverseForward, error) {
+	var fws []icmp_tun.ReverseForward
+	for _, s := range opts.reverse {
+		listen, id, ok := strings.Cut(s, "=")
+		fw := icmp_tun.ReverseForward{Listen: listen, Local: icmp_tun.ParseNodeID(ctx, id)}
+		if !ok || fw.Local == 0 {
+			return nil, fmt.Errorf("invalid reverse: %q", s)
+		}
+		fws = append(fws, fw)
+	}
+	return fws, nil
+}
+
+func newFlagSet(handling flag.ErrorHandling) (*flag.FlagSet, *options) {
+	opts := &options{}
+	fs := flag.NewFlagSet(os.Args[0], handling)
+	opts.AddFlags(fs)
+	fs.StringVar(&opts.target, "target", "8.8.8.8:53", "UDP target")
+	fs.StringVar(&opts.nodeID, "node-id", "", "self node ID")
+	fs.StringVar(&opts.allow, "allow", "", "comma separated local node IDs to allow, empty for all")
+	fs.StringVar(&opts.deny, "deny", "", "comma separated local node IDs to deny")
+	fs.StringVar(&opts.relay, "relay", "", "comma separated src:dst local node IDs to relay between, * for any")
+	fs.Float64Var(&opts.rateLimit, "rate-limit", 0, "packets per second for each local and direction")
+	fs.BoolVar(&opts.takeOverPing, "takeover-ping", false,
+		"disable system echo reply and emulate echo reply")
+	fs.IntVar(&opts.workers, "workers", 0, "decode workers, 0 for GOMAXPROCS")
+	fs.IntVar(&opts.maxPeers, "max-peers", 0, "max locals, 0 for unlimited, locals of relay only are not counted")
+	fs.DurationVar(&opts.idleTimeout, "peer-idle-timeout", 0, "remove locals not heard from for this long, default 10m, negative to disable")
+	fs.Var(&opts.endpoints, "endpoint",
+		"another node ID served on the same socket, repeatable, space separated options of: "+
+			"node-id target no-obfs key allow deny relay service rate-limit max-peers")
+	fs.Var(&opts.services, "service",
+		"channel:name=target, the target of the -map of locals on channel 1-255, repeatable")
+	fs.Var(&opts.reverse, "reverse",
+		"listen=local-id, forward UDP datagrams to listen to the -reverse target of the local, repeatable")
+	return fs, opts
+}
+
+func parseOptions(args []string, handling flag.ErrorHandling) (*options, error) {
+	return cli.Parse(args, func() (*flag.FlagSet, *options) { return newFlagSet(handling) })
+}
+
+func remoteConfig(ctx context.Context, opts *options) (c icmp_tun.RemoteConfig, err error) {
+	c.Target = opts.target
+	c.RateLimit = opts.rateLimit
+
+	c.Obfuscator = opts.Obfuscator()
+
+	// acl
+	allow, err := icmp_tun.ParseNodeIDList(ctx, opts.allow)
+	if err != nil {
+		return c, err
+	}
+	deny, err := icmp_tun.ParseNodeIDList(ctx, opts.deny)
+	if err != nil {
+		return c, err
+	}
+	if len(allow) > 0 || len(deny) > 0 {
+		c.ACL = icmp_tun.NewACL(allow, deny)
+	}
+
+	// services
+	for _, s := range opts.services {
+		svc, err := parseService(s)
+		if err != nil {
+			return c, err
+		}
+		c.Services = append(c.Services, svc)
+	}
+
+	// relay
+	if opts.relay != "" {
+		if c.Routes, err = icmp_tun.ParseRoutes(opts.relay); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func reload(ctx context.Context, remote *icmp_tun.Remote, initial *options, lf *icmp_tun.LogFile) {
+	cli.ReopenLog(ctx, lf)
+
+	opts, err := parseOptions(os.Args[1:], flag.ContinueOnError)
+	if err != nil {
+		slog.ErrorContext(ctx, "reload", "err", err)
+		return
+	}
+	opts.Reload(ctx, &initial.Options)
+
+	// not reloadable
+	if opts.nodeID != initial.nodeID {
+		slog.WarnContext(ctx, "reload: changing node-id requires restart")
+	}
+	if strings.Join(opts.reverse, " ") != strings.Join(initial.reverse, " ") {
+		slog.WarnContext(ctx, "reload: changing reverse requires restart")
+	}
+	if opts.takeOverPing != initial.takeOverPing {
+		slog.WarnContext(ctx, "reload: changing takeover-ping requires restart")
+	}
+	if opts.workers != initial.workers || opts.maxPeers != initial.maxPeers || opts.idleTimeout != initial.idleTimeout {
+		slog.WarnContext(ctx, "reload: changing workers, max-peers or peer-idle-timeout requires restart")
+	}
+	eps, err := parseEndpoints(ctx, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "reload", "err", err)
+		return
+	}
+	if len(eps) != len(remote.Endpoints) {
+		slog.WarnContext(ctx, "reload: adding or removing endpoints requires restart")
+	}
+
+	c, err := remoteConfig(ctx, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "reload", "err", err)
+		return
+	}
+	c.EnableEcho = remote.Config().EnableEcho
+	changes, err := remote.Reload(ctx, c)
+	if err != nil {
+		slog.ErrorContext(ctx, "reload", "err", err)
+		return
+	}
+	for i, ep := range eps {
+		if i >= len(remote.Endpoints) || ep.NodeId != remote.Endpoints[i].NodeId {
+			slog.WarnContext(ctx, "reload: changing node-id of endpoints requires restart")
+			break
+		}
+		if ep.MaxPeers != remote.Endpoints[i].MaxPeers {
+			slog.WarnContext(ctx, "reload: changing max-peers of endpoints requires restart")
+		}
+		more, err := remote.ReloadEndpoint(ctx, ep.NodeId, ep.RemoteConfig)
+		if err != nil {
+			slog.ErrorContext(ctx, "reload", "node_id", fmt.Sprintf("0x%08X", ep.NodeId), "err", err)
+			return
+		}
+		changes = append(changes, more...)
+	}
+	slog.Log(ctx, icmp_tun.LevelNotice, "reloaded", "changes", len(changes))
+}
 
+func cmain() int {
 	// ctx
 	ctx := context.Background()
 
 	// args
-	remote := icmp_tun.Remote{}
-	flag.StringVar(&remote.Target, "target", "8.8.8.8:53", "UDP target")
-	flag.BoolVar(&remote.Verbose, "verbose", false, "verbose log")
-	nodeIDArg := flag.String("node-id", "", "self node ID")
-	noObfsArg := flag.Bool("no-obfs", false, "disable obfuscation")
-	takeOverPingArg := flag.Bool("takeover-ping", false,
-		"disable system echo reply and emulate echo reply")
-	logFileArg := flag.String("log", "", "log file")
-	flag.Parse()
+	opts, err := parseOptions(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		slog.ErrorContext(ctx, "options", "err", err)
+		return 1
+	}
 
 	// log
-	if *logFileArg != "" {
-		f, err := os.OpenFile(*logFileArg, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-		if err == nil {
-			log.SetOutput(f)
-		}
-		// leak f
+	lf, err := cli.SetupLog(&opts.Options)
+	if err != nil {
+		slog.ErrorContext(ctx, "log", "err", err)
+		return 1
+	}
+	if lf != nil {
+		defer lf.Close()
 	}
 
 	// node-id
-	remote.NodeId = icmp_tun.ParseNodeID(ctx, *nodeIDArg)
+	remote := icmp_tun.Remote{}
+	remote.NodeId = icmp_tun.ParseNodeID(ctx, opts.nodeID)
+	remote.ShutdownTimeout = opts.ShutdownTimeout
+	remote.ProbeInterval = opts.ProbeInterval
+	remote.ReportInterval = opts.ReportInterval
+	remote.KernelTimestamp = opts.KernelTimestamp
+	remote.NoBPF = opts.NoBPF
+	remote.NoReopen = opts.NoReopen
+	remote.BatchSize = opts.BatchSize
+	remote.Workers = opts.workers
+	remote.MaxPeers = opts.maxPeers
+	remote.PeerIdleTimeout = opts.idleTimeout
+	remote.LogLevel = &cli.LogLevel
 	if remote.NodeId == 0 {
-		ctxlog.Errorf(ctx, "invalid node-id: %v", *nodeIDArg)
+		slog.ErrorContext(ctx, "invalid node-id", "node_id", opts.nodeID)
+		return 1
+	}
+	remote.StatsWindows, err = icmp_tun.ParseStatsWindows(opts.StatsWindows)
+	if err != nil {
+		slog.ErrorContext(ctx, "options", "err", err)
 		return 1
 	}
 
-	// obfs
-	if *noObfsArg {
-		remote.Obfuscator = icmp_tun.NilObfs{}
-	} else {
-		remote.Obfuscator = icmp_tun.NewSM64CRC32Obfs()
+	// config
+	remote.RemoteConfig, err = remoteConfig(ctx, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "options", "err", err)
+		return 1
+	}
+	remote.Endpoints, err = parseEndpoints(ctx, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "options", "err", err)
+		return 1
+	}
+	remote.Reverse, err = parseReverse(ctx, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "options", "err", err)
+		return 1
+	}
+
+	// pcap
+	remote.Capture, err = opts.OpenCapture()
+	if err != nil {
+		slog.ErrorContext(ctx, "pcap", "err", err)
+		return 1
+	}
+	if remote.Capture != nil {
+		defer remote.Capture.Close()
 	}
 
-	if *takeOverPingArg {
-		if rollback := disablePing(ctx); rollback != nil {
+	// restore sysctl on exit
+	rollback := func() {}
+	if opts.takeOverPing {
+		if restore := disablePing(ctx); restore != nil {
+			once := sync.Once{}
+			rollback = func() { once.Do(restore) }
 			defer rollback()
 			remote.EnableEcho = true
 		}
 	}
 
-	// sigint
-	ctx, cancel := context.WithCancel(ctx)
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
-	go func() {
-		<-sigint
-		ctxlog.Noticef(ctx, "sigint received, stopping")
-		cancel()
-	}()
+	// signals, metrics, admin
+	ctx = cli.HandleSignals(ctx, &opts.Options, rollback, func() { reload(ctx, &remote, opts, lf) })
+	cli.Serve(ctx, &opts.Options, &remote)
 
 	// log
-	ctxlog.Infof(ctx, "starting with [node-id:0x%08X] [ngoroutine:%v]",
-		remote.NodeId, runtime.NumGoroutine())
+	slog.InfoContext(ctx, "starting", "node_id", fmt.Sprintf("0x%08X", remote.NodeId),
+		"ngoroutine", runtime.NumGoroutine())
 
 	// run
 	if err := remote.Run(ctx); err != nil && err != context.Canceled {
-		ctxlog.Errorf(ctx, "run: %v", err)
+		slog.ErrorContext(ctx, "run", "err", err)
 		return 2
 	}
-	ctxlog.Noticef(ctx, "stopped [ngoroutine:%v]", runtime.NumGoroutine())
+	slog.Log(ctx, icmp_tun.LevelNotice, "stopped", "ngoroutine", runtime.NumGoroutine())
 	return 0
 }
 
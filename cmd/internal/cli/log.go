@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"context"
+	"github.com/account-login/icmp_tun"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// LogLevel of the default logger, changed by Reload and the admin API
+var LogLevel slog.LevelVar
+
+// the level of -log-level and -verbose
+func (o *Options) Level() (slog.Level, error) {
+	level, err := icmp_tun.ParseLogLevel(o.LogLevel)
+	if err == nil && o.Verbose && level > slog.LevelDebug {
+		level = slog.LevelDebug
+	}
+	return level, err
+}
+
+// SetupLog sets the default logger to write to stderr or the log file
+func SetupLog(opts *Options) (*icmp_tun.LogFile, error) {
+	level, err := opts.Level()
+	if err != nil {
+		return nil, err
+	}
+	LogLevel.Set(level)
+
+	var lf *icmp_tun.LogFile
+	var w io.Writer = os.Stderr
+	if opts.LogFile != "" {
+		if lf, err = icmp_tun.OpenLogFile(opts.LogFile); err != nil {
+			return nil, err
+		}
+		w = lf
+	}
+
+	handler, err := icmp_tun.NewLogHandler(w, opts.LogFormat, &LogLevel)
+	if err != nil {
+		if lf != nil {
+			_ = lf.Close()
+		}
+		return nil, err
+	}
+	slog.SetDefault(slog.New(handler))
+	return lf, nil
+}
+
+// ReopenLog reopens the log file after logrotate
+func ReopenLog(ctx context.Context, lf *icmp_tun.LogFile) {
+	if lf != nil {
+		if err := lf.Reopen(); err != nil {
+			slog.ErrorContext(ctx, "reload: reopen log", "err", err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Package cli has the options and the setup shared by the mains of icmp_tun_local and icmp_tun_remote.
+package cli
+
+import (
+	"context"
+	"flag"
+	"github.com/account-login/icmp_tun"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Options of both mains
+type Options struct {
+	Verbose         bool
+	NoObfs          bool
+	Key             string
+	ProbeInterval   time.Duration
+	ReportInterval  time.Duration
+	KernelTimestamp bool
+	NoBPF           bool
+	NoReopen        bool
+	BatchSize       int
+	StatsWindows    string
+	Admin           string
+	AdminToken      string
+	Metrics         string
+	LogFile         string
+	LogLevel        string
+	LogFormat       string
+	PcapInner       string
+	PcapOuter       string
+	PcapMaxSize     int64
+	PcapMaxFiles    int
+	PcapPaused      bool
+	ShutdownTimeout time.Duration
+	Config          string
+}
+
+// values of a repeatable flag
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, "; ")
+}
+
+func (l *StringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func (o *Options) AddFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Verbose, "verbose", false, "same as -log-level=debug")
+	fs.BoolVar(&o.NoObfs, "no-obfs", false, "disable obfuscation")
+	fs.StringVar(&o.Key, "key", "", "obfuscation key")
+	fs.DurationVar(&o.ProbeInterval, "probe-interval", time.Second, "RTT probe interval, negative to disable")
+	fs.DurationVar(&o.ReportInterval, "report-interval", 5*time.Second, "interval of sending stats to the peer, negative to disable")
+	fs.BoolVar(&o.KernelTimestamp, "kernel-timestamp", false, "use kernel receive timestamps for RTT")
+	fs.BoolVar(&o.NoBPF, "no-bpf", false, "do not filter ICMP packets in kernel")
+	fs.BoolVar(&o.NoReopen, "no-reopen", false, "exit on socket failures instead of reopening sockets")
+	fs.IntVar(&o.BatchSize, "batch-size", 16, "packets per syscall, 1 to disable batching")
+	fs.StringVar(&o.StatsWindows, "stats-windows", "100,1000,10000", "comma separated loss windows in packets")
+	fs.StringVar(&o.Admin, "admin", "", "serve admin API on this unix socket path or loopback address")
+	fs.StringVar(&o.AdminToken, "admin-token", "", "bearer token of the admin API, required for a loopback address, better set in -config")
+	fs.StringVar(&o.LogFile, "log", "", "log file, reopened on SIGHUP")
+	fs.StringVar(&o.LogLevel, "log-level", "info", "trace, debug, info, notice, warn or error")
+	fs.StringVar(&o.LogFormat, "log-format", "text", "text or json")
+	fs.StringVar(&o.PcapInner, "pcap-inner", "", "write decoded datagrams to this pcap file")
+	fs.StringVar(&o.PcapOuter, "pcap-outer", "", "write ICMP packets to this pcap file")
+	fs.Int64Var(&o.PcapMaxSize, "pcap-max-size", 64<<20, "rotate pcap files at this size in bytes")
+	fs.IntVar(&o.PcapMaxFiles, "pcap-max-files", 3, "rotated pcap files to keep")
+	fs.BoolVar(&o.PcapPaused, "pcap-paused", false, "open pcap files but do not capture until enabled by admin")
+	fs.StringVar(&o.Metrics, "metrics", "", "serve prometheus metrics on this address, e.g. 127.0.0.1:9100")
+	fs.StringVar(&o.Config, "config", "", "config file of name = value lines, reloaded on SIGHUP")
+	fs.DurationVar(&o.ShutdownTimeout, "shutdown-timeout", 2*time.Second, "graceful shutdown deadline")
+}
+
+// the Options embedded in the options of a main
+func (o *Options) Common() *Options {
+	return o
+}
+
+// Parse parses args with a new flag set of newFlagSet, returns the options it filled in.
+// command line options override the config file.
+func Parse[T interface{ Common() *Options }](args []string, newFlagSet func() (*flag.FlagSet, T)) (T, error) {
+	var zero T
+	fs, opts := newFlagSet()
+	if err := fs.Parse(args); err != nil {
+		return zero, err
+	}
+	if opts.Common().Config == "" {
+		return opts, nil
+	}
+
+	path := opts.Common().Config
+	fs, opts = newFlagSet()
+	if err := icmp_tun.ApplyConfigFile(fs, path); err != nil {
+		return zero, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return zero, err
+	}
+	return opts, nil
+}
+
+func (o *Options) Obfuscator() icmp_tun.Obfuscator {
+	if o.NoObfs {
+		return icmp_tun.NilObfs{}
+	}
+	return icmp_tun.NewSM64CRC32ObfsWithKey(icmp_tun.ObfsKeyFromString(o.Key))
+}
+
+// nil if no pcap file
+func (o *Options) OpenCapture() (*icmp_tun.Capture, error) {
+	return icmp_tun.OpenCapture(o.PcapInner, o.PcapOuter, o.PcapMaxSize, o.PcapMaxFiles, !o.PcapPaused)
+}
+
+// Reload applies the log level and warns about the options not reloadable
+func (o *Options) Reload(ctx context.Context, initial *Options) {
+	// log level
+	if level, err := o.Level(); err != nil {
+		slog.ErrorContext(ctx, "reload", "err", err)
+	} else if level != LogLevel.Level() {
+		slog.InfoContext(ctx, "reload", "change", "log_level: "+icmp_tun.LevelName(LogLevel.Level())+" -> "+icmp_tun.LevelName(level))
+		LogLevel.Set(level)
+	}
+
+	// not reloadable
+	if o.ShutdownTimeout != initial.ShutdownTimeout {
+		slog.WarnContext(ctx, "reload: changing shutdown-timeout requires restart")
+	}
+	if o.ProbeInterval != initial.ProbeInterval || o.ReportInterval != initial.ReportInterval ||
+		o.KernelTimestamp != initial.KernelTimestamp {
+		slog.WarnContext(ctx, "reload: changing probe options requires restart")
+	}
+	if o.NoBPF != initial.NoBPF || o.NoReopen != initial.NoReopen || o.BatchSize != initial.BatchSize {
+		slog.WarnContext(ctx, "reload: changing socket options requires restart")
+	}
+	if o.StatsWindows != initial.StatsWindows {
+		slog.WarnContext(ctx, "reload: changing stats-windows requires restart")
+	}
+	if o.Admin != initial.Admin || o.AdminToken != initial.AdminToken {
+		slog.WarnContext(ctx, "reload: changing admin or admin-token requires restart")
+	}
+	if o.Metrics != initial.Metrics {
+		slog.WarnContext(ctx, "reload: changing metrics requires restart")
+	}
+	if o.PcapInner != initial.PcapInner || o.PcapOuter != initial.PcapOuter ||
+		o.PcapMaxSize != initial.PcapMaxSize || o.PcapMaxFiles != initial.PcapMaxFiles {
+		slog.WarnContext(ctx, "reload: changing pcap options requires restart")
+	}
+	if o.LogFile != initial.LogFile || o.LogFormat != initial.LogFormat {
+		slog.WarnContext(ctx, "reload: changing log or log-format requires restart")
+	}
+}
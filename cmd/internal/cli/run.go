@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"context"
+	"github.com/account-login/icmp_tun"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Target is Local or Remote
+type Target interface {
+	icmp_tun.AdminTarget
+	icmp_tun.MetricsSource
+}
+
+// HandleSignals returns a ctx canceled on SIGINT or SIGTERM, and calls reload on SIGHUP.
+// if not stopped in the shutdown timeout or on the second signal, it calls atExit and exits.
+func HandleSignals(ctx context.Context, opts *Options, atExit func(), reload func()) context.Context {
+	// sigint, sigterm
+	ctx, cancel := context.WithCancel(ctx)
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigterm
+		slog.Log(ctx, icmp_tun.LevelNotice, "signal received, stopping", "signal", sig.String())
+		cancel()
+
+		// bounded shutdown, or the second signal
+		select {
+		case <-time.After(opts.ShutdownTimeout + time.Second):
+			slog.ErrorContext(ctx, "shutdown timeout, exiting")
+		case sig = <-sigterm:
+			slog.ErrorContext(ctx, "signal received again, exiting", "signal", sig.String())
+		}
+		if atExit != nil {
+			atExit()
+		}
+		os.Exit(3)
+	}()
+
+	// sighup
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			slog.Log(ctx, icmp_tun.LevelNotice, "sighup received, reloading")
+			reload()
+		}
+	}()
+	return ctx
+}
+
+// Serve serves the metrics and the admin API of target in background if enabled
+func Serve(ctx context.Context, opts *Options, target Target) {
+	// metrics
+	if opts.Metrics != "" {
+		go func() {
+			if err := icmp_tun.ServeMetrics(ctx, opts.Metrics, target); err != nil {
+				slog.ErrorContext(ctx, "metrics", "err", err)
+			}
+		}()
+	}
+
+	// admin
+	if opts.Admin != "" {
+		go func() {
+			if err := icmp_tun.ServeAdmin(ctx, opts.Admin, opts.AdminToken, target); err != nil {
+				slog.ErrorContext(ctx, "admin", "err", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,37 @@
+package icmp_tun
+
+import (
+	"bufio"
+	"flag"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+)
+
+// ApplyConfigFile sets flags of fs from a file of "name = value" lines.
+// Empty lines and lines starting with '#' are ignored.
+func ApplyConfigFile(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value := line, "true" // bool flag
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			name = strings.TrimSpace(line[:i])
+			value = strings.TrimSpace(line[i+1:])
+		}
+		if err := fs.Set(name, value); err != nil {
+			return errors.Wrapf(err, "%s:%d", path, lineno)
+		}
+	}
+	return scanner.Err()
+}
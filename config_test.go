@@ -0,0 +1,84 @@
+package icmp_tun
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icmp_tun")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "conf")
+	content := "# comment\n\ntarget = 1.1.1.1:53\nverbose\n  rate-limit=100  \n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0o644))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	target := fs.String("target", "", "")
+	verbose := fs.Bool("verbose", false, "")
+	rate := fs.Float64("rate-limit", 0, "")
+	assert.NoError(t, ApplyConfigFile(fs, path))
+	assert.Equal(t, "1.1.1.1:53", *target)
+	assert.True(t, *verbose)
+	assert.Equal(t, 100.0, *rate)
+
+	// unknown flag
+	assert.NoError(t, ioutil.WriteFile(path, []byte("nope = 1\n"), 0o644))
+	assert.Error(t, ApplyConfigFile(fs, path))
+}
+
+func TestACL(t *testing.T) {
+	var acl *ACL
+	assert.True(t, acl.Permit(1))
+
+	acl = NewACL(nil, []uint32{2})
+	assert.True(t, acl.Permit(1))
+	assert.False(t, acl.Permit(2))
+
+	acl = NewACL([]uint32{1, 2}, []uint32{2})
+	assert.True(t, acl.Permit(1))
+	assert.False(t, acl.Permit(2))
+	assert.False(t, acl.Permit(3))
+	assert.True(t, acl.Equal(NewACL([]uint32{2, 1}, []uint32{2})))
+	assert.False(t, acl.Equal(nil))
+}
+
+func TestACL_WithDeny(t *testing.T) {
+	var acl *ACL
+	acl = acl.WithDeny(1, true)
+	assert.False(t, acl.Permit(1))
+	assert.True(t, acl.Permit(2))
+	acl = acl.WithDeny(1, false)
+	assert.True(t, acl.Permit(1))
+}
+
+func TestRouteACL(t *testing.T) {
+	var acl *RouteACL
+	assert.False(t, acl.Permit(1, 2))
+	assert.Equal(t, "disabled", acl.String())
+
+	acl, err := ParseRoutes("1:2, *:3,4:*")
+	require.NoError(t, err)
+	assert.True(t, acl.Permit(1, 2))
+	assert.False(t, acl.Permit(2, 1))
+	assert.True(t, acl.Permit(5, 3))
+	assert.True(t, acl.Permit(4, 6))
+	assert.Equal(t, "[*:0x00000003,0x00000001:0x00000002,0x00000004:*]", acl.String())
+	assert.True(t, acl.Equal(NewRouteACL([]Route{{4, 0}, {1, 2}, {0, 3}})))
+	assert.False(t, acl.Equal(nil))
+
+	acl, err = ParseRoutes("*:*")
+	require.NoError(t, err)
+	assert.True(t, acl.Permit(7, 8))
+
+	for _, s := range []string{"1", "1:x", ":2", "rand:*", "*:ip", "1.2.3.4:*", "0:1"} {
+		_, err = ParseRoutes(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -3,5 +3,12 @@ package icmp_tun
 import "time"
 
 const kIOInterval = 200 * time.Millisecond
+const kShutdownTimeout = 2 * time.Second
+const kQuietPeriod = 50 * time.Millisecond
+const kProbeInterval = 1 * time.Second
+const kReportInterval = 5 * time.Second
 const kBitmapSize = 4096 * 8
 const kTunHeaderSize = 16
+const kWorkerQueueSize = 1024
+const kPeerIdleTimeout = 10 * time.Minute
+const kMaxDelayedBytes = 1 << 20 // of Local or a peer of Remote
@@ -0,0 +1,675 @@
+package icmp_tun
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	kTestLocalIP  = "10.0.0.1"
+	kTestRemoteIP = "10.0.0.2"
+	kTestTarget   = "10.0.0.2:7"
+	kTestLocal    = "127.0.0.1:5353"
+)
+
+type testTunnel struct {
+	local  *Local
+	remote *Remote
+	client net.PacketConn
+	laddr  *net.UDPAddr
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	errs   []error
+}
+
+// client -> local -> remote -> udp echo server, all on sn
+func startTunnel(t *testing.T, sn *SimNet, setup ...func(tt *testTunnel)) *testTunnel {
+	lh, rh := sn.Host(kTestLocalIP), sn.Host(kTestRemoteIP)
+	tt := &testTunnel{}
+	tt.ctx, tt.cancel = context.WithCancel(context.Background())
+
+	startEcho(t, rh)
+	tt.remote = &Remote{
+		NodeId:       2,
+		RemoteConfig: RemoteConfig{Target: kTestTarget, Obfuscator: NewSM64CRC32ObfsWithKey(1)},
+		Network:      rh,
+	}
+	tt.local = &Local{
+		LocalID: 1, RemoteID: 2, Local: kTestLocal,
+		LocalConfig: LocalConfig{Remote: kTestRemoteIP, Obfuscator: NewSM64CRC32ObfsWithKey(1)},
+		Network:     lh,
+	}
+	for _, f := range setup {
+		f(tt)
+	}
+	tt.run(tt.remote.Run)
+	tt.run(tt.local.Run)
+
+	var err error
+	tt.client, err = lh.ListenUDP("")
+	require.NoError(t, err)
+	tt.laddr, _ = net.ResolveUDPAddr("udp", kTestLocal)
+
+	t.Cleanup(func() {
+		tt.stop(t)
+		_ = tt.client.Close()
+	})
+	return tt
+}
+
+// udp echo server on kTestTarget
+func startEcho(t *testing.T, h Network) {
+	echo, err := h.ListenUDP(kTestTarget)
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	t.Cleanup(func() { _ = echo.Close() })
+}
+
+// the host goes down without notifying peers, returns the error of the instance
+func (tt *testTunnel) crash(t *testing.T, sn *SimNet, ip string) error {
+	sn.SetDown(ip, true)
+	defer sn.SetDown(ip, false)
+	require.Eventually(t, func() bool {
+		tt.mu.Lock()
+		defer tt.mu.Unlock()
+		return len(tt.errs) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	err := tt.errs[0]
+	tt.errs = nil
+	return err
+}
+
+// the error is checked by stop()
+func (tt *testTunnel) run(f func(ctx context.Context) error) {
+	tt.wg.Add(1)
+	go func() {
+		defer tt.wg.Done()
+		err := f(tt.ctx)
+		tt.mu.Lock()
+		tt.errs = append(tt.errs, err)
+		tt.mu.Unlock()
+	}()
+}
+
+// another local with its own client on host ip, stopped with tt
+func (tt *testTunnel) addLocal(t *testing.T, sn *SimNet, ip string, id uint32, setup ...func(l *Local)) *testTunnel {
+	h := sn.Host(ip)
+	sub := &testTunnel{remote: tt.remote, laddr: tt.laddr}
+	sub.local = &Local{
+		LocalID: id, RemoteID: 2, Local: kTestLocal,
+		LocalConfig: LocalConfig{Remote: kTestRemoteIP, Obfuscator: NewSM64CRC32ObfsWithKey(1)},
+		Network:     h,
+	}
+	for _, f := range setup {
+		f(sub.local)
+	}
+	tt.run(sub.local.Run)
+
+	var err error
+	sub.client, err = h.ListenUDP("")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sub.client.Close() })
+	return sub
+}
+
+func (tt *testTunnel) stop(t *testing.T) {
+	if tt.cancel == nil {
+		return
+	}
+	tt.cancel()
+	tt.cancel = nil
+	tt.wg.Wait()
+	for _, err := range tt.errs {
+		assert.Equal(t, context.Canceled, err)
+	}
+}
+
+// returns the received echoes within timeout
+func (tt *testTunnel) roundtrip(t *testing.T, msgs []string, timeout time.Duration) map[string]bool {
+	for _, msg := range msgs {
+		_, err := tt.client.WriteTo([]byte(msg), tt.laddr)
+		require.NoError(t, err)
+	}
+
+	got := map[string]bool{}
+	buf := make([]byte, 64*1024)
+	_ = tt.client.SetReadDeadline(time.Now().Add(timeout))
+	for len(got) < len(msgs) {
+		n, _, err := tt.client.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		got[string(buf[:n])] = true
+	}
+	return got
+}
+
+// the tunnel is ready once a message goes through
+func (tt *testTunnel) waitReady(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		if len(tt.roundtrip(t, []string{"ping"}, 100*time.Millisecond)) > 0 {
+			return
+		}
+	}
+	t.Fatal("tunnel not ready")
+}
+
+func testMessages(n int) []string {
+	msgs := make([]string, n)
+	for i := range msgs {
+		msgs[i] = fmt.Sprintf("msg-%04d", i)
+	}
+	return msgs
+}
+
+func TestE2E_Echo(t *testing.T) {
+	sn := NewSimNet(1)
+	sn.Delay = time.Millisecond
+	tt := startTunnel(t, sn)
+	tt.waitReady(t)
+
+	msgs := testMessages(100)
+	got := tt.roundtrip(t, msgs, 2*time.Second)
+	assert.Equal(t, len(msgs), len(got))
+
+	// peer state on remote
+	peers := tt.remote.Peers()
+	require.Equal(t, 1, len(peers))
+	assert.Equal(t, nodeLabel(1), peers[0].ID)
+	assert.Equal(t, kTestLocalIP, peers[0].IP)
+	assert.True(t, peers[0].UpPackets >= 100)
+	assert.True(t, peers[0].DownPackets >= 100)
+	// delivered in order without jitter
+	assert.Zero(t, peers[0].Stats.OutOfOrder)
+
+	// the local notifies close on shutdown
+	tt.stop(t)
+	assert.Empty(t, tt.remote.Peers())
+}
+
+func TestE2E_LossAndReorder(t *testing.T) {
+	sn := NewSimNet(2)
+	sn.Loss = 0.2
+	sn.Delay = time.Millisecond
+	sn.Jitter = 5 * time.Millisecond
+	tt := startTunnel(t, sn)
+	tt.waitReady(t)
+
+	msgs := testMessages(500)
+	got := tt.roundtrip(t, msgs, time.Second)
+	// delivered both ways with p = 0.8 * 0.8
+	assert.InDelta(t, 0.64*float64(len(msgs)), float64(len(got)), 0.1*float64(len(msgs)))
+
+	// reordered by jitter
+	assert.True(t, tt.local.st.Snapshot().OutOfOrder > 0)
+}
+
+func TestE2E_MTU(t *testing.T) {
+	sn := NewSimNet(3)
+	sn.MTU = 1500
+	tt := startTunnel(t, sn)
+	tt.waitReady(t)
+
+	small := string(make([]byte, 1000))
+	big := string(make([]byte, 1500))
+	assert.Equal(t, 1, len(tt.roundtrip(t, []string{small}, time.Second)))
+	assert.Equal(t, 0, len(tt.roundtrip(t, []string{big}, 200*time.Millisecond)))
+	assert.True(t, atomic.LoadUint64(&tt.local.cnt.icmpWrite) > 0)
+}
+
+func TestE2E_Unprivileged(t *testing.T) {
+	unprivileged := func(tt *testTunnel) { tt.local.Unprivileged = true }
+
+	// ping socket
+	sn := NewSimNet(4)
+	tt := startTunnel(t, sn, unprivileged)
+	tt.waitReady(t)
+	assert.True(t, tt.local.icmp.get().ping)
+	assert.Equal(t, 10, len(tt.roundtrip(t, testMessages(10), time.Second)))
+	peers := tt.remote.Peers()
+	require.Equal(t, 1, len(peers))
+	assert.Equal(t, tt.local.icmp.get().icmpid, peers[0].ICMPID) // assigned by kernel
+	tt.stop(t)
+
+	// fall back to raw socket
+	sn = NewSimNet(5)
+	sn.NoPing = true
+	tt = startTunnel(t, sn, unprivileged)
+	tt.waitReady(t)
+	assert.False(t, tt.local.icmp.get().ping)
+	assert.Equal(t, 10, len(tt.roundtrip(t, testMessages(10), time.Second)))
+}
+
+func TestE2E_ManyPeers(t *testing.T) {
+	sn := NewSimNet(6)
+	sn.Delay = time.Millisecond
+	tt := startTunnel(t, sn, func(tt *testTunnel) {
+		tt.remote.Workers = 4
+		tt.remote.MaxPeers = 3
+	})
+	tt.waitReady(t)
+
+	peers := []*testTunnel{tt}
+	for i := 0; i < 2; i++ {
+		peers = append(peers, tt.addLocal(t, sn, fmt.Sprintf("10.0.1.%d", i+1), uint32(10+i)))
+	}
+	for _, p := range peers[1:] {
+		p.waitReady(t)
+	}
+
+	// concurrently from all peers
+	var wg sync.WaitGroup
+	got := make([]int, len(peers))
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p *testTunnel) {
+			defer wg.Done()
+			got[i] = len(p.roundtrip(t, testMessages(100), 2*time.Second))
+		}(i, p)
+	}
+	wg.Wait()
+	for i := range peers {
+		assert.Equal(t, 100, got[i])
+	}
+	assert.Equal(t, 3, len(tt.remote.Peers()))
+
+	// over the limit
+	extra := tt.addLocal(t, sn, "10.0.1.100", 100)
+	assert.Empty(t, extra.roundtrip(t, []string{"ping"}, 500*time.Millisecond))
+	assert.Equal(t, 3, len(tt.remote.Peers()))
+	assert.True(t, atomic.LoadUint64(&tt.remote.cnt.peerLimit) > 0)
+}
+
+func TestE2E_SocketError(t *testing.T) {
+	sn := NewSimNet(7)
+	tt := startTunnel(t, sn, func(tt *testTunnel) { tt.local.NoReopen = true })
+	tt.waitReady(t)
+
+	// stops with the error instead of running without the socket
+	assert.ErrorIs(t, tt.crash(t, sn, kTestLocalIP), net.ErrClosed)
+
+	// shutdown does not wait for a poll interval, only the quiet period of the remote
+	start := time.Now()
+	tt.stop(t)
+	assert.True(t, time.Since(start) < kQuietPeriod+kIOInterval/2)
+}
+
+func TestE2E_Reopen(t *testing.T) {
+	sn := NewSimNet(8)
+	tt := startTunnel(t, sn)
+	tt.waitReady(t)
+	oldICMP, oldClient := tt.local.icmp.get(), tt.local.lconn.get()
+
+	// both sockets of the local fail, reopened once the host is up
+	sn.SetDown(kTestLocalIP, true)
+	time.Sleep(3 * kReopenMinBackoff)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tt.local.icmp.down))
+	sn.SetDown(kTestLocalIP, false)
+
+	// the client socket is gone too
+	client, err := sn.Host(kTestLocalIP).ListenUDP("")
+	require.NoError(t, err)
+	_ = tt.client.Close()
+	tt.client = client
+	tt.waitReady(t)
+	assert.NotSame(t, oldICMP, tt.local.icmp.get())
+	assert.NotSame(t, oldClient, tt.local.lconn.get())
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&tt.local.icmp.reopens))
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&tt.local.lconn.reopens))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tt.local.icmp.down))
+
+	// the remote keeps the peer
+	_ = tt.remote.icmpconn.get().Close()
+	tt.waitReady(t)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&tt.remote.icmpconn.reopens))
+	assert.Equal(t, 1, len(tt.remote.Peers()))
+	assert.Equal(t, 10, len(tt.roundtrip(t, testMessages(10), time.Second)))
+}
+
+func TestE2E_Restart(t *testing.T) {
+	sn := NewSimNet(9)
+	noReopen := func(tt *testTunnel) {
+		tt.local.NoReopen = true
+		tt.remote.NoReopen = true
+	}
+	tt := startTunnel(t, sn, noReopen)
+	tt.waitReady(t)
+	oldSocket := tt.remote.Peers()[0].Socket
+
+	// the remote recreates the peer of the restarted local
+	assert.Error(t, tt.crash(t, sn, kTestLocalIP))
+	local := tt.addLocal(t, sn, kTestLocalIP, 1)
+	local.waitReady(t)
+	peers := tt.remote.Peers()
+	require.Equal(t, 1, len(peers))
+	assert.NotEqual(t, oldSocket, peers[0].Socket)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&tt.remote.cnt.peerRestarts))
+
+	// the local resets stats of the restarted remote
+	assert.Error(t, tt.crash(t, sn, kTestRemoteIP))
+	rh := sn.Host(kTestRemoteIP)
+	startEcho(t, rh)
+	remote := &Remote{
+		NodeId:       2,
+		RemoteConfig: RemoteConfig{Target: kTestTarget, Obfuscator: NewSM64CRC32ObfsWithKey(1)},
+		Network:      rh,
+	}
+	tt.run(remote.Run)
+	local.waitReady(t)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&local.local.cnt.peerRestarts))
+	assert.Equal(t, uint64(1), local.local.st.Snapshot().Resets)
+	assert.Equal(t, 10, len(local.roundtrip(t, testMessages(10), time.Second)))
+}
+
+// records events in order
+type testObserver struct {
+	NopObserver
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *testObserver) add(format string, args ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *testObserver) ClientAddr(ch uint8, old *net.UDPAddr, addr *net.UDPAddr) {
+	o.add("client %v %v", ch, old == nil)
+}
+func (o *testObserver) PeerCreated(ev PeerEvent) { o.add("created %v %v", ev.ID, ev.IP) }
+func (o *testObserver) PeerRemoved(ev PeerEvent) { o.add("removed %v %v", ev.ID, ev.Reason) }
+func (o *testObserver) LossReport(node uint32, snap StatsSnapshot) {
+	o.add("report %v", node)
+}
+func (o *testObserver) DecodeError(ip net.IP, err error) { o.add("decode %v", ip) }
+func (o *testObserver) NodeIDMismatch(ip net.IP, src uint32, dst uint32) {
+	o.add("mismatch %v %v %v", ip, src, dst)
+}
+
+func (o *testObserver) has(event string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, ev := range o.events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+func TestE2E_Observer(t *testing.T) {
+	sn := NewSimNet(10)
+	lobs, robs := &testObserver{}, &testObserver{}
+	tt := startTunnel(t, sn, func(tt *testTunnel) {
+		tt.local.Observer = lobs
+		tt.remote.Observer = robs
+	})
+	tt.waitReady(t)
+	assert.Equal(t, 150, len(tt.roundtrip(t, testMessages(150), 2*time.Second)))
+
+	assert.True(t, lobs.has("client 0 true"))
+	assert.True(t, lobs.has("report 2"))
+	assert.True(t, robs.has("created 1 "+kTestLocalIP))
+	assert.True(t, robs.has("report 1"))
+
+	// bad packets from other locals, sent until observed
+	send := func(ip string, id uint32, remoteID uint32, key uint64, event string) {
+		h := sn.Host(ip)
+		tt.run((&Local{
+			LocalID: id, RemoteID: remoteID, Local: kTestLocal,
+			LocalConfig: LocalConfig{Remote: kTestRemoteIP, Obfuscator: NewSM64CRC32ObfsWithKey(key)},
+			Network:     h,
+		}).Run)
+		client, err := h.ListenUDP("")
+		require.NoError(t, err)
+		defer client.Close()
+		assert.Eventually(t, func() bool {
+			_, _ = client.WriteTo([]byte("bad"), tt.laddr)
+			return robs.has(event)
+		}, 2*time.Second, 20*time.Millisecond, event)
+	}
+	send("10.0.0.3", 3, 2, 2, "decode 10.0.0.3")
+	send("10.0.0.4", 4, 5, 1, "mismatch 10.0.0.4 4 5")
+
+	assert.True(t, tt.remote.KickPeer(tt.ctx, 1))
+	assert.True(t, robs.has("removed 1 kicked"))
+}
+
+func TestE2E_Endpoints(t *testing.T) {
+	sn := NewSimNet(12)
+	robs := &testObserver{}
+	tt := startTunnel(t, sn, func(tt *testTunnel) {
+		tt.remote.Observer = robs
+		tt.remote.Endpoints = []Endpoint{{
+			NodeId:       3,
+			RemoteConfig: RemoteConfig{Target: kTestTarget, Obfuscator: NewSM64CRC32ObfsWithKey(2)},
+			MaxPeers:     1,
+		}}
+	})
+	tt.waitReady(t)
+
+	// the same local id on another endpoint with its own key
+	toEndpoint := func(l *Local) {
+		l.RemoteID = 3
+		l.Obfuscator = NewSM64CRC32ObfsWithKey(2)
+	}
+	other := tt.addLocal(t, sn, "10.0.0.3", 1, toEndpoint)
+	other.waitReady(t)
+	assert.Equal(t, 10, len(other.roundtrip(t, testMessages(10), time.Second)))
+	assert.Equal(t, 10, len(tt.roundtrip(t, testMessages(10), time.Second)))
+
+	peers := map[string]string{}
+	for _, peer := range tt.remote.Peers() {
+		peers[peer.Endpoint] = peer.IP
+	}
+	assert.Equal(t, map[string]string{nodeLabel(2): kTestLocalIP, nodeLabel(3): "10.0.0.3"}, peers)
+	assert.True(t, robs.has("created 1 10.0.0.3"))
+
+	// limited by the endpoint
+	limited := tt.addLocal(t, sn, "10.0.0.4", 4, toEndpoint)
+	assert.Equal(t, 0, len(limited.roundtrip(t, []string{"ping"}, 200*time.Millisecond)))
+	assert.NotEqual(t, uint64(0), atomic.LoadUint64(&tt.remote.cnt.peerLimit))
+
+	// the key of another endpoint
+	wrongKey := tt.addLocal(t, sn, "10.0.0.5", 5, func(l *Local) { l.RemoteID = 3 })
+	assert.Eventually(t, func() bool {
+		_, _ = wrongKey.client.WriteTo([]byte("bad"), wrongKey.laddr)
+		return robs.has("mismatch 10.0.0.5 5 3")
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// reloading an endpoint removes denied peers
+	_, err := tt.remote.ReloadEndpoint(tt.ctx, 3, RemoteConfig{
+		Target: kTestTarget, Obfuscator: NewSM64CRC32ObfsWithKey(2), ACL: NewACL(nil, []uint32{1}),
+	})
+	require.NoError(t, err)
+	assert.True(t, robs.has("removed 1 acl"))
+	require.Equal(t, 1, len(tt.remote.Peers()))
+	assert.Equal(t, nodeLabel(2), tt.remote.Peers()[0].Endpoint)
+	_, err = tt.remote.ReloadEndpoint(tt.ctx, 4, RemoteConfig{})
+	assert.Error(t, err)
+}
+
+func TestE2E_Relay(t *testing.T) {
+	sn := NewSimNet(13)
+	tt := startTunnel(t, sn, func(tt *testTunnel) {
+		tt.local.RemoteID = 4
+		tt.remote.Routes = NewRouteACL([]Route{{1, 4}, {4, 1}})
+		// relay only peers are not limited
+		tt.remote.MaxPeers = 1
+	})
+	other := tt.addLocal(t, sn, "10.0.0.3", 4, func(l *Local) { l.RemoteID = 1 })
+
+	// a client reads what the other one writes
+	relayed := func(from *testTunnel, to *testTunnel, msg string) bool {
+		// the local learns its client
+		_, _ = to.client.WriteTo([]byte("hello"), to.laddr)
+		_, err := from.client.WriteTo([]byte(msg), from.laddr)
+		require.NoError(t, err)
+		buf := make([]byte, 1500)
+		_ = to.client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		for {
+			n, _, err := to.client.ReadFrom(buf)
+			if err != nil {
+				return false
+			}
+			if string(buf[:n]) == msg {
+				return true
+			}
+		}
+	}
+	assert.Eventually(t, func() bool { return relayed(tt, other, "1->4") }, 2*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return relayed(other, tt, "4->1") }, 2*time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, uint64(0), atomic.LoadUint64(&tt.remote.cnt.relayed))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&tt.remote.cnt.idMismatches))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&tt.remote.cnt.peerLimit))
+
+	// without target sockets
+	peers := tt.remote.Peers()
+	require.Equal(t, 2, len(peers))
+	for _, p := range peers {
+		assert.Empty(t, p.Socket)
+	}
+
+	// no route from 5
+	denied := tt.addLocal(t, sn, "10.0.0.4", 5, func(l *Local) { l.RemoteID = 1 })
+	assert.Eventually(t, func() bool {
+		_, _ = denied.client.WriteTo([]byte("5->1"), denied.laddr)
+		return atomic.LoadUint64(&tt.remote.cnt.relayDrops) > 0
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestE2E_IdlePeer(t *testing.T) {
+	sn := NewSimNet(16)
+	obs := &testObserver{}
+	tt := startTunnel(t, sn, func(tt *testTunnel) {
+		tt.remote.Observer = obs
+		tt.remote.MaxPeers = 1
+		tt.remote.PeerIdleTimeout = 300 * time.Millisecond
+		tt.local.ProbeInterval = -1
+		tt.local.ReportInterval = -1
+	})
+	tt.waitReady(t)
+	assert.Equal(t, 10, len(tt.roundtrip(t, testMessages(10), time.Second)))
+
+	// the silent peer is removed, and another local takes its place
+	assert.Eventually(t, func() bool { return obs.has("removed 1 idle") }, 2*time.Second, 20*time.Millisecond)
+	assert.Empty(t, tt.remote.Peers())
+	other := tt.addLocal(t, sn, "10.0.1.1", 10, func(l *Local) { l.ProbeInterval = -1 })
+	other.waitReady(t)
+	assert.Equal(t, 10, len(other.roundtrip(t, testMessages(10), time.Second)))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&tt.remote.cnt.peerLimit))
+}
+
+func TestE2E_Reverse(t *testing.T) {
+	sn := NewSimNet(14)
+	startEcho(t, sn.Host(kTestLocalIP))
+	tt := startTunnel(t, sn, func(tt *testTunnel) {
+		tt.remote.Reverse = []ReverseForward{{Listen: kTestRemoteIP + ":2222", Local: 1}}
+		tt.local.Reverse = kTestLocalIP + ":7"
+		tt.local.ProbeInterval = -1
+		// both ends see the reverse datagrams
+		tt.remote.Middleware = Pipeline{HandlerFunc(func(meta PacketMeta, data []byte) ([]byte, Verdict) {
+			if meta.Dir == TargetToLocal {
+				data = append([]byte("r>"), data...)
+			}
+			return data, Verdict{}
+		})}
+		tt.local.Middleware = Pipeline{HandlerFunc(func(meta PacketMeta, data []byte) ([]byte, Verdict) {
+			if meta.Dir == ClientToRemote {
+				data = append([]byte("l<"), data...)
+			}
+			return data, Verdict{}
+		})}
+	})
+
+	// a sender on the remote side reaches the echo server behind the local
+	sender, err := sn.Host("10.0.0.9").ListenUDP("")
+	require.NoError(t, err)
+	defer sender.Close()
+	raddr, _ := net.ResolveUDPAddr("udp", kTestRemoteIP+":2222")
+	buf := make([]byte, 1500)
+	assert.Eventually(t, func() bool {
+		_, err := sender.WriteTo([]byte("reverse"), raddr)
+		require.NoError(t, err)
+		_ = sender.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, addr, err := sender.ReadFrom(buf)
+		return err == nil && string(buf[:n]) == "l<r>reverse" && addr.String() == raddr.String()
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, uint64(0), atomic.LoadUint64(&tt.remote.cnt.reversed))
+	assert.NotEqual(t, uint64(0), atomic.LoadUint64(&tt.local.cnt.reversed))
+	assert.Equal(t, 1, tt.remote.rev.len())
+
+	// the forward direction still works
+	assert.Equal(t, 10, len(tt.roundtrip(t, testMessages(10), time.Second)))
+}
+
+func TestE2E_Channels(t *testing.T) {
+	sn := NewSimNet(15)
+	rh := sn.Host(kTestRemoteIP)
+	svc, err := rh.ListenUDP(kTestRemoteIP + ":9")
+	require.NoError(t, err)
+	defer svc.Close()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := svc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = svc.WriteTo(append([]byte("svc:"), buf[:n]...), addr)
+		}
+	}()
+
+	lobs := &testObserver{}
+	tt := startTunnel(t, sn, func(tt *testTunnel) {
+		tt.local.Observer = lobs
+		tt.remote.Services = []Service{{Channel: 1, Name: "svc", Target: kTestRemoteIP + ":9"}}
+		tt.local.Mappings = []Mapping{{Listen: "127.0.0.1:5354", Channel: 1}, {Listen: "127.0.0.1:5355", Channel: 2}}
+	})
+	tt.waitReady(t)
+
+	// the mapping reaches its service, along with channel 0
+	mapped := &testTunnel{client: tt.client}
+	mapped.laddr, _ = net.ResolveUDPAddr("udp", "127.0.0.1:5354")
+	got := mapped.roundtrip(t, []string{"a", "b"}, time.Second)
+	assert.Equal(t, map[string]bool{"svc:a": true, "svc:b": true}, got)
+	assert.Equal(t, 10, len(tt.roundtrip(t, testMessages(10), time.Second)))
+
+	// no service on channel 2
+	unknown := &testTunnel{client: tt.client}
+	unknown.laddr, _ = net.ResolveUDPAddr("udp", "127.0.0.1:5355")
+	assert.Equal(t, 0, len(unknown.roundtrip(t, []string{"c"}, 200*time.Millisecond)))
+	assert.NotEqual(t, uint64(0), atomic.LoadUint64(&tt.remote.cnt.unknownChan))
+
+	// the clients of the mappings
+	peers := tt.local.Peers()
+	require.Equal(t, 1, len(peers))
+	require.Equal(t, 2, len(peers[0].Channels))
+	assert.Equal(t, uint8(1), peers[0].Channels[0].Channel)
+	assert.Equal(t, kTestLocalIP+":5354", peers[0].Channels[0].Socket)
+	assert.Equal(t, tt.client.LocalAddr().String(), peers[0].Channels[0].Client)
+	assert.Equal(t, uint8(2), peers[0].Channels[1].Channel)
+	assert.True(t, lobs.has("client 1 true"))
+}
@@ -0,0 +1,164 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Endpoint is a virtual Remote with its own node id and config, sharing the ICMP socket of Remote
+type Endpoint struct {
+	NodeId uint32
+	RemoteConfig
+	// 0 for unlimited, Remote.MaxPeers limits the total
+	MaxPeers int
+}
+
+// the NodeId of Remote or one of Remote.Endpoints
+type endpoint struct {
+	id       uint32
+	maxPeers int
+	conf     unsafe.Pointer // current config: *remoteConf
+	npeers   int            // guarded by Remote.mu
+}
+
+func (ep *endpoint) loadConf() *remoteConf {
+	return (*remoteConf)(atomic.LoadPointer(&ep.conf))
+}
+
+var errShortPacket = errors.New("icmp packet too short")
+
+// peers of different endpoints may share the node id
+func peerKey(ep uint32, local uint32) uint64 {
+	return uint64(ep)<<32 | uint64(local)
+}
+
+// sets up the endpoints, the first is Remote itself
+func (r *Remote) initEndpoints(primary *remoteConf) error {
+	eps := []*endpoint{&r.ep}
+	r.ep.id = r.NodeId
+	atomic.StorePointer(&r.ep.conf, unsafe.Pointer(primary))
+	for _, e := range r.Endpoints {
+		conf, err := newRemoteConf(e.RemoteConfig)
+		if err != nil {
+			return err
+		}
+		ep := &endpoint{id: e.NodeId, maxPeers: e.MaxPeers}
+		atomic.StorePointer(&ep.conf, unsafe.Pointer(conf))
+		eps = append(eps, ep)
+	}
+
+	id2ep := map[uint32]*endpoint{}
+	for _, ep := range eps {
+		id2ep[ep.id] = ep
+	}
+	r.mu.Lock()
+	r.eps, r.id2ep = eps, id2ep
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Remote) endpoints() []*endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.eps
+}
+
+func (r *Remote) getEndpoint(id uint32) *endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id2ep[id]
+}
+
+// decodes the icmp data of pkt with the obfuscator of each endpoint in turn, returns the endpoint
+// that decoded it. with several endpoints the data is decoded in scratch, pkt is kept for echo replies.
+func (r *Remote) decode(pkt []byte, scratch []byte) ([]byte, *endpoint, error) {
+	icmpData := pkt[ICMPEchoHeaderSize:]
+	if len(r.eps) == 1 {
+		// decode inplace
+		obfs := r.ep.loadConf().Obfuscator
+		hs := obfs.HeaderSize()
+		if len(icmpData) < hs {
+			return nil, nil, errShortPacket
+		}
+		data, err := obfs.Decode(icmpData[hs:], icmpData)
+		if err != nil {
+			return nil, nil, err
+		}
+		if &icmpData[hs] != &data[0] {
+			panic("should reuse buf")
+		}
+		return data, &r.ep, nil
+	}
+
+	err := errShortPacket
+	for i, ep := range r.eps {
+		obfs := ep.loadConf().Obfuscator
+		if r.triedObfs(i, obfs) {
+			continue
+		}
+		hs := obfs.HeaderSize()
+		if len(icmpData) < hs {
+			continue
+		}
+		n := copy(scratch, icmpData)
+		data, derr := obfs.Decode(scratch[hs:n], scratch[:n])
+		if derr == nil {
+			return data, ep, nil
+		}
+		err = derr
+	}
+	return nil, nil, err
+}
+
+// obfs is the same as of an endpoint before i
+func (r *Remote) triedObfs(i int, obfs Obfuscator) bool {
+	for _, ep := range r.eps[:i] {
+		if obfsEqual(ep.loadConf().Obfuscator, obfs) {
+			return true
+		}
+	}
+	return false
+}
+
+// the packet decoded by the obfuscator of ep is for dst
+func (r *Remote) dispatch(ep *endpoint, dst uint32) *endpoint {
+	if ep.id == dst {
+		return ep
+	}
+	if target := r.id2ep[dst]; target != nil && obfsEqual(target.loadConf().Obfuscator, ep.loadConf().Obfuscator) {
+		return target
+	}
+	return nil
+}
+
+// normal pings are accepted if echo is enabled by any endpoint
+func (r *Remote) echoEnabled() bool {
+	for _, ep := range r.endpoints() {
+		if ep.loadConf().EnableEcho {
+			return true
+		}
+	}
+	return false
+}
+
+// the smallest tunnel packet of all endpoints, 0 if echo is enabled
+func (r *Remote) minSize() uint32 {
+	size := uint32(0)
+	for i, ep := range r.endpoints() {
+		if s := remoteMinSize(ep.loadConf()); i == 0 || s < size {
+			size = s
+		}
+	}
+	return size
+}
+
+// ReloadEndpoint applies the new config to an endpoint of the running Remote, see Reload()
+func (r *Remote) ReloadEndpoint(ctx context.Context, id uint32, c RemoteConfig) (changes []string, err error) {
+	ep := r.getEndpoint(id)
+	if ep == nil {
+		return nil, errors.Errorf("no endpoint %s", nodeLabel(id))
+	}
+	return r.reload(logWith(ctx, nodeAttr("endpoint", id)), ep, c)
+}
@@ -0,0 +1,95 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// consecutive read errors before a socket is considered dead
+const kMaxReadErrors = 100
+
+// returned by readers whose socket is closed on shutdown, not an error of the group
+var errStopped = errors.New("stopped")
+
+// runGroup runs the goroutines of an instance like errgroup.
+// it is stopped by the parent ctx or the first error, which is returned by Wait().
+type runGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+}
+
+func newRunGroup(ctx context.Context) *runGroup {
+	g := &runGroup{}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	return g
+}
+
+// closed when the group is stopping
+func (g *runGroup) Done() <-chan struct{} {
+	return g.ctx.Done()
+}
+
+func (g *runGroup) stopping() bool {
+	return g.ctx.Err() != nil
+}
+
+// returns false if the group is stopping
+func (g *runGroup) Go(f func() error) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopping() {
+		return false
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := f(); err != nil && !errors.Is(err, errStopped) {
+			g.fail(err)
+		}
+	}()
+	return true
+}
+
+func (g *runGroup) fail(err error) {
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.mu.Unlock()
+	g.cancel()
+}
+
+// waits for all goroutines, returns the first error
+func (g *runGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// returns nil if the read error is transient, errStopped if the socket is closed on shutdown,
+// the error itself if the socket is dead. streak counts the consecutive errors, reset it on success.
+func (g *runGroup) readError(err error, streak *int) error {
+	if errors.Is(err, net.ErrClosed) && g.stopping() {
+		return errStopped
+	}
+	*streak++
+	if isFatalSocketError(err) || *streak >= kMaxReadErrors {
+		return err
+	}
+	return nil
+}
+
+// errors of a dead socket, others are transient, e.g. ICMP errors reported on UDP sockets
+func isFatalSocketError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EBADF) || errors.Is(err, syscall.ENOTSOCK)
+}
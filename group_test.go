@@ -0,0 +1,48 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestRunGroup_FirstError(t *testing.T) {
+	g := newRunGroup(context.Background())
+	err1 := errors.New("err1")
+	assert.True(t, g.Go(func() error { <-g.Done(); return nil }))
+	assert.True(t, g.Go(func() error { return errors.Wrap(errStopped, "read") }))
+	assert.True(t, g.Go(func() error { return err1 }))
+	<-g.Done()
+	assert.False(t, g.Go(func() error { return errors.New("err2") }))
+	assert.Equal(t, err1, g.Wait())
+}
+
+func TestRunGroup_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := newRunGroup(ctx)
+	g.Go(func() error { <-g.Done(); return nil })
+	cancel()
+	assert.NoError(t, g.Wait())
+}
+
+func TestRunGroup_ReadError(t *testing.T) {
+	g := newRunGroup(context.Background())
+	streak := 0
+	assert.NoError(t, g.readError(syscall.ECONNREFUSED, &streak))
+	assert.Equal(t, syscall.EBADF, g.readError(syscall.EBADF, &streak))
+	assert.Equal(t, net.ErrClosed, g.readError(net.ErrClosed, &streak))
+
+	// too many errors
+	streak = 0
+	for i := 0; i < kMaxReadErrors-1; i++ {
+		assert.NoError(t, g.readError(syscall.ECONNREFUSED, &streak))
+	}
+	assert.Error(t, g.readError(syscall.ECONNREFUSED, &streak))
+
+	// closed on shutdown
+	g.cancel()
+	assert.Equal(t, errStopped, g.readError(&net.OpError{Op: "read", Err: net.ErrClosed}, &streak))
+}
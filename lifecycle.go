@@ -0,0 +1,194 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+)
+
+// lifecycle of a Local or Remote, which runs once
+type lifecycle struct {
+	mu      sync.Mutex
+	ready   chan struct{} // closed once the sockets are open
+	done    chan struct{} // closed when stopped
+	cancel  context.CancelFunc
+	started bool
+	err     error
+}
+
+func (lc *lifecycle) init() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.ready == nil {
+		lc.ready = make(chan struct{})
+		lc.done = make(chan struct{})
+	}
+}
+
+// returns the ctx of the run, canceled by close()
+func (lc *lifecycle) begin(ctx context.Context) (context.Context, error) {
+	lc.init()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.started {
+		return nil, errors.New("already started")
+	}
+	lc.started = true
+	ctx, lc.cancel = context.WithCancel(ctx)
+	return ctx, nil
+}
+
+func (lc *lifecycle) setReady() {
+	close(lc.ready)
+}
+
+func (lc *lifecycle) end(err error) {
+	lc.mu.Lock()
+	lc.err = err
+	lc.mu.Unlock()
+	lc.cancel()
+	close(lc.done)
+}
+
+func (lc *lifecycle) readyChan() <-chan struct{} {
+	lc.init()
+	return lc.ready
+}
+
+func (lc *lifecycle) doneChan() <-chan struct{} {
+	lc.init()
+	return lc.done
+}
+
+// the error of the run, nil if not stopped or stopped by close()
+func (lc *lifecycle) error() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.err == context.Canceled {
+		return nil
+	}
+	return lc.err
+}
+
+// runs f in foreground
+func (lc *lifecycle) run(ctx context.Context, f func(ctx context.Context) error) error {
+	ctx, err := lc.begin(ctx)
+	if err != nil {
+		return err
+	}
+	err = f(ctx)
+	lc.end(err)
+	return err
+}
+
+// runs f in background, returns once ready or stopped
+func (lc *lifecycle) start(ctx context.Context, f func(ctx context.Context) error) error {
+	ctx, err := lc.begin(ctx)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		lc.end(err)
+		return err
+	}
+	go func() { lc.end(f(ctx)) }()
+
+	select {
+	case <-lc.ready:
+		return nil
+	case <-lc.done:
+	}
+
+	// stopped before ready, the error is returned even if canceled
+	select {
+	case <-lc.ready:
+		return nil
+	default:
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.err == nil {
+		return errors.New("stopped before ready")
+	}
+	return lc.err
+}
+
+func (lc *lifecycle) close() error {
+	lc.mu.Lock()
+	cancel := lc.cancel
+	lc.mu.Unlock()
+	if cancel == nil {
+		return nil // not started
+	}
+	cancel()
+	<-lc.done
+	return lc.error()
+}
+
+// Start runs Local in background until ctx is done or Close() is called.
+// it returns once the sockets are open, or the error.
+func (l *Local) Start(ctx context.Context) error {
+	return l.lc.start(ctx, l.run)
+}
+
+// Ready is closed once the sockets are open
+func (l *Local) Ready() <-chan struct{} {
+	return l.lc.readyChan()
+}
+
+// Done is closed when stopped
+func (l *Local) Done() <-chan struct{} {
+	return l.lc.doneChan()
+}
+
+// Close stops Local and waits, returns the error that stopped it, if any
+func (l *Local) Close() error {
+	return l.lc.close()
+}
+
+// UDPAddr returns the bound address of the client listener, nil if not running
+func (l *Local) UDPAddr() *net.UDPAddr {
+	if sc := l.lconn.get(); sc != nil {
+		addr, _ := sc.LocalAddr().(*net.UDPAddr)
+		return addr
+	}
+	return nil
+}
+
+// ICMPAddr returns the bound address of the ICMP socket, nil if not running
+func (l *Local) ICMPAddr() net.Addr {
+	if sc := l.icmp.get(); sc != nil {
+		return sc.LocalAddr()
+	}
+	return nil
+}
+
+// Start runs Remote in background until ctx is done or Close() is called.
+// it returns once the socket is open, or the error.
+func (r *Remote) Start(ctx context.Context) error {
+	return r.lc.start(ctx, r.run)
+}
+
+// Ready is closed once the socket is open
+func (r *Remote) Ready() <-chan struct{} {
+	return r.lc.readyChan()
+}
+
+// Done is closed when stopped
+func (r *Remote) Done() <-chan struct{} {
+	return r.lc.doneChan()
+}
+
+// Close stops Remote and waits, returns the error that stopped it, if any
+func (r *Remote) Close() error {
+	return r.lc.close()
+}
+
+// ICMPAddr returns the bound address of the ICMP socket, nil if not running
+func (r *Remote) ICMPAddr() net.Addr {
+	if sc := r.icmpconn.get(); sc != nil {
+		return sc.LocalAddr()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLifecycle_Start(t *testing.T) {
+	sn := NewSimNet(1)
+	rh := sn.Host(kTestRemoteIP)
+	startEcho(t, rh)
+
+	remote := &Remote{
+		NodeId:       2,
+		RemoteConfig: RemoteConfig{Target: kTestTarget, Obfuscator: NewSM64CRC32ObfsWithKey(1)},
+		Network:      rh,
+	}
+	require.NoError(t, remote.Start(context.Background()))
+	defer remote.Close()
+	assert.NotNil(t, remote.ICMPAddr())
+
+	local := &Local{
+		LocalID: 1, RemoteID: 2, Local: "127.0.0.1:0",
+		LocalConfig: LocalConfig{Remote: kTestRemoteIP, Obfuscator: NewSM64CRC32ObfsWithKey(1)},
+		Network:     sn.Host(kTestLocalIP),
+	}
+	assert.Nil(t, local.UDPAddr())
+	require.NoError(t, local.Start(context.Background()))
+	select {
+	case <-local.Ready():
+	default:
+		t.Fatal("not ready")
+	}
+	assert.EqualError(t, local.Start(context.Background()), "already started")
+	assert.EqualError(t, local.Run(context.Background()), "already started")
+
+	// the bound port
+	laddr := local.UDPAddr()
+	require.NotNil(t, laddr)
+	assert.NotEqual(t, 0, laddr.Port)
+	assert.NotNil(t, local.ICMPAddr())
+
+	client, err := sn.Host(kTestLocalIP).ListenUDP("")
+	require.NoError(t, err)
+	defer client.Close()
+	tt := &testTunnel{client: client, laddr: laddr}
+	tt.waitReady(t)
+	assert.Equal(t, 1, len(remote.Peers()))
+
+	assert.NoError(t, local.Close())
+	select {
+	case <-local.Done():
+	default:
+		t.Fatal("not done")
+	}
+	assert.NoError(t, local.Close())
+	assert.NoError(t, remote.Close())
+}
+
+func TestLifecycle_StartError(t *testing.T) {
+	local := &Local{LocalID: 1}
+	err := local.Start(context.Background())
+	var errs OptionErrors
+	assert.True(t, errors.As(err, &errs))
+	<-local.Done()
+	assert.Equal(t, err, local.Close())
+	select {
+	case <-local.Ready():
+		t.Fatal("ready")
+	default:
+	}
+
+	// stopped by ctx
+	sn := NewSimNet(1)
+	remote := &Remote{
+		NodeId:       2,
+		RemoteConfig: RemoteConfig{Target: kTestTarget, Obfuscator: NewSM64CRC32ObfsWithKey(1)},
+		Network:      sn.Host(kTestRemoteIP),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, remote.Start(ctx))
+	cancel()
+	select {
+	case <-remote.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not stopped")
+	}
+	assert.NoError(t, remote.Close())
+
+	// canceled before ready
+	remote = &Remote{
+		NodeId:       2,
+		RemoteConfig: RemoteConfig{Target: kTestTarget, Obfuscator: NewSM64CRC32ObfsWithKey(1)},
+		Network:      sn.Host(kTestRemoteIP),
+	}
+	assert.Equal(t, context.Canceled, remote.Start(ctx))
+	<-remote.Done()
+	assert.NoError(t, remote.Close())
+}
@@ -4,270 +4,880 @@ import (
 	"context"
 	"encoding/binary"
 	"github.com/pkg/errors"
-	"golang.org/x/net/icmp"
-	"gopkg.in/account-login/ctxlog.v2"
+	"log/slog"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
+// LocalConfig is the part of Local that can be changed by Local.Reload()
+type LocalConfig struct {
+	// remote ip
+	Remote string
+	// other
+	Obfuscator Obfuscator
+	// packets per second of each direction, 0 for unlimited
+	RateLimit float64
+}
+
 type Local struct {
 	// node-id
 	LocalID  uint32
 	RemoteID uint32
-	// local UDP listener
+	// local UDP listener, channel 0
 	Local string
-	// remote ip
-	Remote string
-	// other
-	Verbose    bool
-	Obfuscator Obfuscator
+	// more UDP listeners to the services of the remote
+	Mappings []Mapping
+	// target of the reverse forwarding of the remote, see Remote.Reverse. empty to disable
+	Reverse string
+	// keepalive interval for the remote to reply on, default kKeepaliveInterval with Reverse, negative to disable
+	KeepaliveInterval time.Duration
+	// initial config
+	LocalConfig
+	// wait for a quiet period and notify remote before stopping, default kShutdownTimeout
+	ShutdownTimeout time.Duration
+	// RTT probe interval, default kProbeInterval, negative to disable
+	ProbeInterval time.Duration
+	// stats report interval, default kReportInterval, negative to disable
+	ReportInterval time.Duration
+	// use SO_TIMESTAMPNS for RTT
+	KernelTimestamp bool
+	// loss windows of Stats, default 100, 1000, 10000
+	StatsWindows []uint32
+	// sockets, default OSNetwork
+	Network Network
+	// use an unprivileged ping socket if the Network supports it, fall back to raw socket
+	Unprivileged bool
+	// do not attach the BPF filter to the raw socket
+	NoBPF bool
+	// stop with the error instead of reopening a failed socket
+	NoReopen bool
+	// packets per syscall, default kBatchSize, each takes a 64KiB buffer
+	BatchSize int
+	// optional, exposed to the admin API
+	LogLevel *slog.LevelVar
+	Capture  *Capture
+	// optional, notified of events
+	Observer Observer
+	// optional, sees inner datagrams of both directions
+	Middleware Pipeline
 	// states
-	raddr    *net.IPAddr
-	icmpconn *icmp.PacketConn
-	lconn    *net.UDPConn
-	pcaddr   unsafe.Pointer // client addr: *net.UDPConn
-	pktid    uint32
-	st       Stats
-	quiter   Quiter
+	conf    unsafe.Pointer   // current config: *localConf
+	icmp    socket           // to remote
+	chans   []*clientChannel // channel 0 and Mappings
+	icmpseq uint32           // atomic, lower 16 bits used
+	npkt    uint64           // atomic, forwarded packets
+	verbose int32            // atomic, set by admin
+	seen    int64            // atomic, unix nano of the last packet from remote
+	up      trafficCounter
+	down    trafficCounter
+	cnt     counters
+	logs    logLimiter
+	delayed delayQueue // of both directions
+	pktid   uint32     // atomic
+	epoch   uint16     // of this run
+	st      Stats
+	group   *runGroup
+	lc      lifecycle
+	obs     Observer
+	// channel 0, the listener of Local
+	clientChannel
+	// rate limit of the down direction, the up direction is limited by channels
+	downlimit RateLimiter
+	// epochs of the remote, used by remote2local
+	peerEpoch     uint16
+	prevPeerEpoch uint16
+	// reverse forwarding
+	rtaddr   *net.UDPAddr
+	revMu    sync.Mutex
+	revConns map[uint32]*reverseConn // by session id
+}
+
+type localConf struct {
+	LocalConfig
+	raddr *net.IPAddr
+}
+
+func newLocalConf(c LocalConfig) (*localConf, error) {
+	var errs OptionErrors
+	errs.checkConfig(c.Obfuscator, c.RateLimit)
+
+	// remote addr
+	raddr, err := net.ResolveIPAddr("ip4", c.Remote)
+	if err != nil {
+		errs.add("Remote", "%v", err)
+	} else if raddr.IP == nil {
+		errs.add("Remote", "not set")
+	}
+	if err = errs.err(); err != nil {
+		return nil, err
+	}
+	return &localConf{LocalConfig: c, raddr: raddr}, nil
+}
+
+func (l *Local) loadConf() *localConf {
+	return (*localConf)(atomic.LoadPointer(&l.conf))
+}
+
+// Config returns the current config
+func (l *Local) Config() LocalConfig {
+	if conf := l.loadConf(); conf != nil {
+		return conf.LocalConfig
+	}
+	return l.LocalConfig
+}
+
+// Reload applies the new config to the running Local without touching sockets.
+func (l *Local) Reload(ctx context.Context, c LocalConfig) (changes []string, err error) {
+	old := l.loadConf()
+	if old == nil {
+		return nil, errors.New("local not running")
+	}
+
+	conf, err := newLocalConf(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// diff
+	var diff confDiff
+	diff.add("remote", old.raddr, conf.raddr)
+	diff.addObfs(old.Obfuscator, conf.Obfuscator)
+	diff.add("ratelimit", old.RateLimit, conf.RateLimit)
+	if obfsEqual(old.Obfuscator, conf.Obfuscator) {
+		// keep the rand state
+		conf.Obfuscator = old.Obfuscator
+	}
+
+	// apply
+	atomic.StorePointer(&l.conf, unsafe.Pointer(conf))
+	for _, change := range diff {
+		logInfo(ctx, "reload", "change", change)
+	}
+	if !old.raddr.IP.Equal(conf.raddr.IP) {
+		l.attachFilter(ctx, l.icmp.get(), conf)
+	}
+	return diff, nil
 }
 
+// Run blocks until ctx is done, Close() is called or a fatal error. see also Start().
 func (l *Local) Run(ctx context.Context) error {
-	if l.LocalID == 0 || l.RemoteID == 0 || l.Obfuscator == nil {
-		return errors.New("c.LocalID == 0 || c.RemoteID == 0 || c.Obfuscator == nil")
+	return l.lc.run(ctx, l.run)
+}
+
+func (l *Local) run(ctx context.Context) error {
+	if err := l.Validate(); err != nil {
+		return err
 	}
+	ctx = logWith(ctx, nodeAttr("local", l.LocalID), nodeAttr("remote", l.RemoteID))
 
-	// remote addr
-	var err error
-	l.raddr, err = net.ResolveIPAddr("ip4", l.Remote)
+	conf, err := newLocalConf(l.LocalConfig)
 	if err != nil {
-		return errors.Wrap(err, "resolve remote")
+		return err
 	}
+	atomic.StorePointer(&l.conf, unsafe.Pointer(conf))
+	l.obs = observerOrNop(l.Observer)
+	l.rtaddr = nil
+	if l.Reverse != "" {
+		if l.rtaddr, err = net.ResolveUDPAddr("udp", l.Reverse); err != nil {
+			return errors.Wrap(err, "resolve reverse target")
+		}
+	}
+	l.revConns = map[uint32]*reverseConn{}
 
 	// local conn
-	lconn, err := net.ListenPacket("udp", l.Local)
+	network := networkOrDefault(l.Network)
+	l.clientChannel.init(0, l.Local, network, l.NoReopen)
+	lconn, err := l.lconn.open()
 	if err != nil {
-		return errors.Wrap(err, "listen on local")
+		return err
+	}
+	l.lconn.set(lconn)
+	if err = l.openChannels(ctx, network); err != nil {
+		return err
 	}
-	defer SafeClose(ctx, lconn)
-	l.lconn = lconn.(*net.UDPConn)
 
-	// ICMP Conn
-	l.icmpconn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	// ICMP Conn, the id of raw sockets is kept on reopen
+	rn := Rand64ByTime()
+	l.icmp.init("icmp", l.NoReopen, func() (*sockConn, error) {
+		return l.openICMP(ctx, network, uint16(rn))
+	})
+	icmp, err := l.icmp.open()
 	if err != nil {
-		return errors.Wrap(err, "listen for remote icmp")
+		l.closeChannels(ctx)
+		return err
 	}
-	defer SafeClose(ctx, l.icmpconn)
+	l.icmp.set(icmp)
 
 	// log
-	ctxlog.Infof(ctx, "start listening [remote:%v][local:%v]", l.raddr, l.lconn.LocalAddr())
+	l.epoch = newEpoch()
+	logInfo(ctx, "start listening", "remote_ip", conf.raddr.String(), "addr", lconn.LocalAddr().String(),
+		"icmp_id", icmp.icmpid, "ping_socket", icmp.ping, "epoch", l.epoch)
 
 	// init states
-	l.pktid = uint32(Rand64ByTime())
+	l.icmpseq = uint32(uint16(rn >> 16))
+	l.pktid = uint32(rn >> 32)
+	l.peerEpoch, l.prevPeerEpoch = 0, 0
+	l.st.Windows = l.StatsWindows
 	l.st.Init()
-	l.quiter.Init()
-
-	// convert ctx.Done() to quit flag
-	go func() {
-		<-ctx.Done()
-		l.quiter.Quit()
-	}()
+	l.group = newRunGroup(ctx)
 
-	// run
-	l.quiter.Go(func() { l.client2local(ctx) })
-	l.quiter.Go(func() { l.remote2local(ctx) })
-	l.quiter.Wait()
+	// run until ctx.Done() or a fatal error
+	for _, c := range l.chans {
+		l.group.Go(func() error { return l.client2local(ctx, c) })
+	}
+	l.group.Go(func() error { return l.remote2local(ctx) })
+	l.group.Go(func() error { return l.timers(ctx) })
+	l.lc.setReady()
+	<-l.group.Done()
 
-	// clean up
-	ctxlog.Debugf(ctx, "stopping")
+	// closing sockets stops the readers
+	logDebug(ctx, "stopping")
+	l.shutdown(ctx)
+	err = l.group.Wait()
+	l.logs.flush(ctx, time.Now().Add(kLogFloodInterval))
 
 	// done
+	if err != nil {
+		logError(ctx, "stopped by error", errAttr(err))
+		return err
+	}
 	return ctx.Err()
 }
 
-func (l *Local) client2local(ctx context.Context) {
-	rn := Rand64ByTime()
-	icmpid := uint16(rn)
-	icmpseq := uint16(rn >> 16)
-	ctxlog.Debugf(ctx, "ready to read from client [icmpid:%v]", icmpid)
+// opens and sets up the ICMP socket, rawID is the icmp id if not a ping socket
+func (l *Local) openICMP(ctx context.Context, network Network, rawID uint16) (*sockConn, error) {
+	sc, err := l.listenICMP(ctx, network, rawID)
+	if err != nil {
+		return nil, err
+	}
+	l.attachFilter(ctx, sc, l.loadConf())
+	if l.KernelTimestamp {
+		if sc.ping {
+			logWarn(ctx, "kernel timestamp not supported by ping socket")
+		} else if err = enableRxTimestamp(sc.PacketConn); err != nil {
+			SafeClose(ctx, sc)
+			return nil, err
+		}
+	}
+	return sc, nil
+}
+
+// opens a ping socket if Unprivileged and available, otherwise a raw socket
+func (l *Local) listenICMP(ctx context.Context, network Network, rawID uint16) (*sockConn, error) {
+	if pn, ok := network.(PingNetwork); ok && l.Unprivileged {
+		conn, id, err := pn.ListenPing()
+		if err == nil {
+			return &sockConn{PacketConn: conn, icmpid: id, ping: true}, nil
+		}
+		args := []any{errAttr(err)}
+		if val, serr := SysctlGet("net.ipv4.ping_group_range"); serr == nil {
+			args = append(args, "ping_group_range", strings.TrimSpace(string(val)))
+		}
+		logWarn(ctx, "ping socket not available, fall back to raw socket", args...)
+	} else if l.Unprivileged {
+		logWarn(ctx, "ping socket not supported by network, fall back to raw socket")
+	}
+
+	conn, err := network.ListenICMP()
+	if err != nil {
+		return nil, errors.Wrap(err, "listen for remote icmp")
+	}
+	return &sockConn{PacketConn: conn, icmpid: rawID}, nil
+}
+
+// only the echo replies of the remote with our id reach user space
+func (l *Local) attachFilter(ctx context.Context, sc *sockConn, conf *localConf) {
+	if l.NoBPF || sc.ping {
+		return
+	}
+	if err := attachBPF(sc.PacketConn, localBPF(conf.raddr.IP, sc.icmpid)); err != nil {
+		logWarn(ctx, "bpf filter not attached", errAttr(err))
+	}
+}
+
+func (l *Local) shutdown(ctx context.Context) {
+	timeout := l.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = kShutdownTimeout
+	}
+
+	// let the packets in flight be forwarded, unless stopped by error
+	if ctx.Err() != nil {
+		logDebug(ctx, "waiting for a quiet period")
+		waitQuiet(ctx, &l.npkt, time.Now().Add(timeout/2))
+	}
+
+	// nothing is sent after the close
+	l.delayed.stop()
+
+	// so the remote frees the peer
+	if err := l.sendCtrl(kCmdClose, nil); err != nil {
+		logError(ctx, "notify remote close", errAttr(err))
+	} else {
+		logDebug(ctx, "notified remote close")
+	}
+
+	l.expireReverse(ctx, time.Time{})
+	l.closeSockets(ctx)
+}
+
+func (l *Local) closeSockets(ctx context.Context) {
+	l.closeChannels(ctx)
+	l.icmp.close(ctx)
+}
+
+func (l *Local) nextICMPSeq() uint16 {
+	return uint16(atomic.AddUint32(&l.icmpseq, 1))
+}
+
+func (l *Local) sendCtrl(cmd uint32, payload []byte) error {
+	conf := l.loadConf()
+	icmp := l.icmp.get()
+	pkt := encodeCtrl(conf.Obfuscator, ICMPTypeEcho, icmp.icmpid, l.nextICMPSeq(),
+		l.LocalID, l.RemoteID, makeCmd(cmd, l.epoch), payload)
+	_, err := icmp.WriteTo(pkt, conf.raddr)
+	if err != nil {
+		inc(&l.cnt.icmpWrite)
+		return err
+	}
+	_ = l.Capture.outer(nil, conf.raddr.IP, pkt) // errors are logged on the data path
+	return nil
+}
+
+// sends RTT probes and stats reports to remote, and flushes suppressed logs
+func (l *Local) timers(ctx context.Context) error {
+	probe := newTicker(l.ProbeInterval, kProbeInterval)
+	report := newTicker(l.ReportInterval, kReportInterval)
+	interval := l.KeepaliveInterval
+	if interval == 0 && l.Reverse == "" {
+		interval = -1
+	}
+	keepalive := newTicker(interval, kKeepaliveInterval)
+	for {
+		now := time.Now()
+		if probe.tick(now) {
+			if err := l.sendCtrl(kCmdProbe, probePayload(now)); err != nil {
+				logError(ctx, "send probe", errAttr(err))
+			}
+		}
+		if report.tick(now) {
+			if err := l.sendCtrl(kCmdReport, encodeReport(l.st.Snapshot())); err != nil {
+				logError(ctx, "send report", errAttr(err))
+			}
+		}
+		if keepalive.tick(now) {
+			if err := l.sendCtrl(kCmdKeepalive, nil); err != nil {
+				logError(ctx, "send keepalive", errAttr(err))
+			}
+		}
+		l.expireReverse(ctx, now)
+		l.logs.flush(ctx, now)
+
+		select {
+		case <-l.group.Done():
+			return nil
+		case <-time.After(minDuration(kIOInterval, probe.until(now), report.until(now), keepalive.until(now))):
+		}
+	}
+}
+
+func (l *Local) client2local(ctx context.Context, c *clientChannel) error {
+	lconn, icmp := c.lconn.get(), l.icmp.get()
+	logDebug(ctx, "ready to read from client", "icmp_id", icmp.icmpid, "channel", c.ch)
 
 	//   1B |   1B |     2B | 2B |  2B | 8B |  4B |  4B |  4B |    4B |
 	// type | code | chksum | id | seq | HS | src | dst | cmd | pktid | data
 	// -------------------------------
 	//        ICMP ECHO HEADER
-	hs := l.Obfuscator.HeaderSize()
-	buf := make([]byte, 128*1024)
-	buf[0] = ICMPTypeEcho
-	buf[1] = 0
-	binary.BigEndian.PutUint16(buf[4:6], icmpid)
-	icmpData := buf[ICMPEchoHeaderSize:]
+	size := batchSizeOrDefault(l.BatchSize)
+	rb := newBatchReader(lconn.PacketConn, size, 0)
+	defer func() { rb.release() }() // rb is replaced on reopen
+	wb := newBatchWriter(icmp.PacketConn, size)
+	laddr := lconn.LocalAddr().(*net.UDPAddr)
+
+	queued := make([]queuedICMP, size)
+	var conf *localConf
+	done := func(i int, err error) {
+		if err != nil {
+			inc(&l.cnt.icmpWrite)
+			l.logs.log(ctx, slog.LevelError, "send to remote", "send to remote", errAttr(err))
+			return
+		}
+		q := &queued[i]
+		atomic.AddUint64(&l.npkt, 1)
+		l.up.add(q.size)
+		captureError(ctx, &l.logs, l.Capture.outer(nil, conf.raddr.IP, q.encoded))
 
-	for {
-		// test for quit flag
-		if l.quiter.IsQuit() {
-			break
+		// log
+		if level, ok := packetLogLevel(ctx, &l.verbose); ok {
+			logAt(ctx, level, "send to remote",
+				"icmp_seq", q.icmpseq, "pktid", q.pktid, "size", q.size, "wire_size", len(q.encoded))
 		}
+	}
 
-		// src dst cmd
-		binary.LittleEndian.PutUint32(icmpData[hs+0:hs+4], l.LocalID)
-		binary.LittleEndian.PutUint32(icmpData[hs+4:hs+8], l.RemoteID)
-		binary.LittleEndian.PutUint32(icmpData[hs+8:hs+12], 0)
+	errs := 0
+	for {
+		conf = l.loadConf()
+		hs := conf.Obfuscator.HeaderSize()
+		off := ICMPEchoHeaderSize + hs + kTunHeaderSize
 
 		// read from client
-		_ = l.lconn.SetReadDeadline(time.Now().Add(kIOInterval))
-		n, addr, err := l.lconn.ReadFrom(icmpData[hs+kTunHeaderSize:])
+		cnt, err := rb.read(ctx, off)
 		if err != nil {
-			// skip timeout
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if sc, rerr := c.lconn.readError(ctx, l.group, err, &errs); rerr != nil {
+				logDebug(ctx, "stopped read from client")
+				return rerr
+			} else if sc != nil {
+				rb.release()
+				rb = newBatchReader(sc.PacketConn, size, 0)
+				lconn, laddr = sc, sc.LocalAddr().(*net.UDPAddr)
 				continue
 			}
 
-			ctxlog.Errorf(ctx, "client read: %v", err)
+			inc(&l.cnt.udpRead)
+			l.logs.log(ctx, slog.LevelError, "client read", "client read", errAttr(err))
 			continue
 		}
-		caddr := addr.(*net.UDPAddr)
-
-		// update client addr
-		oaddr := (*net.UDPAddr)(atomic.LoadPointer(&l.pcaddr))
-		if oaddr == nil {
-			ctxlog.Infof(ctx, "learned client [addr:%v]", caddr)
-			atomic.StorePointer(&l.pcaddr, unsafe.Pointer(caddr))
-		} else if !(oaddr.IP.Equal(caddr.IP) && oaddr.Port == caddr.Port) {
-			ctxlog.Infof(ctx, "client addr update [old:%v] -> [new:%v]", oaddr, caddr)
-			atomic.StorePointer(&l.pcaddr, unsafe.Pointer(caddr))
+		errs = 0
+
+		// reopened by remote2local
+		if sc := l.icmp.get(); sc != icmp {
+			icmp = sc
+			wb = newBatchWriter(icmp.PacketConn, size)
 		}
 
-		// pktid
-		l.pktid++
-		binary.LittleEndian.PutUint32(icmpData[hs+12:hs+16], l.pktid)
+		for i := 0; i < cnt; i++ {
+			buf := rb.bufs[i]
+			n := rb.msgs[i].N
+			caddr := rb.msgs[i].Addr.(*net.UDPAddr)
+
+			// update client addr
+			oaddr := (*net.UDPAddr)(atomic.LoadPointer(&c.pcaddr))
+			if oaddr == nil {
+				logInfo(ctx, "learned client", "client", caddr.String(), "channel", c.ch)
+				atomic.StorePointer(&c.pcaddr, unsafe.Pointer(caddr))
+				l.obs.ClientAddr(c.ch, nil, caddr)
+			} else if !(oaddr.IP.Equal(caddr.IP) && oaddr.Port == caddr.Port) {
+				logInfo(ctx, "client addr update", "old", oaddr.String(), "client", caddr.String(), "channel", c.ch)
+				atomic.StorePointer(&c.pcaddr, unsafe.Pointer(caddr))
+				l.obs.ClientAddr(c.ch, oaddr, caddr)
+			}
+			captureError(ctx, &l.logs, l.Capture.inner(caddr, laddr, buf[off:off+n]))
+
+			// rate limit
+			if !c.uplimit.Allow(conf.RateLimit, time.Now()) {
+				inc(&l.cnt.rateLimited)
+				if level, ok := packetLogLevel(ctx, &l.verbose); ok {
+					logAt(ctx, level, "rate limited", "dir", "up", "size", n)
+				}
+				continue
+			}
 
-		// encode
-		encoded := l.Obfuscator.Encode(buf[:ICMPEchoHeaderSize], icmpData[hs:hs+kTunHeaderSize+n])
-		if &buf[0] != &encoded[0] {
-			panic("should reuse buf")
-		}
+			// middleware, dropped packets do not take pktids
+			pktid := atomic.LoadUint32(&l.pktid) + 1
+			meta := PacketMeta{Dir: ClientToRemote, Self: l.LocalID, Node: l.RemoteID, PktID: pktid, Channel: c.ch, Src: caddr, Dst: laddr}
+			n, v := l.Middleware.runInPlace(meta, buf, off, n)
+			l.mirror(ctx, lconn, buf[off:off+n], v.Mirror)
+			if v.Drop {
+				continue
+			}
+			pktid = atomic.AddUint32(&l.pktid, 1)
+			if v.Delay > 0 {
+				l.sendLater(ctx, v.Delay, buf[off:off+n], c.ch, pktid)
+				continue
+			}
 
-		// icmp seq
-		icmpseq++
-		binary.BigEndian.PutUint16(encoded[6:8], icmpseq)
-		// checksum
-		checksumPut(encoded[2:4], encoded)
+			// encode
+			icmpseq := l.nextICMPSeq()
+			encoded := encodeData(conf.Obfuscator, buf, n, ICMPTypeEcho, icmp.icmpid, icmpseq,
+				l.LocalID, l.RemoteID, withChannel(makeCmd(kCmdData, l.epoch), c.ch), pktid)
 
-		// write icmp req
-		_, err = l.icmpconn.WriteTo(encoded, l.raddr)
-		if err != nil {
-			ctxlog.Errorf(ctx, "reply local error: %v", err)
-			continue
+			// queue icmp req
+			queued[wb.n] = queuedICMP{size: n, pktid: pktid, icmpseq: icmpseq, encoded: encoded}
+			wb.add(encoded, conf.raddr)
 		}
 
-		// log
-		if l.Verbose {
-			ctxlog.Debugf(ctx, "send icmp packet to remote [icmpseq:%v] [pktid:%v] [size:%v/%v]",
-				icmpseq, l.pktid, n, len(encoded))
-		}
+		// write icmp reqs
+		wb.flush(done)
 	}
-
-	ctxlog.Debugf(ctx, "stopped read from client")
 }
 
-func (l *Local) remote2local(ctx context.Context) {
-	ctxlog.Debugf(ctx, "ready to read icmp from remote")
+func (l *Local) remote2local(ctx context.Context) error {
+	logDebug(ctx, "ready to read icmp from remote")
 
-	hs := l.Obfuscator.HeaderSize()
-	buf := make([]byte, 128*1024)
-	for {
-		// test for quit flag
-		if l.quiter.IsQuit() {
-			break
+	size := batchSizeOrDefault(l.BatchSize)
+	oobSize := 0
+	if l.KernelTimestamp {
+		oobSize = 128
+	}
+	icmp, lconn := l.icmp.get(), l.lconn.get()
+	rb := newBatchReader(icmp.PacketConn, size, oobSize)
+	defer func() { rb.release() }() // rb is replaced on reopen
+	wb := newBatchWriter(lconn.PacketConn, size)
+	laddr := lconn.LocalAddr().(*net.UDPAddr)
+	done := func(i int, err error) {
+		if err != nil {
+			inc(&l.cnt.udpWrite)
+			l.logs.log(ctx, slog.LevelError, "write client", "write client", errAttr(err))
+			return
 		}
+		data := wb.msgs[i].Buffers[0]
+		atomic.AddUint64(&l.npkt, 1)
+		l.down.add(len(data))
+		captureError(ctx, &l.logs, l.Capture.inner(laddr, wb.msgs[i].Addr.(*net.UDPAddr), data))
+	}
 
+	errs := 0
+	for {
 		// read from remote
-		_ = l.icmpconn.SetReadDeadline(time.Now().Add(kIOInterval))
-		n, addr, err := l.icmpconn.ReadFrom(buf)
+		cnt, err := rb.read(ctx, 0)
 		if err != nil {
-			// skip timeout
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if sc, rerr := l.icmp.readError(ctx, l.group, err, &errs); rerr != nil {
+				logDebug(ctx, "stopped to read icmp from remote")
+				return rerr
+			} else if sc != nil {
+				rb.release()
+				rb = newBatchReader(sc.PacketConn, size, oobSize)
 				continue
 			}
 
-			ctxlog.Errorf(ctx, "remote read: %v", err)
+			inc(&l.cnt.icmpRead)
+			l.logs.log(ctx, slog.LevelError, "remote read", "remote read", errAttr(err))
 			continue
 		}
-		ipaddr := addr.(*net.IPAddr)
+		errs = 0
 
-		if n < ICMPEchoHeaderSize+hs {
-			ctxlog.Warnf(ctx, "icmp packet too short, [ip:%v][length:%v]", ipaddr, n)
-			continue
+		// reopened by client2local
+		if sc := l.lconn.get(); sc != lconn {
+			lconn = sc
+			wb = newBatchWriter(lconn.PacketConn, size)
+			laddr = lconn.LocalAddr().(*net.UDPAddr)
 		}
-		if buf[0] != ICMPTypeEchoReply {
-			ctxlog.Debugf(ctx, "not icmp type echo [ip:%v][reply:%v]", ipaddr, buf[0])
-			continue
-		}
-		icmpID := binary.BigEndian.Uint16(buf[4:6])
-		icmpSeq := binary.BigEndian.Uint16(buf[6:8])
-		icmpData := buf[ICMPEchoHeaderSize:n]
 
-		// decode inplace
-		data, err := l.Obfuscator.Decode(icmpData[hs:], icmpData)
-		if err != nil {
-			ctxlog.Warnf(ctx, "[ip:%v][icmpid:%v][icmpseq:%v] Obfuscator.Decode: %v",
-				ipaddr, icmpID, icmpSeq, err)
-			continue
+		for i := 0; i < cnt; i++ {
+			msg := &rb.msgs[i]
+			rxts := rxTimestamp(msg.OOB[:msg.NN])
+			data, caddr, c := l.handleRemote(ctx, rb.bufs[i], msg.N, msg.Addr.(*net.IPAddr), rxts)
+			if data == nil {
+				continue
+			}
+			if c == &l.clientChannel {
+				wb.add(data, caddr)
+			} else {
+				l.writeClient(ctx, c, data, caddr)
+			}
 		}
-		if &icmpData[hs] != &data[0] {
-			panic("should reuse buf")
+
+		// send data to client
+		wb.flush(done)
+	} // for loop
+}
+
+// returns the data to the client of the channel, if any
+func (l *Local) handleRemote(
+	ctx context.Context, buf []byte, n int, ipaddr *net.IPAddr, rxts time.Time) ([]byte, *net.UDPAddr, *clientChannel) {
+	// body
+	conf := l.loadConf()
+	hs := conf.Obfuscator.HeaderSize()
+
+	if n < ICMPEchoHeaderSize+hs {
+		l.logs.log(ctx, slog.LevelWarn, "short:"+ipaddr.String(), "icmp packet too short", "ip", ipaddr.String(), "size", n)
+		return nil, nil, nil
+	}
+	if buf[0] != ICMPTypeEchoReply {
+		l.logs.log(ctx, slog.LevelDebug, "type:"+ipaddr.String(), "not icmp echo reply", "ip", ipaddr.String(), "icmp_type", buf[0])
+		return nil, nil, nil
+	}
+	icmpID := binary.BigEndian.Uint16(buf[4:6])
+	icmpSeq := binary.BigEndian.Uint16(buf[6:8])
+	icmpData := buf[ICMPEchoHeaderSize:n]
+	captureError(ctx, &l.logs, l.Capture.outer(ipaddr.IP, nil, buf[:n]))
+
+	// decode inplace
+	data, err := conf.Obfuscator.Decode(icmpData[hs:], icmpData)
+	if err != nil {
+		inc(&l.cnt.decodeErrors)
+		l.logs.log(ctx, slog.LevelWarn, "decode:"+ipaddr.String(), "decode",
+			"ip", ipaddr.String(), "icmp_id", icmpID, "icmp_seq", icmpSeq, errAttr(err))
+		l.obs.DecodeError(ipaddr.IP, err)
+		return nil, nil, nil
+	}
+	if &icmpData[hs] != &data[0] {
+		panic("should reuse buf")
+	}
+
+	// src dst cmd pktid
+	if len(data) < kTunHeaderSize {
+		l.logs.log(ctx, slog.LevelError, "short:"+ipaddr.String(), "short data",
+			"ip", ipaddr.String(), "icmp_id", icmpID, "icmp_seq", icmpSeq, "size", len(data))
+		return nil, nil, nil
+	}
+	src := binary.LittleEndian.Uint32(data[0:4])
+	dst := binary.LittleEndian.Uint32(data[4:8])
+	cmdField := binary.LittleEndian.Uint32(data[8:12])
+	cmd, epoch := splitCmd(cmdField)
+	pktid := binary.LittleEndian.Uint32(data[12:16])
+	data = data[kTunHeaderSize:]
+
+	if !(src == l.RemoteID && dst == l.LocalID) {
+		inc(&l.cnt.idMismatches)
+		l.logs.log(ctx, slog.LevelError, "mismatch:"+ipaddr.String(), "node id mismatch",
+			"ip", ipaddr.String(), "icmp_id", icmpID, "icmp_seq", icmpSeq, nodeAttr("src", src), nodeAttr("dst", dst))
+		l.obs.NodeIDMismatch(ipaddr.IP, src, dst)
+		return nil, nil, nil
+	}
+
+	// session of the remote
+	switch epochState(l.peerEpoch, l.prevPeerEpoch, epoch) {
+	case epochStale:
+		inc(&l.cnt.staleEpoch)
+		l.logs.log(ctx, slog.LevelDebug, "stale epoch", "drop from previous session of remote", "epoch", epoch)
+		return nil, nil, nil
+	case epochNew:
+		if l.peerEpoch == 0 {
+			logInfo(ctx, "remote session", "epoch", epoch)
+		} else {
+			inc(&l.cnt.peerRestarts)
+			logNotice(ctx, "remote restarted", "old_epoch", l.peerEpoch, "epoch", epoch)
+			l.st.Reset()
+			l.expireReverse(ctx, time.Time{})
 		}
+		l.prevPeerEpoch, l.peerEpoch = l.peerEpoch, epoch
+	}
 
-		// src dst cmd pktid
-		if len(data) < kTunHeaderSize {
-			ctxlog.Errorf(ctx, "[ip:%v][icmpid:%v][icmpseq:%v] short data, length: %v",
-				ipaddr, icmpID, icmpSeq, len(data))
-			continue
+	atomic.StoreInt64(&l.seen, time.Now().UnixNano())
+
+	// control packets
+	switch cmd {
+	case kCmdData:
+		// pass
+	case kCmdClose:
+		logNotice(ctx, "remote is closing")
+		l.st.Reset()
+		return nil, nil, nil
+	case kCmdProbe:
+		if err := l.sendCtrl(kCmdProbeAck, data); err != nil {
+			logError(ctx, "probe ack", errAttr(err))
 		}
-		src := binary.LittleEndian.Uint32(data[0:4])
-		dst := binary.LittleEndian.Uint32(data[4:8])
-		pktid := binary.LittleEndian.Uint32(data[12:16])
-		data = data[kTunHeaderSize:]
-
-		if !(src == l.RemoteID && dst == l.LocalID) {
-			ctxlog.Errorf(ctx, "[ip:%v][icmpid:%v][icmpseq:%v] [src:%v][dst:%v] mismatch with [remote:%v][local:%v]",
-				ipaddr, icmpID, icmpSeq, src, dst, l.RemoteID, l.LocalID)
-			continue
+		return nil, nil, nil
+	case kCmdProbeAck:
+		if rtt, ok := probeRTT(data, rxts); ok {
+			l.st.AddRTT(rtt)
+		}
+		return nil, nil, nil
+	case kCmdReport:
+		if peer, err := decodeReport(data); err != nil {
+			inc(&l.cnt.decodeErrors)
+			logError(ctx, "decode report", errAttr(err))
+			l.obs.DecodeError(ipaddr.IP, err)
+		} else {
+			l.st.SetPeer(peer)
+			if level, ok := packetLogLevel(ctx, &l.verbose); ok {
+				logAt(ctx, level, "report", "stats", peer)
+			}
 		}
+		return nil, nil, nil
+	case kCmdReverse:
+		l.handleReverse(ctx, data)
+		return nil, nil, nil
+	default:
+		l.logs.log(ctx, slog.LevelDebug, "unknown command", "unknown command", "cmd", cmd)
+		return nil, nil, nil
+	}
 
-		// log
-		if l.Verbose {
-			ctxlog.Debugf(ctx, "recv from [remote:%v] [ip:%v][icmpid:%v][icmpseq:%v] [pktid:%v] [size:%v/%v]",
-				src, ipaddr, icmpID, icmpSeq, pktid, len(data), n)
+	// log
+	if level, ok := packetLogLevel(ctx, &l.verbose); ok {
+		logAt(ctx, level, "recv from remote", "ip", ipaddr.String(), "icmp_id", icmpID, "icmp_seq", icmpSeq,
+			"pktid", pktid, "size", len(data), "wire_size", n)
+	}
+
+	// stats
+	if l.st.Update(pktid, len(data)) {
+		snap := l.st.Snapshot()
+		logInfo(ctx, "stats", "stats", snap)
+		l.obs.LossReport(l.RemoteID, snap)
+	}
+
+	// rate limit
+	if !l.downlimit.Allow(conf.RateLimit, time.Now()) {
+		inc(&l.cnt.rateLimited)
+		if level, ok := packetLogLevel(ctx, &l.verbose); ok {
+			logAt(ctx, level, "rate limited", "dir", "down", "pktid", pktid)
 		}
+		return nil, nil, nil
+	}
+
+	// load client addr
+	c := l.channel(cmdChannel(cmdField))
+	if c == nil {
+		inc(&l.cnt.unknownChan)
+		l.logs.log(ctx, slog.LevelWarn, "channel", "unknown channel", "channel", cmdChannel(cmdField))
+		return nil, nil, nil
+	}
+	caddr := (*net.UDPAddr)(atomic.LoadPointer(&c.pcaddr))
+	if caddr == nil {
+		l.logs.log(ctx, slog.LevelWarn, "no client", "client addr not learned")
+		return nil, nil, nil
+	}
 
-		// stats
-		if l.st.Update(pktid) {
-			ctxlog.Infof(ctx, "[remote:%v] loss count: [%v/%v] [%v/%v] [%v/%v]",
-				src,
-				l.st.Loss100, l.st.Count100,
-				l.st.Loss1000, l.st.Count1000,
-				l.st.Loss10000, l.st.Count10000,
-			)
+	// middleware
+	lconn := c.lconn.get()
+	meta := PacketMeta{Dir: RemoteToClient, Self: l.LocalID, Node: l.RemoteID, PktID: pktid, Channel: c.ch,
+		Src: lconn.LocalAddr().(*net.UDPAddr), Dst: caddr}
+	data, v := l.Middleware.run(meta, data)
+	l.mirror(ctx, lconn, data, v.Mirror)
+	if v.Drop {
+		return nil, nil, nil
+	}
+	if v.Delay > 0 {
+		if !l.delayed.add(v.Delay, data, func(data []byte) { l.writeClient(ctx, c, data, caddr) }) {
+			inc(&l.cnt.delayDrops)
+			l.logs.log(ctx, slog.LevelWarn, "delay", "delayed datagram dropped")
 		}
+		return nil, nil, nil
+	}
+	return data, caddr, c
+}
 
-		// load client addr
-		caddr := (*net.UDPAddr)(atomic.LoadPointer(&l.pcaddr))
-		if caddr == nil {
-			ctxlog.Warnf(ctx, "client addr not learned")
-			continue
+// writes a datagram of the remote to the client, channel 0 is batched by remote2local
+func (l *Local) writeClient(ctx context.Context, c *clientChannel, data []byte, caddr *net.UDPAddr) {
+	lconn := c.lconn.get()
+	if _, err := lconn.WriteTo(data, caddr); err != nil {
+		inc(&l.cnt.udpWrite)
+		l.logs.log(ctx, slog.LevelError, "write client", "write client", errAttr(err))
+		return
+	}
+	atomic.AddUint64(&l.npkt, 1)
+	l.down.add(len(data))
+	captureError(ctx, &l.logs, l.Capture.inner(lconn.LocalAddr().(*net.UDPAddr), caddr, data))
+}
+
+// sends the datagram to remote after delay
+func (l *Local) sendLater(ctx context.Context, delay time.Duration, data []byte, ch uint8, pktid uint32) {
+	added := l.delayed.add(delay, data, func(data []byte) {
+		conf := l.loadConf()
+		icmp := l.icmp.get()
+		buf := getBuf(kPacketBufSize)
+		defer putBuf(buf)
+
+		n := copy(buf[ICMPEchoHeaderSize+conf.Obfuscator.HeaderSize()+kTunHeaderSize:], data)
+		encoded := encodeData(conf.Obfuscator, buf, n, ICMPTypeEcho, icmp.icmpid, l.nextICMPSeq(),
+			l.LocalID, l.RemoteID, withChannel(makeCmd(kCmdData, l.epoch), ch), pktid)
+		if _, err := icmp.WriteTo(encoded, conf.raddr); err != nil {
+			inc(&l.cnt.icmpWrite)
+			l.logs.log(ctx, slog.LevelError, "send to remote", "send to remote", errAttr(err))
+			return
 		}
+		atomic.AddUint64(&l.npkt, 1)
+		l.up.add(n)
+	})
+	if !added {
+		inc(&l.cnt.delayDrops)
+		l.logs.log(ctx, slog.LevelWarn, "delay", "delayed datagram dropped")
+	}
+}
 
-		// send data to client
-		_, err = l.lconn.WriteToUDP(data, caddr)
-		if err != nil {
-			ctxlog.Errorf(ctx, "write client from [remote:%v]: %v", src, err)
-			continue
+func (l *Local) mirror(ctx context.Context, conn net.PacketConn, data []byte, addrs []*net.UDPAddr) {
+	if err := mirror(conn, data, addrs); err != nil {
+		inc(&l.cnt.udpWrite)
+		l.logs.log(ctx, slog.LevelError, "mirror", "mirror", errAttr(err))
+	}
+}
+
+func (l *Local) CollectMetrics(m *Metrics) {
+	labels := []string{"local", nodeLabel(l.LocalID), "remote", nodeLabel(l.RemoteID)}
+	l.up.collect(m, append(labels, "dir", "up")...)
+	l.down.collect(m, append(labels, "dir", "down")...)
+	snap := l.st.Snapshot()
+	collectStats(m, snap, append(labels, "dir", "down")...)
+	if snap.Peer != nil {
+		collectStats(m, *snap.Peer, append(labels, "dir", "up")...)
+	}
+	l.cnt.collect(m, "client", labels...)
+	l.icmp.collect(m, labels...)
+	for _, c := range l.chans {
+		c.lconn.collect(m, labels...)
+	}
+	l.logs.collect(m, labels...)
+}
+
+// the remote is the only peer
+func (l *Local) Peers() []PeerInfo {
+	conf := l.loadConf()
+	if conf == nil {
+		return nil
+	}
+
+	info := PeerInfo{
+		ID:          nodeLabel(l.RemoteID),
+		IP:          conf.raddr.String(),
+		ICMPSeq:     uint16(atomic.LoadUint32(&l.icmpseq)),
+		UpPackets:   atomic.LoadUint64(&l.up.packets),
+		UpBytes:     atomic.LoadUint64(&l.up.bytes),
+		DownPackets: atomic.LoadUint64(&l.down.packets),
+		DownBytes:   atomic.LoadUint64(&l.down.bytes),
+		Stats:       l.st.Snapshot(),
+		LastSeen:    time.Unix(0, atomic.LoadInt64(&l.seen)),
+		Verbose:     atomic.LoadInt32(&l.verbose) != 0,
+	}
+	if sc := l.icmp.get(); sc != nil {
+		info.ICMPID = sc.icmpid
+	}
+	if sc := l.lconn.get(); sc != nil {
+		info.Socket = sc.LocalAddr().String()
+	}
+	if caddr := (*net.UDPAddr)(atomic.LoadPointer(&l.pcaddr)); caddr != nil {
+		info.Target = caddr.String()
+	}
+	for _, c := range l.chans {
+		if c.ch != 0 {
+			info.Channels = append(info.Channels, c.info())
 		}
+	}
+	return []PeerInfo{info}
+}
 
-		// done
-	} // for loop
+func (l *Local) DumpConfig() map[string]interface{} {
+	c := l.Config()
+	return map[string]interface{}{
+		"log_level":    logLevelName(l.LogLevel),
+		"local_id":     nodeLabel(l.LocalID),
+		"remote_id":    nodeLabel(l.RemoteID),
+		"local":        l.Local,
+		"reverse":      l.Reverse,
+		"mappings":     formatMappings(l.Mappings),
+		"remote":       c.Remote,
+		"unprivileged": l.Unprivileged,
+		"obfs":         ObfsName(c.Obfuscator),
+		"rate_limit":   c.RateLimit,
+	}
+}
+
+func (l *Local) SetPeerVerbose(id uint32, on bool) bool {
+	if id != l.RemoteID {
+		return false
+	}
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&l.verbose, v)
+	return true
+}
+
+// Stats of the downstream and RTT, with the upstream reported by remote in Peer
+func (l *Local) Stats() StatsSnapshot {
+	return l.st.Snapshot()
+}
+
+func (l *Local) LogLevelVar() *slog.LevelVar {
+	return l.LogLevel
+}
 
-	ctxlog.Debugf(ctx, "stopped to read icmp from remote")
+func (l *Local) CaptureControl() *Capture {
+	return l.Capture
 }
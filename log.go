@@ -0,0 +1,189 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// levels besides slog's
+const (
+	LevelTrace  = slog.LevelDebug - 4
+	LevelNotice = slog.LevelInfo + 2
+)
+
+type loggerKey struct{}
+
+// WithLogger attaches logger to ctx
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger attached to ctx, or slog.Default()
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// adds fields to all logs of ctx
+func logWith(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, Logger(ctx).With(args...))
+}
+
+func logAt(ctx context.Context, level slog.Level, msg string, args ...any) {
+	Logger(ctx).Log(ctx, level, msg, args...)
+}
+
+func logDebug(ctx context.Context, msg string, args ...any) {
+	logAt(ctx, slog.LevelDebug, msg, args...)
+}
+
+func logInfo(ctx context.Context, msg string, args ...any) {
+	logAt(ctx, slog.LevelInfo, msg, args...)
+}
+
+func logNotice(ctx context.Context, msg string, args ...any) {
+	logAt(ctx, LevelNotice, msg, args...)
+}
+
+func logWarn(ctx context.Context, msg string, args ...any) {
+	logAt(ctx, slog.LevelWarn, msg, args...)
+}
+
+func logError(ctx context.Context, msg string, args ...any) {
+	logAt(ctx, slog.LevelError, msg, args...)
+}
+
+// level of per-packet logs: debug, or info for peers set verbose by admin
+func packetLogLevel(ctx context.Context, verbose *int32) (slog.Level, bool) {
+	if atomic.LoadInt32(verbose) != 0 {
+		return slog.LevelInfo, true
+	}
+	return slog.LevelDebug, Logger(ctx).Enabled(ctx, slog.LevelDebug)
+}
+
+// common fields
+func nodeAttr(key string, id uint32) slog.Attr {
+	return slog.String(key, nodeLabel(id))
+}
+
+func errAttr(err error) slog.Attr {
+	return slog.String("err", err.Error())
+}
+
+// ParseLogLevel accepts trace, debug, info, notice, warn and error
+func ParseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return LevelTrace, nil
+	case "notice":
+		return LevelNotice, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, errors.Errorf("invalid log level: %v", s)
+	}
+	return level, nil
+}
+
+// LevelName is the inverse of ParseLogLevel
+func LevelName(level slog.Level) string {
+	switch level {
+	case LevelTrace:
+		return "TRACE"
+	case LevelNotice:
+		return "NOTICE"
+	}
+	return level.String()
+}
+
+// NewLogHandler creates a "text" or "json" handler
+func NewLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.LevelKey {
+				if level, ok := a.Value.Any().(slog.Level); ok {
+					a.Value = slog.StringValue(LevelName(level))
+				}
+			}
+			return a
+		},
+	}
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, errors.Errorf("invalid log format: %v", format)
+	}
+}
+
+// LogFile is an appending log file that can be reopened after rotation
+type LogFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	lf := &LogFile{path: path}
+	if err := lf.Reopen(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *LogFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	return lf.f.Write(p)
+}
+
+// Reopen opens the path again, e.g. on SIGHUP after logrotate
+func (lf *LogFile) Reopen() error {
+	f, err := os.OpenFile(lf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "open log file")
+	}
+
+	lf.mu.Lock()
+	old := lf.f
+	lf.f = f
+	lf.mu.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+func (lf *LogFile) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
+
+// for DumpConfig
+func logLevelName(lv *slog.LevelVar) string {
+	if lv == nil {
+		return ""
+	}
+	return LevelName(lv.Level())
+}
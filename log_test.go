@@ -0,0 +1,79 @@
+package icmp_tun
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, name := range []string{"TRACE", "DEBUG", "INFO", "NOTICE", "WARN", "ERROR"} {
+		level, err := ParseLogLevel(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, LevelName(level))
+	}
+	level, err := ParseLogLevel("debug")
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, level)
+	_, err = ParseLogLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestNewLogHandler(t *testing.T) {
+	buf := bytes.Buffer{}
+	lv := slog.LevelVar{}
+	h, err := NewLogHandler(&buf, "json", &lv)
+	assert.NoError(t, err)
+
+	ctx := WithLogger(context.Background(), slog.New(h))
+	ctx = logWith(ctx, nodeAttr("local", 1))
+	logDebug(ctx, "hidden")
+	logNotice(ctx, "remote is closing", "pktid", 3)
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), `"level":"NOTICE","msg":"remote is closing","local":"0x00000001","pktid":3`)
+
+	// per-packet logs
+	var verbose int32
+	_, ok := packetLogLevel(ctx, &verbose)
+	assert.False(t, ok)
+	verbose = 1
+	level, ok := packetLogLevel(ctx, &verbose)
+	assert.True(t, ok)
+	assert.Equal(t, slog.LevelInfo, level)
+	verbose = 0
+	lv.Set(slog.LevelDebug)
+	_, ok = packetLogLevel(ctx, &verbose)
+	assert.True(t, ok)
+
+	_, err = NewLogHandler(&buf, "xml", &lv)
+	assert.Error(t, err)
+}
+
+func TestLogFile_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	lf, err := OpenLogFile(path)
+	assert.NoError(t, err)
+
+	_, err = lf.Write([]byte("1\n"))
+	assert.NoError(t, err)
+
+	// rotated
+	assert.NoError(t, os.Rename(path, path+".1"))
+	_, _ = lf.Write([]byte("2\n"))
+	assert.NoError(t, lf.Reopen())
+	_, err = lf.Write([]byte("3\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, lf.Close())
+
+	_, err = lf.Write([]byte("4\n"))
+	assert.Error(t, err)
+
+	old, _ := os.ReadFile(path + ".1")
+	cur, _ := os.ReadFile(path)
+	assert.Equal(t, "1\n2\n", string(old))
+	assert.Equal(t, "3\n", string(cur))
+}
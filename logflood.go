@@ -0,0 +1,97 @@
+package icmp_tun
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const kLogFloodInterval = 10 * time.Second
+const kLogFloodKeys = 1024
+
+// collapses repeated logs of the same key, e.g. per source ip and error class.
+// the first log of a key is written, the following ones within kLogFloodInterval
+// are counted and summarized by a later log or flush().
+type logLimiter struct {
+	mu         sync.Mutex
+	keys       map[string]*logFloodEntry
+	suppressed uint64 // atomic, total
+}
+
+type logFloodEntry struct {
+	level      slog.Level
+	msg        string
+	args       []any
+	last       time.Time // of the written log
+	suppressed uint64
+}
+
+// the key of logs when there are too many keys
+const kLogFloodOverflow = "overflow"
+
+func (ll *logLimiter) log(ctx context.Context, level slog.Level, key string, msg string, args ...any) {
+	if !Logger(ctx).Enabled(ctx, level) {
+		return
+	}
+	now := time.Now()
+
+	ll.mu.Lock()
+	if ll.keys == nil {
+		ll.keys = map[string]*logFloodEntry{}
+	}
+	e := ll.keys[key]
+	if e == nil && len(ll.keys) >= kLogFloodKeys {
+		key = kLogFloodOverflow
+		e = ll.keys[key]
+	}
+	if e != nil && now.Sub(e.last) < kLogFloodInterval {
+		e.suppressed++
+		e.level, e.msg, e.args = level, msg, args
+		ll.mu.Unlock()
+		atomic.AddUint64(&ll.suppressed, 1)
+		return
+	}
+
+	var suppressed uint64
+	if e == nil {
+		e = &logFloodEntry{}
+		ll.keys[key] = e
+	} else {
+		suppressed = e.suppressed
+	}
+	*e = logFloodEntry{last: now}
+	ll.mu.Unlock()
+
+	if suppressed > 0 {
+		args = append(args[:len(args):len(args)], "suppressed", suppressed)
+	}
+	logAt(ctx, level, msg, args...)
+}
+
+// writes summaries of keys idle for kLogFloodInterval, and forgets them
+func (ll *logLimiter) flush(ctx context.Context, now time.Time) {
+	var summaries []*logFloodEntry
+
+	ll.mu.Lock()
+	for key, e := range ll.keys {
+		if now.Sub(e.last) < kLogFloodInterval {
+			continue
+		}
+		delete(ll.keys, key)
+		if e.suppressed > 0 {
+			summaries = append(summaries, e)
+		}
+	}
+	ll.mu.Unlock()
+
+	for _, e := range summaries {
+		logAt(ctx, e.level, e.msg, append(e.args[:len(e.args):len(e.args)], "suppressed", e.suppressed)...)
+	}
+}
+
+func (ll *logLimiter) collect(m *Metrics, labels ...string) {
+	m.Counter("logs_suppressed_total", "Logs collapsed by flood protection.",
+		atomic.LoadUint64(&ll.suppressed), labels...)
+}
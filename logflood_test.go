@@ -0,0 +1,51 @@
+package icmp_tun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLimiter(t *testing.T) {
+	buf := bytes.Buffer{}
+	h, _ := NewLogHandler(&buf, "text", slog.LevelInfo)
+	ctx := WithLogger(context.Background(), slog.New(h))
+	ll := logLimiter{}
+
+	for i := 0; i < 100; i++ {
+		ll.log(ctx, slog.LevelWarn, "decode:1.1.1.1", "decode", "ip", "1.1.1.1", "seq", i)
+	}
+	ll.log(ctx, slog.LevelWarn, "decode:2.2.2.2", "decode", "ip", "2.2.2.2")
+	// disabled level is not counted
+	ll.log(ctx, slog.LevelDebug, "type:1.1.1.1", "not icmp echo")
+	assert.Equal(t, 2, strings.Count(buf.String(), "msg=decode"))
+	assert.Equal(t, uint64(99), ll.suppressed)
+
+	// not idle yet
+	ll.flush(ctx, time.Now())
+	assert.Equal(t, 2, strings.Count(buf.String(), "msg=decode"))
+
+	// summary with the latest args
+	buf.Reset()
+	ll.flush(ctx, time.Now().Add(kLogFloodInterval))
+	assert.Equal(t, "level=WARN msg=decode ip=1.1.1.1 seq=99 suppressed=99", strings.TrimSpace(buf.String()[strings.Index(buf.String(), "level="):]))
+	assert.Empty(t, ll.keys)
+}
+
+func TestLogLimiter_Overflow(t *testing.T) {
+	buf := bytes.Buffer{}
+	h, _ := NewLogHandler(&buf, "text", slog.LevelInfo)
+	ctx := WithLogger(context.Background(), slog.New(h))
+	ll := logLimiter{}
+
+	for i := 0; i < 2*kLogFloodKeys; i++ {
+		ll.log(ctx, slog.LevelWarn, fmt.Sprint("decode:", i), "decode")
+	}
+	assert.Equal(t, kLogFloodKeys+1, len(ll.keys))
+	assert.Equal(t, kLogFloodKeys+1, strings.Count(buf.String(), "msg=decode"))
+}
@@ -0,0 +1,242 @@
+package icmp_tun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsSource is implemented by Local and Remote
+type MetricsSource interface {
+	CollectMetrics(m *Metrics)
+}
+
+// Metrics collects samples in the Prometheus text format
+type Metrics struct {
+	names   []string
+	metrics map[string]*metric
+}
+
+type metric struct {
+	typ     string
+	help    string
+	samples []string
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{metrics: map[string]*metric{}}
+}
+
+// labels are name value pairs
+func (m *Metrics) Counter(name string, help string, value uint64, labels ...string) {
+	m.add(name, "counter", help, strconv.FormatUint(value, 10), labels)
+}
+
+func (m *Metrics) Gauge(name string, help string, value float64, labels ...string) {
+	m.add(name, "gauge", help, strconv.FormatFloat(value, 'g', -1, 64), labels)
+}
+
+func (m *Metrics) add(name string, typ string, help string, value string, labels []string) {
+	name = "icmp_tun_" + name
+	mt := m.metrics[name]
+	if mt == nil {
+		mt = &metric{typ: typ, help: help}
+		m.metrics[name] = mt
+		m.names = append(m.names, name)
+	}
+	mt.samples = append(mt.samples, name+formatLabels(labels)+" "+value)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	if len(labels)%2 != 0 {
+		panic("labels must be name value pairs")
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	names := append([]string(nil), m.names...)
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		mt := m.metrics[name]
+		fmt.Fprintf(&sb, "# HELP %s %s\n", name, mt.help)
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, mt.typ)
+		for _, sample := range mt.samples {
+			sb.WriteString(sample)
+			sb.WriteByte('\n')
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func MetricsHandler(sources ...MetricsSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := NewMetrics()
+		for _, src := range sources {
+			src.CollectMetrics(m)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = m.WriteTo(w)
+	})
+}
+
+// ServeMetrics serves /metrics on addr until ctx is done
+func ServeMetrics(ctx context.Context, addr string, sources ...MetricsSource) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler(sources...))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	logInfo(ctx, "serving metrics", "addr", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func nodeLabel(id uint32) string {
+	return fmt.Sprintf("0x%08X", id)
+}
+
+// traffic counters of one direction, updated atomically
+type trafficCounter struct {
+	packets uint64
+	bytes   uint64
+}
+
+func (tc *trafficCounter) add(size int) {
+	atomic.AddUint64(&tc.packets, 1)
+	atomic.AddUint64(&tc.bytes, uint64(size))
+}
+
+func (tc *trafficCounter) collect(m *Metrics, labels ...string) {
+	m.Counter("packets_total", "Tunneled packets.", atomic.LoadUint64(&tc.packets), labels...)
+	m.Counter("bytes_total", "Tunneled payload bytes.", atomic.LoadUint64(&tc.bytes), labels...)
+}
+
+// counters of an instance, updated atomically
+type counters struct {
+	decodeErrors uint64
+	idMismatches uint64
+	nonTarget    uint64
+	echoReplies  uint64
+	aclDenied    uint64
+	rateLimited  uint64
+	queueDrops   uint64
+	peerLimit    uint64
+	peerRestarts uint64
+	staleEpoch   uint64
+	relayed      uint64
+	relayDrops   uint64
+	reversed     uint64
+	reverseDrops uint64
+	unknownChan  uint64
+	delayDrops   uint64
+	// socket errors
+	icmpRead  uint64
+	icmpWrite uint64
+	udpRead   uint64
+	udpWrite  uint64
+}
+
+func (c *counters) collect(m *Metrics, udp string, labels ...string) {
+	m.Counter("decode_errors_total", "Packets failed to decode.",
+		atomic.LoadUint64(&c.decodeErrors), labels...)
+	m.Counter("node_id_mismatches_total", "Packets with unexpected node ids.",
+		atomic.LoadUint64(&c.idMismatches), labels...)
+	m.Counter("non_target_drops_total", "Packets dropped from non-target addresses.",
+		atomic.LoadUint64(&c.nonTarget), labels...)
+	m.Counter("echo_replies_total", "Emulated ICMP echo replies.",
+		atomic.LoadUint64(&c.echoReplies), labels...)
+	m.Counter("acl_denied_total", "Packets denied by ACL.",
+		atomic.LoadUint64(&c.aclDenied), labels...)
+	m.Counter("rate_limited_total", "Packets dropped by rate limit.",
+		atomic.LoadUint64(&c.rateLimited), labels...)
+	m.Counter("queue_drops_total", "Packets dropped by full worker queues.",
+		atomic.LoadUint64(&c.queueDrops), labels...)
+	m.Counter("peer_limit_drops_total", "Packets of new peers dropped by the peer limit.",
+		atomic.LoadUint64(&c.peerLimit), labels...)
+	m.Counter("peer_restarts_total", "Restarts of peers detected by session epochs.",
+		atomic.LoadUint64(&c.peerRestarts), labels...)
+	m.Counter("stale_epoch_drops_total", "Packets dropped from previous sessions of restarted peers.",
+		atomic.LoadUint64(&c.staleEpoch), labels...)
+	m.Counter("relayed_total", "Packets relayed between locals.",
+		atomic.LoadUint64(&c.relayed), labels...)
+	m.Counter("relay_drops_total", "Packets to relay dropped without a route.",
+		atomic.LoadUint64(&c.relayDrops), labels...)
+	m.Counter("reverse_packets_total", "Datagrams of reverse forwarding.",
+		atomic.LoadUint64(&c.reversed), labels...)
+	m.Counter("reverse_drops_total", "Datagrams of reverse forwarding dropped without a local or session.",
+		atomic.LoadUint64(&c.reverseDrops), labels...)
+	m.Counter("unknown_channel_drops_total", "Packets dropped on channels without a mapping or service.",
+		atomic.LoadUint64(&c.unknownChan), labels...)
+	m.Counter("delay_drops_total", "Datagrams delayed by middleware and dropped by the byte cap or shutdown.",
+		atomic.LoadUint64(&c.delayDrops), labels...)
+
+	const help = "Socket read and write errors."
+	sockErr := func(value *uint64, socket string, op string) {
+		m.Counter("socket_errors_total", help, atomic.LoadUint64(value),
+			append(labels[:len(labels):len(labels)], "socket", socket, "op", op)...)
+	}
+	sockErr(&c.icmpRead, "icmp", "read")
+	sockErr(&c.icmpWrite, "icmp", "write")
+	sockErr(&c.udpRead, udp, "read")
+	sockErr(&c.udpWrite, udp, "write")
+}
+
+func inc(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+func collectStats(m *Metrics, snap StatsSnapshot, labels ...string) {
+	with := func(extra ...string) []string {
+		return append(labels[:len(labels):len(labels)], extra...)
+	}
+
+	for _, w := range snap.Loss {
+		ratio := 0.0
+		if w.Count > 0 {
+			ratio = float64(w.Loss) / float64(w.Count)
+		}
+		m.Gauge("loss_ratio", "Packet loss ratio of the received direction over the last N pktids.",
+			ratio, with("window", strconv.Itoa(int(w.Window)))...)
+	}
+	m.Gauge("loss_ewma", "Packet loss ratio of the received direction, smoothed over reports.",
+		snap.EWMALoss, labels...)
+	m.Counter("out_of_order_total", "Packets received out of order.", snap.OutOfOrder, labels...)
+	m.Counter("duplicates_total", "Duplicated packets received.", snap.Duplicates, labels...)
+	m.Counter("pktid_resets_total", "Resets of the pktid sequence.", snap.Resets, labels...)
+
+	if snap.RTT.Count == 0 {
+		return
+	}
+	rtt := func(value time.Duration, stat string) {
+		m.Gauge("rtt_seconds", "Round trip time measured by probes over the latest samples.",
+			value.Seconds(), with("stat", stat)...)
+	}
+	rtt(snap.RTT.Min, "min")
+	rtt(snap.RTT.Avg, "avg")
+	rtt(snap.RTT.Max, "max")
+	rtt(snap.RTT.P99, "p99")
+	rtt(snap.RTT.Jitter, "jitter")
+}
@@ -0,0 +1,45 @@
+package icmp_tun
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMetrics_WriteTo(t *testing.T) {
+	m := NewMetrics()
+	m.Counter("packets_total", "Tunneled packets.", 3, "local", "0x00000001", "dir", "up")
+	m.Gauge("peers", "Active peers.", 2)
+	m.Counter("packets_total", "Tunneled packets.", 5, "local", "0x00000001", "dir", "down")
+
+	buf := bytes.Buffer{}
+	_, err := m.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP icmp_tun_packets_total Tunneled packets.
+# TYPE icmp_tun_packets_total counter
+icmp_tun_packets_total{local="0x00000001",dir="up"} 3
+icmp_tun_packets_total{local="0x00000001",dir="down"} 5
+# HELP icmp_tun_peers Active peers.
+# TYPE icmp_tun_peers gauge
+icmp_tun_peers 2
+`, buf.String())
+}
+
+func TestMetrics_Loss(t *testing.T) {
+	st := Stats{Windows: []uint32{100, 1000}, ReportInterval: time.Nanosecond}
+	st.Init()
+	for pktid := uint32(1); pktid <= 250; pktid++ {
+		if pktid%20 != 0 {
+			st.Update(pktid, 10)
+		}
+	}
+
+	m := NewMetrics()
+	collectStats(m, st.Snapshot(), "local", "0x00000001")
+	buf := bytes.Buffer{}
+	_, _ = m.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `icmp_tun_loss_ratio{local="0x00000001",window="100"} 0.05`)
+	assert.Contains(t, buf.String(), `icmp_tun_loss_ratio{local="0x00000001",window="1000"} 0.0497`)
+	assert.Contains(t, buf.String(), `icmp_tun_duplicates_total{local="0x00000001"} 0`)
+}
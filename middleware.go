@@ -0,0 +1,161 @@
+package icmp_tun
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Direction of an inner datagram
+type Direction uint8
+
+const (
+	ClientToRemote Direction = iota // on Local
+	RemoteToClient                  // on Local
+	LocalToTarget                   // on Remote
+	TargetToLocal                   // on Remote
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToRemote:
+		return "client-to-remote"
+	case RemoteToClient:
+		return "remote-to-client"
+	case LocalToTarget:
+		return "local-to-target"
+	case TargetToLocal:
+		return "target-to-local"
+	default:
+		return "unknown"
+	}
+}
+
+// PacketMeta describes an inner datagram
+type PacketMeta struct {
+	Dir Direction
+	// this node: LocalID of Local, or the endpoint of Remote
+	Self uint32
+	// the other node: the remote of Local, or the local of a peer of Remote
+	Node uint32
+	// received pktid, or the pktid to be sent with
+	PktID uint32
+	// of Local.Mappings and Remote.Services, 0 for Local.Local and Remote.Target
+	Channel uint8
+	// UDP addresses of the datagram, e.g. the client and the listener of Local
+	Src *net.UDPAddr
+	Dst *net.UDPAddr
+}
+
+// Verdict of a Handler, the zero value passes the datagram
+type Verdict struct {
+	Drop bool
+	// send later, a delayed datagram keeps its pktid and arrives out of order
+	Delay time.Duration
+	// send a copy to these addresses from the UDP socket of the direction, even if dropped
+	Mirror []*net.UDPAddr
+}
+
+// Handler sees an inner datagram and returns the data to send, which can be modified in place
+// or replaced. called concurrently on the packet paths, must not block or retain data.
+type Handler interface {
+	Handle(meta PacketMeta, data []byte) ([]byte, Verdict)
+}
+
+type HandlerFunc func(meta PacketMeta, data []byte) ([]byte, Verdict)
+
+func (f HandlerFunc) Handle(meta PacketMeta, data []byte) ([]byte, Verdict) {
+	return f(meta, data)
+}
+
+// Pipeline runs handlers in order until one drops the datagram. delays add up, mirrors are merged.
+type Pipeline []Handler
+
+func (p Pipeline) run(meta PacketMeta, data []byte) ([]byte, Verdict) {
+	var v Verdict
+	for _, h := range p {
+		var hv Verdict
+		data, hv = h.Handle(meta, data)
+		v.Delay += hv.Delay
+		v.Mirror = append(v.Mirror, hv.Mirror...)
+		if hv.Drop {
+			v.Drop = true
+			break
+		}
+	}
+	return data, v
+}
+
+// runs on buf[off:off+n] which is encoded in place, returns the new n.
+// replaced data that does not fit in buf is dropped.
+func (p Pipeline) runInPlace(meta PacketMeta, buf []byte, off int, n int) (int, Verdict) {
+	if len(p) == 0 {
+		return n, Verdict{}
+	}
+	data, v := p.run(meta, buf[off:off+n])
+	if off+len(data) > len(buf) {
+		v.Drop = true
+		return 0, v
+	}
+	copy(buf[off:], data)
+	return len(data), v
+}
+
+// datagrams delayed by middleware, sent by timers until stopped
+type delayQueue struct {
+	mu      sync.Mutex
+	timers  map[*time.Timer]struct{}
+	bytes   int // waiting to be sent
+	stopped bool
+}
+
+// calls send with a copy of data after delay, false if stopped or over kMaxDelayedBytes
+func (q *delayQueue) add(delay time.Duration, data []byte, send func(data []byte)) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped || q.bytes+len(data) > kMaxDelayedBytes {
+		return false
+	}
+	if q.timers == nil {
+		q.timers = map[*time.Timer]struct{}{}
+	}
+
+	data = append([]byte(nil), data...)
+	q.bytes += len(data)
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if _, ok := q.timers[t]; !ok {
+			return // stopped
+		}
+		delete(q.timers, t)
+		q.bytes -= len(data)
+		send(data)
+	})
+	q.timers[t] = struct{}{}
+	return true
+}
+
+// drops the datagrams not sent yet, waits for the send in progress
+func (q *delayQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopped = true
+	for t := range q.timers {
+		t.Stop()
+	}
+	q.timers = nil
+	q.bytes = 0
+}
+
+// sends copies of data, returns the first error
+func mirror(conn net.PacketConn, data []byte, addrs []*net.UDPAddr) error {
+	var first error
+	for _, addr := range addrs {
+		if _, err := conn.WriteTo(data, addr); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
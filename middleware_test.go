@@ -0,0 +1,132 @@
+package icmp_tun
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	tap := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	var dirs []Direction
+	p := Pipeline{
+		HandlerFunc(func(meta PacketMeta, data []byte) ([]byte, Verdict) {
+			dirs = append(dirs, meta.Dir)
+			return bytes.ToUpper(data), Verdict{Delay: time.Second, Mirror: []*net.UDPAddr{tap}}
+		}),
+		HandlerFunc(func(meta PacketMeta, data []byte) ([]byte, Verdict) {
+			return append(data, '!'), Verdict{Delay: time.Second, Drop: meta.PktID == 2}
+		}),
+		HandlerFunc(func(meta PacketMeta, data []byte) ([]byte, Verdict) {
+			t.Fatal("after drop")
+			return data, Verdict{}
+		}),
+	}
+
+	data, v := p[:2].run(PacketMeta{Dir: LocalToTarget, PktID: 1}, []byte("abc"))
+	assert.Equal(t, "ABC!", string(data))
+	assert.Equal(t, Verdict{Delay: 2 * time.Second, Mirror: []*net.UDPAddr{tap}}, v)
+
+	_, v = p.run(PacketMeta{Dir: TargetToLocal, PktID: 2}, []byte("abc"))
+	assert.True(t, v.Drop)
+	assert.Equal(t, []Direction{LocalToTarget, TargetToLocal}, dirs)
+	assert.Equal(t, "target-to-local", TargetToLocal.String())
+}
+
+func TestPipeline_RunInPlace(t *testing.T) {
+	buf := make([]byte, 16)
+	copy(buf[4:], "abc")
+	n, v := Pipeline(nil).runInPlace(PacketMeta{}, buf, 4, 3)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, Verdict{}, v)
+
+	grow := Pipeline{HandlerFunc(func(meta PacketMeta, data []byte) ([]byte, Verdict) {
+		return []byte(strings.Repeat(string(data), 4)), Verdict{}
+	})}
+	n, v = grow.runInPlace(PacketMeta{}, buf, 4, 3)
+	assert.Equal(t, 12, n)
+	assert.False(t, v.Drop)
+	assert.Equal(t, "abcabcabcabc", string(buf[4:4+n]))
+
+	// too large
+	_, v = grow.runInPlace(PacketMeta{}, buf, 4, n)
+	assert.True(t, v.Drop)
+}
+
+func TestDelayQueue(t *testing.T) {
+	var q delayQueue
+	sent := make(chan string, 4)
+	send := func(data []byte) { sent <- string(data) }
+
+	data := []byte("abc")
+	require.True(t, q.add(time.Millisecond, data, send))
+	data[0] = 'x' // copied
+	assert.Equal(t, "abc", <-sent)
+
+	// the cap
+	big := make([]byte, kMaxDelayedBytes)
+	require.True(t, q.add(time.Hour, big, send))
+	assert.False(t, q.add(time.Millisecond, data, send))
+
+	// nothing sent after stop
+	q.stop()
+	assert.Zero(t, q.bytes)
+	assert.False(t, q.add(time.Millisecond, data, send))
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, sent)
+}
+
+func TestE2E_Middleware(t *testing.T) {
+	sn := NewSimNet(11)
+	tap, err := sn.Host(kTestLocalIP).ListenUDP("")
+	require.NoError(t, err)
+	defer tap.Close()
+
+	tt := startTunnel(t, sn, func(tt *testTunnel) {
+		tt.local.Middleware = Pipeline{HandlerFunc(func(meta PacketMeta, data []byte) ([]byte, Verdict) {
+			v := Verdict{Drop: bytes.HasPrefix(data, []byte("drop"))}
+			if meta.Dir == ClientToRemote && bytes.HasPrefix(data, []byte("tap")) {
+				v.Mirror = []*net.UDPAddr{tap.LocalAddr().(*net.UDPAddr)}
+			}
+			return data, v
+		})}
+		tt.remote.Middleware = Pipeline{HandlerFunc(func(meta PacketMeta, data []byte) ([]byte, Verdict) {
+			var v Verdict
+			switch {
+			case meta.Dir == LocalToTarget && bytes.HasPrefix(data, []byte("up")):
+				data = bytes.ToUpper(data)
+			case meta.Dir == TargetToLocal && bytes.HasPrefix(data, []byte("slow")):
+				v.Delay = 200 * time.Millisecond
+			}
+			return data, v
+		})}
+	})
+	tt.waitReady(t)
+
+	got := tt.roundtrip(t, []string{"drop-1", "up-1", "tap-1"}, 500*time.Millisecond)
+	assert.Equal(t, map[string]bool{"UP-1": true, "tap-1": true}, got)
+
+	buf := make([]byte, 64)
+	_ = tap.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := tap.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "tap-1", string(buf[:n]))
+
+	// the delayed echo arrives after the later one
+	start := time.Now()
+	_, err = tt.client.WriteTo([]byte("slow-1"), tt.laddr)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"fast-1": true}, tt.roundtrip(t, []string{"fast-1"}, 100*time.Millisecond))
+	_ = tt.client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = tt.client.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "slow-1", string(buf[:n]))
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+
+	// delayed packets keep their pktids
+	assert.Equal(t, uint64(1), tt.local.Stats().OutOfOrder)
+}
@@ -0,0 +1,454 @@
+package icmp_tun
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/net/icmp"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Network opens the sockets of Local and Remote
+type Network interface {
+	// raw socket of ICMPv4 messages without IP header, receives all ICMP packets of the host
+	ListenICMP() (net.PacketConn, error)
+	// UDP socket, empty addr for any port
+	ListenUDP(addr string) (net.PacketConn, error)
+}
+
+// PingNetwork is optionally implemented by Network for unprivileged ICMP
+type PingNetwork interface {
+	// ICMP echo socket without IP header, the kernel owns the echo id and only
+	// receives the echo replies of it. Returns the id.
+	ListenPing() (net.PacketConn, uint16, error)
+}
+
+// OSNetwork is the default Network, ListenICMP requires CAP_NET_RAW,
+// ListenPing requires the gid in net.ipv4.ping_group_range on linux.
+type OSNetwork struct{}
+
+func (OSNetwork) ListenICMP() (net.PacketConn, error) {
+	return net.ListenPacket("ip4:icmp", "0.0.0.0")
+}
+
+func (OSNetwork) ListenPing() (net.PacketConn, uint16, error) {
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		return nil, 0, err
+	}
+	// the id is the local port
+	id := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	return &pingConn{conn}, id, nil
+}
+
+// pingConn uses *net.IPAddr like raw sockets instead of *net.UDPAddr
+type pingConn struct {
+	net.PacketConn
+}
+
+func (c *pingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if uaddr, ok := addr.(*net.UDPAddr); ok {
+		addr = &net.IPAddr{IP: uaddr.IP, Zone: uaddr.Zone}
+	}
+	return n, addr, err
+}
+
+func (c *pingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ipaddr, ok := addr.(*net.IPAddr); ok {
+		addr = &net.UDPAddr{IP: ipaddr.IP, Zone: ipaddr.Zone}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (OSNetwork) ListenUDP(addr string) (net.PacketConn, error) {
+	if addr == "" {
+		return net.ListenUDP("udp4", nil)
+	}
+	return net.ListenPacket("udp", addr)
+}
+
+func networkOrDefault(n Network) Network {
+	if n == nil {
+		return OSNetwork{}
+	}
+	return n
+}
+
+// SimNet is an in-memory network for tests. Packets between different hosts are
+// subject to loss, delay, jitter (thus reordering) and MTU. Set fields before use.
+type SimNet struct {
+	// probability of dropping a packet
+	Loss float64
+	// one way delay, plus a random duration in [0, Jitter)
+	Delay  time.Duration
+	Jitter time.Duration
+	// IP packet size limit between hosts, 0 for unlimited. Bigger packets fail with EMSGSIZE.
+	MTU int
+	// ListenPing fails with EACCES, like a gid not in net.ipv4.ping_group_range
+	NoPing bool
+	// states
+	mu    sync.Mutex
+	rand  *rand.Rand
+	hosts map[string]*simHost
+	// delayed packets, delivered in order of due time then send order
+	pending simQueue
+	seq     uint64
+	timer   *time.Timer
+	running bool
+}
+
+func NewSimNet(seed int64) *SimNet {
+	return &SimNet{rand: rand.New(rand.NewSource(seed)), hosts: map[string]*simHost{}}
+}
+
+// Host returns the Network of the host with IPv4 address ip
+func (sn *SimNet) Host(ip string) Network {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	h := sn.hosts[ip]
+	if h == nil {
+		h = &simHost{
+			net: sn, ip: net.ParseIP(ip).To4(), nextPort: 40000, nextPing: 1,
+			udp: map[int]*simConn{}, icmp: map[*simConn]bool{},
+		}
+		sn.hosts[ip] = h
+	}
+	return h
+}
+
+// SetDown takes the host down like a removed interface: its sockets are closed
+// and new ones fail with ENETDOWN until it is up again.
+func (sn *SimNet) SetDown(ip string, down bool) {
+	h := sn.Host(ip).(*simHost)
+	var conns []*simConn
+	sn.mu.Lock()
+	h.down = down
+	if down {
+		for _, c := range h.udp {
+			conns = append(conns, c)
+		}
+		for c := range h.icmp {
+			conns = append(conns, c)
+		}
+	}
+	sn.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+type simHost struct {
+	net      *SimNet
+	ip       net.IP
+	down     bool
+	nextPort int
+	nextPing uint16
+	udp      map[int]*simConn
+	icmp     map[*simConn]bool // raw and ping sockets
+}
+
+func errNetDown(op string) error {
+	return os.NewSyscallError(op, syscall.ENETDOWN)
+}
+
+func (h *simHost) ListenICMP() (net.PacketConn, error) {
+	h.net.mu.Lock()
+	defer h.net.mu.Unlock()
+	if h.down {
+		return nil, errNetDown("socket")
+	}
+	c := newSimConn(h, &net.IPAddr{IP: h.ip})
+	h.icmp[c] = true
+	return c, nil
+}
+
+func (h *simHost) ListenPing() (net.PacketConn, uint16, error) {
+	h.net.mu.Lock()
+	defer h.net.mu.Unlock()
+	if h.down {
+		return nil, 0, errNetDown("socket")
+	}
+	if h.net.NoPing {
+		return nil, 0, os.NewSyscallError("socket", syscall.EACCES)
+	}
+	c := newSimConn(h, &net.IPAddr{IP: h.ip})
+	c.ping = true
+	c.pingID = h.nextPing
+	h.nextPing++
+	h.icmp[c] = true
+	return c, c.pingID, nil
+}
+
+func (h *simHost) ListenUDP(addr string) (net.PacketConn, error) {
+	port := 0
+	if addr != "" {
+		uaddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		port = uaddr.Port
+	}
+
+	h.net.mu.Lock()
+	defer h.net.mu.Unlock()
+	if h.down {
+		return nil, errNetDown("bind")
+	}
+	if port == 0 {
+		for h.udp[h.nextPort] != nil {
+			h.nextPort++
+		}
+		port = h.nextPort
+		h.nextPort++
+	}
+	if h.udp[port] != nil {
+		return nil, syscall.EADDRINUSE
+	}
+	c := newSimConn(h, &net.UDPAddr{IP: h.ip, Port: port})
+	h.udp[port] = c
+	return c, nil
+}
+
+type simPacket struct {
+	data []byte
+	from net.Addr
+}
+
+type simConn struct {
+	host     *simHost
+	laddr    net.Addr
+	ping     bool // ping socket of pingID
+	pingID   uint16
+	queue    chan simPacket
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newSimConn(h *simHost, laddr net.Addr) *simConn {
+	return &simConn{host: h, laddr: laddr, queue: make(chan simPacket, 1024), done: make(chan struct{})}
+}
+
+func (c *simConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.queue:
+		return copy(b, pkt.data), pkt.from, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *simConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	var ip net.IP
+	size := len(b) + 20
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+		size += 8
+	default:
+		return 0, errors.Errorf("unsupported addr: %v", addr)
+	}
+	sn := c.host.net
+
+	// destination
+	sn.mu.Lock()
+	dst := c.host
+	if !ip.IsLoopback() {
+		dst = sn.hosts[ip.String()]
+	}
+	var delay time.Duration
+	if dst != c.host {
+		if sn.MTU > 0 && size > sn.MTU {
+			sn.mu.Unlock()
+			return 0, syscall.EMSGSIZE
+		}
+		if sn.rand.Float64() < sn.Loss {
+			dst = nil
+		}
+		delay = sn.Delay
+		if sn.Jitter > 0 {
+			delay += time.Duration(sn.rand.Int63n(int64(sn.Jitter)))
+		}
+	}
+	sn.mu.Unlock()
+	if dst == nil {
+		// lost or no route
+		return len(b), nil
+	}
+
+	data := append([]byte(nil), b...)
+	if c.ping {
+		// the kernel only sends echo requests, with its own id
+		if len(data) < ICMPEchoHeaderSize || data[0] != ICMPTypeEcho {
+			return 0, syscall.EINVAL
+		}
+		binary.BigEndian.PutUint16(data[4:6], c.pingID)
+		checksumPut(data[2:4], data)
+	}
+	if delay > 0 {
+		sn.schedule(time.Now().Add(delay), func() { dst.deliver(c.laddr, addr, data) })
+	} else {
+		dst.deliver(c.laddr, addr, data)
+	}
+	return len(b), nil
+}
+
+type simEvent struct {
+	due time.Time
+	seq uint64
+	fn  func()
+}
+
+type simQueue []simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q simQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x any)   { *q = append(*q, x.(simEvent)) }
+func (q *simQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+func (sn *SimNet) schedule(due time.Time, fn func()) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.seq++
+	heap.Push(&sn.pending, simEvent{due: due, seq: sn.seq, fn: fn})
+	if sn.pending[0].seq == sn.seq && !sn.running {
+		// new earliest event
+		if sn.timer == nil {
+			sn.timer = time.AfterFunc(time.Until(due), sn.run)
+		} else {
+			sn.timer.Reset(time.Until(due))
+		}
+	}
+}
+
+// delivers due packets in order, a single timer avoids reordering by goroutine scheduling
+func (sn *SimNet) run() {
+	sn.mu.Lock()
+	if sn.running {
+		sn.mu.Unlock()
+		return
+	}
+	sn.running = true
+	for len(sn.pending) > 0 {
+		if d := time.Until(sn.pending[0].due); d > 0 {
+			sn.timer.Reset(d)
+			break
+		}
+		e := heap.Pop(&sn.pending).(simEvent)
+		sn.mu.Unlock()
+		e.fn()
+		sn.mu.Lock()
+	}
+	sn.running = false
+	sn.mu.Unlock()
+}
+
+func (h *simHost) deliver(from net.Addr, to net.Addr, data []byte) {
+	h.net.mu.Lock()
+	var conns []*simConn
+	switch a := to.(type) {
+	case *net.IPAddr:
+		for c := range h.icmp {
+			if c.ping && !isEchoReplyOf(data, c.pingID) {
+				continue
+			}
+			conns = append(conns, c)
+		}
+	case *net.UDPAddr:
+		if c := h.udp[a.Port]; c != nil {
+			conns = append(conns, c)
+		}
+	}
+	h.net.mu.Unlock()
+
+	for _, c := range conns {
+		select {
+		case c.queue <- simPacket{data: data, from: from}:
+		default:
+			// socket buffer full
+		}
+	}
+}
+
+func isEchoReplyOf(data []byte, id uint16) bool {
+	return len(data) >= ICMPEchoHeaderSize && data[0] == ICMPTypeEchoReply &&
+		binary.BigEndian.Uint16(data[4:6]) == id
+}
+
+func (c *simConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		h := c.host
+		h.net.mu.Lock()
+		defer h.net.mu.Unlock()
+		switch a := c.laddr.(type) {
+		case *net.IPAddr:
+			delete(h.icmp, c)
+		case *net.UDPAddr:
+			delete(h.udp, a.Port)
+		}
+	})
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -3,7 +3,8 @@ package icmp_tun
 import (
 	"context"
 	"encoding/binary"
-	"gopkg.in/account-login/ctxlog.v2"
+	"fmt"
+	"github.com/pkg/errors"
 	"net"
 	"strconv"
 	"strings"
@@ -14,7 +15,7 @@ import (
 func GetOutboundIPV4(ctx context.Context) net.IP {
 	conn, err := net.Dial("udp4", "8.8.8.8:53")
 	if err != nil {
-		ctxlog.Errorf(ctx, "net.Dial: %v", err)
+		logError(ctx, "net.Dial", errAttr(err))
 		return nil
 	}
 	defer SafeClose(ctx, conn)
@@ -45,3 +46,35 @@ func ParseNodeID(ctx context.Context, id string) uint32 {
 	}
 	return 0
 }
+
+// a node id of 0x-prefixed hex or decimal, for input that must not resolve "ip" or "rand"
+func parseNodeIDStrict(s string) (uint32, error) {
+	var id uint64
+	var err error
+	if hex, ok := strings.CutPrefix(strings.ToLower(s), "0x"); ok {
+		id, err = strconv.ParseUint(hex, 16, 32)
+	} else {
+		id, err = strconv.ParseUint(s, 10, 32)
+	}
+	if err != nil || id == 0 {
+		return 0, errors.Errorf("invalid node id: %q", s)
+	}
+	return uint32(id), nil
+}
+
+// comma separated node-ids
+func ParseNodeIDList(ctx context.Context, ids string) ([]uint32, error) {
+	var list []uint32
+	for _, s := range strings.Split(ids, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id := ParseNodeID(ctx, s)
+		if id == 0 {
+			return nil, fmt.Errorf("invalid node id: %v", s)
+		}
+		list = append(list, id)
+	}
+	return list, nil
+}
@@ -7,6 +7,7 @@ import (
 	"hash/crc32"
 	"math/rand"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -16,6 +17,36 @@ type Obfuscator interface {
 	HeaderSize() int
 }
 
+// for logging, never reveals the key
+func ObfsName(obfs Obfuscator) string {
+	switch o := obfs.(type) {
+	case nil:
+		return "none"
+	case NilObfs:
+		return "nil"
+	case *SM64CRC32Obfs:
+		if o.key != 0 {
+			return "sm64crc32(keyed)"
+		}
+		return "sm64crc32"
+	default:
+		return fmt.Sprintf("%T", obfs)
+	}
+}
+
+func obfsEqual(a Obfuscator, b Obfuscator) bool {
+	switch ao := a.(type) {
+	case NilObfs:
+		_, ok := b.(NilObfs)
+		return ok
+	case *SM64CRC32Obfs:
+		bo, ok := b.(*SM64CRC32Obfs)
+		return ok && ao.key == bo.key
+	default:
+		return false
+	}
+}
+
 type NilObfs struct{}
 
 func (NilObfs) Encode(header []byte, data []byte) []byte {
@@ -37,8 +68,41 @@ func (NilObfs) HeaderSize() int {
 	return 0
 }
 
+// the zero value is unkeyed and uses a shared rand
 type SM64CRC32Obfs struct {
-	rand *rand.Rand
+	rand *lockedRand
+	key  uint64
+}
+
+// shared by the copies of an obfs, which encode concurrently in the workers of Remote
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+var defaultObfsRand = newLockedRand()
+
+func newLockedRand() *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))}
+}
+
+// the padding length and the random field of the header
+func (lr *lockedRand) draw(origin int) (int, int) {
+	if lr == nil {
+		lr = defaultObfsRand
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return padLen(origin, lr.r), lr.r.Intn(0x10000)
+}
+
+func (lr *lockedRand) read(p []byte) {
+	if lr == nil {
+		lr = defaultObfsRand
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	_, _ = lr.r.Read(p)
 }
 
 func padLen(origin int, rand *rand.Rand) int {
@@ -50,7 +114,25 @@ func padLen(origin int, rand *rand.Rand) int {
 }
 
 func NewSM64CRC32Obfs() *SM64CRC32Obfs {
-	return &SM64CRC32Obfs{rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))}
+	return NewSM64CRC32ObfsWithKey(0)
+}
+
+// key 0 is compatible with the unkeyed obfs
+func NewSM64CRC32ObfsWithKey(key uint64) *SM64CRC32Obfs {
+	return &SM64CRC32Obfs{rand: newLockedRand(), key: key}
+}
+
+// FNV-1a
+func ObfsKeyFromString(s string) uint64 {
+	if s == "" {
+		return 0
+	}
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
 }
 
 // from https://github.com/aappleby/smhasher/blob/master/src/MurmurHash3.cpp
@@ -79,10 +161,13 @@ func ximf64(h uint64) uint64 {
 //           |
 //         fmix64
 //           |
+//         xor key
+//           |
 //         enc key        enc payload padding
 // ---------------------- ----------- -------
 func (obfs SM64CRC32Obfs) Encode(header []byte, data []byte) []byte {
-	pad := padLen(len(data), obfs.rand)
+	pad, rnd := obfs.rand.draw(len(data))
+
 	buflen := len(header) + HS + len(data) + pad
 	var out []byte
 	if cap(header) >= buflen {
@@ -101,7 +186,7 @@ func (obfs SM64CRC32Obfs) Encode(header []byte, data []byte) []byte {
 	buf := out[len(header):buflen]
 
 	// padding
-	obfs.rand.Read(buf[HS+len(data):])
+	obfs.rand.read(buf[HS+len(data):])
 
 	// crc32 of payload
 	hasher := crc32.NewIEEE()
@@ -110,9 +195,9 @@ func (obfs SM64CRC32Obfs) Encode(header []byte, data []byte) []byte {
 
 	// header
 	r := uint64(pad)
-	r |= uint64(obfs.rand.Intn(0x10000)) << 16
+	r |= uint64(rnd) << 16
 	r |= uint64(hash) << 32
-	binary.LittleEndian.PutUint64(buf[:HS], fmix64(r))
+	binary.LittleEndian.PutUint64(buf[:HS], fmix64(r)^obfs.key)
 
 	// body
 	sm := SplitMix64(binary.LittleEndian.Uint64(buf[:HS]))
@@ -121,13 +206,13 @@ func (obfs SM64CRC32Obfs) Encode(header []byte, data []byte) []byte {
 	return out
 }
 
-func (SM64CRC32Obfs) Decode(dst []byte, src []byte) ([]byte, error) {
+func (obfs SM64CRC32Obfs) Decode(dst []byte, src []byte) ([]byte, error) {
 	if len(src) < HS {
 		return nil, fmt.Errorf("packet length %v < %v", len(src), HS)
 	}
 
 	// pad
-	r := ximf64(binary.LittleEndian.Uint64(src[:HS]))
+	r := ximf64(binary.LittleEndian.Uint64(src[:HS]) ^ obfs.key)
 	pad := r & 0xffff
 	bodyLen := len(src) - HS - int(pad)
 	if bodyLen < 0 {
@@ -157,6 +242,19 @@ func (SM64CRC32Obfs) Decode(dst []byte, src []byte) ([]byte, error) {
 	return dst, nil
 }
 
+// the first 8 bytes of the payload of src, the crc is not checked
+func (obfs SM64CRC32Obfs) peek(src []byte) (uint64, bool) {
+	if len(src) < HS+8 {
+		return 0, false
+	}
+	r := ximf64(binary.LittleEndian.Uint64(src[:HS]) ^ obfs.key)
+	if len(src)-HS-int(r&0xffff) < 8 {
+		return 0, false
+	}
+	sm := SplitMix64(binary.LittleEndian.Uint64(src[:HS]))
+	return sm.next() ^ binary.LittleEndian.Uint64(src[HS:HS+8]), true
+}
+
 const HS = 8
 
 func (SM64CRC32Obfs) HeaderSize() int {
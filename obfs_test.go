@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -61,3 +62,44 @@ func TestSM64CRC32Obfs_ReuseHeader(t *testing.T) {
 		assert.True(t, bytes.Equal(cpy, decoded))
 	}
 }
+
+func TestSM64CRC32Obfs_Key(t *testing.T) {
+	obfs := NewSM64CRC32ObfsWithKey(ObfsKeyFromString("secret"))
+	other := NewSM64CRC32ObfsWithKey(ObfsKeyFromString("other"))
+	nokey := NewSM64CRC32Obfs()
+
+	data := make([]byte, 100)
+	_, _ = rand.Read(data)
+	encoded := obfs.Encode(nil, data)
+
+	decoded, err := obfs.Decode(nil, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decoded)
+
+	_, err = other.Decode(nil, encoded)
+	assert.Error(t, err)
+	_, err = nokey.Decode(nil, encoded)
+	assert.Error(t, err)
+}
+
+// the workers of Remote share the obfs of an endpoint, run with -race
+func TestSM64CRC32Obfs_Concurrent(t *testing.T) {
+	for _, obfs := range []*SM64CRC32Obfs{NewSM64CRC32Obfs(), {}} {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(copied SM64CRC32Obfs) {
+				defer wg.Done()
+				data := make([]byte, 100)
+				for j := 0; j < 1000; j++ {
+					encoded := copied.Encode(nil, data)
+					decoded, err := obfs.Decode(nil, encoded)
+					if !assert.NoError(t, err) || !assert.Equal(t, data, decoded) {
+						return
+					}
+				}
+			}(*obfs)
+		}
+		wg.Wait()
+	}
+}
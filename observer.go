@@ -0,0 +1,54 @@
+package icmp_tun
+
+import "net"
+
+// Observer is notified of events of Local and Remote.
+// methods are called synchronously and concurrently on the packet paths, they must not block.
+// embed NopObserver to implement a subset.
+type Observer interface {
+	// Local only, the client of channel ch, old is nil when the client is learned
+	ClientAddr(ch uint8, old *net.UDPAddr, addr *net.UDPAddr)
+	// Remote only
+	PeerCreated(ev PeerEvent)
+	PeerUpdated(ev PeerEvent)
+	PeerRemoved(ev PeerEvent)
+	// a loss report of the received direction from the node
+	LossReport(node uint32, snap StatsSnapshot)
+	// packets dropped
+	DecodeError(ip net.IP, err error)
+	NodeIDMismatch(ip net.IP, src uint32, dst uint32)
+}
+
+// PeerEvent describes a peer of Remote
+type PeerEvent struct {
+	ID uint32
+	// the node id of Remote the peer talks to
+	Endpoint uint32
+	IP       net.IP
+	ICMPID   uint16
+	Epoch    uint16
+	// of PeerRemoved: kicked, acl, closed, restarted, shutdown or target socket
+	Reason string
+}
+
+type NopObserver struct{}
+
+func (NopObserver) ClientAddr(ch uint8, old *net.UDPAddr, addr *net.UDPAddr) {}
+func (NopObserver) PeerCreated(ev PeerEvent)                                 {}
+func (NopObserver) PeerUpdated(ev PeerEvent)                                 {}
+func (NopObserver) PeerRemoved(ev PeerEvent)                                 {}
+func (NopObserver) LossReport(node uint32, snap StatsSnapshot)               {}
+func (NopObserver) DecodeError(ip net.IP, err error)                         {}
+func (NopObserver) NodeIDMismatch(ip net.IP, src uint32, dst uint32)         {}
+
+func observerOrNop(o Observer) Observer {
+	if o == nil {
+		return NopObserver{}
+	}
+	return o
+}
+
+// caller holds r.mu or p.mu, both are held to update the peer
+func (p *localPeer) event(reason string) PeerEvent {
+	return PeerEvent{ID: p.id, Endpoint: p.ep.id, IP: p.ipaddr.IP, ICMPID: p.icmpid, Epoch: p.epoch, Reason: reason}
+}
@@ -0,0 +1,156 @@
+package icmp_tun
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// OptionError is an invalid option of Local or Remote
+type OptionError struct {
+	Option string
+	Reason string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Option, e.Reason)
+}
+
+// OptionErrors lists all invalid options, returned by Validate() and Run()
+type OptionErrors []*OptionError
+
+func (errs OptionErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs *OptionErrors) add(option string, format string, args ...interface{}) {
+	*errs = append(*errs, &OptionError{Option: option, Reason: fmt.Sprintf(format, args...)})
+}
+
+// prefix is prepended to the option names
+func (errs *OptionErrors) merge(prefix string, err error) {
+	if more, ok := err.(OptionErrors); ok {
+		for _, e := range more {
+			*errs = append(*errs, &OptionError{Option: prefix + e.Option, Reason: e.Reason})
+		}
+	} else if err != nil {
+		errs.add(prefix+"config", "%v", err)
+	}
+}
+
+// nil if no errors
+func (errs OptionErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// options of the reloadable config
+func (errs *OptionErrors) checkConfig(obfs Obfuscator, rateLimit float64) {
+	if obfs == nil {
+		errs.add("Obfuscator", "not set")
+	}
+	if rateLimit < 0 {
+		errs.add("RateLimit", "negative: %v", rateLimit)
+	}
+}
+
+// options of both Local and Remote
+func (errs *OptionErrors) checkCommon(windows []uint32, batchSize int) {
+	for _, w := range windows {
+		if w == 0 || w > 1<<24 {
+			errs.add("StatsWindows", "window out of range: %v", w)
+		}
+	}
+	if batchSize < 0 {
+		errs.add("BatchSize", "negative: %v", batchSize)
+	}
+}
+
+// Validate reports all invalid options without opening sockets
+func (l *Local) Validate() error {
+	var errs OptionErrors
+	if l.LocalID == 0 {
+		errs.add("LocalID", "not set")
+	}
+	if l.RemoteID == 0 {
+		errs.add("RemoteID", "not set")
+	}
+	if l.Local != "" {
+		if _, err := net.ResolveUDPAddr("udp", l.Local); err != nil {
+			errs.add("Local", "%v", err)
+		}
+	}
+	if l.Reverse != "" {
+		if taddr, err := net.ResolveUDPAddr("udp", l.Reverse); err != nil {
+			errs.add("Reverse", "%v", err)
+		} else if taddr.Port == 0 {
+			errs.add("Reverse", "no port: %q", l.Reverse)
+		}
+	}
+	chans := map[uint8]bool{}
+	for i, m := range l.Mappings {
+		prefix := fmt.Sprintf("Mappings[%d].", i)
+		if _, err := net.ResolveUDPAddr("udp", m.Listen); err != nil {
+			errs.add(prefix+"Listen", "%v", err)
+		}
+		if m.Channel == 0 {
+			errs.add(prefix+"Channel", "0 is Local")
+		} else if chans[m.Channel] {
+			errs.add(prefix+"Channel", "duplicated: %d", m.Channel)
+		}
+		chans[m.Channel] = true
+	}
+	_, err := newLocalConf(l.LocalConfig)
+	errs.merge("", err)
+	errs.checkCommon(l.StatsWindows, l.BatchSize)
+	return errs.err()
+}
+
+// Validate reports all invalid options without opening sockets
+func (r *Remote) Validate() error {
+	var errs OptionErrors
+	if r.NodeId == 0 {
+		errs.add("NodeId", "not set")
+	}
+	_, err := newRemoteConf(r.RemoteConfig)
+	errs.merge("", err)
+	errs.checkCommon(r.StatsWindows, r.BatchSize)
+	if r.Workers < 0 {
+		errs.add("Workers", "negative: %v", r.Workers)
+	}
+	if r.MaxPeers < 0 {
+		errs.add("MaxPeers", "negative: %v", r.MaxPeers)
+	}
+
+	ids := map[uint32]bool{r.NodeId: true}
+	for i, ep := range r.Endpoints {
+		prefix := fmt.Sprintf("Endpoints[%d].", i)
+		if ep.NodeId == 0 {
+			errs.add(prefix+"NodeId", "not set")
+		} else if ids[ep.NodeId] {
+			errs.add(prefix+"NodeId", "duplicated: %s", nodeLabel(ep.NodeId))
+		}
+		ids[ep.NodeId] = true
+		_, err = newRemoteConf(ep.RemoteConfig)
+		errs.merge(prefix, err)
+		if ep.MaxPeers < 0 {
+			errs.add(prefix+"MaxPeers", "negative: %v", ep.MaxPeers)
+		}
+	}
+	for i, fw := range r.Reverse {
+		prefix := fmt.Sprintf("Reverse[%d].", i)
+		if _, err = net.ResolveUDPAddr("udp", fw.Listen); err != nil {
+			errs.add(prefix+"Listen", "%v", err)
+		}
+		if fw.Local == 0 {
+			errs.add(prefix+"Local", "not set")
+		}
+	}
+	return errs.err()
+}
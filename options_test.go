@@ -0,0 +1,66 @@
+package icmp_tun
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLocal_Validate(t *testing.T) {
+	l := &Local{LocalID: 1, Local: "bad:addr:1", BatchSize: -1}
+	err := l.Validate()
+	require.Error(t, err)
+
+	var errs OptionErrors
+	require.True(t, errors.As(err, &errs))
+	var options []string
+	for _, e := range errs {
+		options = append(options, e.Option)
+	}
+	assert.Equal(t, []string{"RemoteID", "Local", "Obfuscator", "Remote", "BatchSize"}, options)
+	assert.Contains(t, err.Error(), "invalid RemoteID: not set; ")
+
+	l = &Local{LocalID: 1, RemoteID: 2, LocalConfig: LocalConfig{Remote: "10.0.0.2", Obfuscator: NewSM64CRC32ObfsWithKey(1)}}
+	assert.NoError(t, l.Validate())
+	l.Reverse = "10.0.0.1"
+	assert.EqualError(t, l.Validate(), "invalid Reverse: address 10.0.0.1: missing port in address")
+	l.Reverse = ""
+
+	// mappings
+	l.Mappings = []Mapping{{Listen: ":53", Channel: 1}, {Listen: ":54", Channel: 1}, {Listen: ":55"}}
+	assert.EqualError(t, l.Validate(), "invalid Mappings[1].Channel: duplicated: 1; invalid Mappings[2].Channel: 0 is Local")
+}
+
+func TestRemote_Validate(t *testing.T) {
+	r := &Remote{RemoteConfig: RemoteConfig{Target: "10.0.0.2"}, Workers: -1}
+	var errs OptionErrors
+	require.True(t, errors.As(r.Validate(), &errs))
+	var options []string
+	for _, e := range errs {
+		options = append(options, e.Option)
+	}
+	assert.Equal(t, []string{"NodeId", "Obfuscator", "Target", "Workers"}, options)
+
+	r = &Remote{NodeId: 2, RemoteConfig: RemoteConfig{Target: kTestTarget, Obfuscator: NewSM64CRC32ObfsWithKey(1)}}
+	assert.NoError(t, r.Validate())
+
+	// endpoints
+	r.Endpoints = []Endpoint{
+		{NodeId: 3, RemoteConfig: RemoteConfig{Target: kTestTarget, Obfuscator: NilObfs{}}},
+		{NodeId: 2, RemoteConfig: RemoteConfig{Target: kTestTarget}, MaxPeers: -1},
+	}
+	assert.EqualError(t, r.Validate(), "invalid Endpoints[1].NodeId: duplicated: 0x00000002; "+
+		"invalid Endpoints[1].Obfuscator: not set; invalid Endpoints[1].MaxPeers: negative: -1")
+
+	// reverse forwarding
+	r.Endpoints = nil
+	r.Reverse = []ReverseForward{{Listen: ":2222", Local: 1}, {Listen: ":2223"}}
+	assert.EqualError(t, r.Validate(), "invalid Reverse[1].Local: not set")
+	r.Reverse = nil
+
+	// services
+	r.Services = []Service{{Channel: 1, Target: "10.0.0.2:9"}, {Channel: 1, Target: "10.0.0.2:10"}, {Channel: 2, Target: kTestTarget}}
+	assert.EqualError(t, r.Validate(), "invalid Services[1].Channel: duplicated: 1; "+
+		"invalid Services[2].Target: duplicated with channel 0: 10.0.0.2:7")
+}
@@ -0,0 +1,233 @@
+package icmp_tun
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pcap file with nanosecond timestamps and raw IPv4 packets
+const (
+	kPcapMagicNano = 0xa1b23c4d
+	kPcapSnapLen   = 256 * 1024
+	kPcapLinkRaw   = 101
+	kPcapHdrSize   = 24
+	kPcapRecSize   = 16
+)
+
+// PcapWriter writes a pcap file, rotated to path.1 ... path.MaxFiles by size
+type PcapWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+}
+
+// maxSize <= 0 for no rotation
+func NewPcapWriter(path string, maxSize int64, maxFiles int) (*PcapWriter, error) {
+	w := &PcapWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *PcapWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "open pcap")
+	}
+
+	hdr := make([]byte, kPcapHdrSize)
+	binary.LittleEndian.PutUint32(hdr[0:4], kPcapMagicNano)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2) // version 2.4
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], kPcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], kPcapLinkRaw)
+	if _, err = f.Write(hdr); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "write pcap header")
+	}
+
+	w.f = f
+	w.size = kPcapHdrSize
+	return nil
+}
+
+// path -> path.1 -> ... -> path.maxFiles
+func (w *PcapWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if w.maxFiles > 0 {
+		_ = os.Rename(w.path, w.path+".1")
+	}
+	return w.open()
+}
+
+// WritePacket writes an IPv4 packet
+func (w *PcapWriter) WritePacket(ts time.Time, pkt []byte) error {
+	caplen := len(pkt)
+	if caplen > kPcapSnapLen {
+		caplen = kPcapSnapLen
+	}
+	rec := make([]byte, kPcapRecSize, kPcapRecSize+caplen)
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(caplen))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(pkt)))
+	rec = append(rec, pkt[:caplen]...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > kPcapHdrSize && w.size+int64(len(rec)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return errors.Wrap(err, "rotate pcap")
+		}
+	}
+	n, err := w.f.Write(rec)
+	w.size += int64(n)
+	return err
+}
+
+func (w *PcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// synthesized IPv4 header, unknown addresses are 0.0.0.0
+func ipv4Packet(proto uint8, src net.IP, dst net.IP, payload []byte) []byte {
+	pkt := make([]byte, 20+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64 // ttl
+	pkt[9] = proto
+	if src4 := src.To4(); src4 != nil {
+		copy(pkt[12:16], src4)
+	}
+	if dst4 := dst.To4(); dst4 != nil {
+		copy(pkt[16:20], dst4)
+	}
+	checksumPut(pkt[10:12], pkt[:20])
+	copy(pkt[20:], payload)
+	return pkt
+}
+
+// UDP checksum is left 0, which is valid for IPv4
+func ipv4UDPPacket(src *net.UDPAddr, dst *net.UDPAddr, payload []byte) []byte {
+	udp := make([]byte, 8+len(payload))
+	var sip, dip net.IP
+	if src != nil {
+		sip = src.IP
+		binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	}
+	if dst != nil {
+		dip = dst.IP
+		binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	}
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], payload)
+	return ipv4Packet(17, sip, dip, udp)
+}
+
+// Capture writes the decoded datagrams (Inner) and the ICMP packets on wire (Outer),
+// either writer can be nil. It can be toggled at runtime.
+type Capture struct {
+	Inner *PcapWriter
+	Outer *PcapWriter
+	on    int32 // atomic
+}
+
+func NewCapture(inner *PcapWriter, outer *PcapWriter, on bool) *Capture {
+	c := &Capture{Inner: inner, Outer: outer}
+	c.SetEnabled(on)
+	return c
+}
+
+func (c *Capture) SetEnabled(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&c.on, v)
+}
+
+func (c *Capture) Enabled() bool {
+	return c != nil && atomic.LoadInt32(&c.on) != 0
+}
+
+func (c *Capture) inner(src *net.UDPAddr, dst *net.UDPAddr, payload []byte) error {
+	if !c.Enabled() || c.Inner == nil {
+		return nil
+	}
+	return c.Inner.WritePacket(time.Now(), ipv4UDPPacket(src, dst, payload))
+}
+
+func (c *Capture) outer(src net.IP, dst net.IP, icmp []byte) error {
+	if !c.Enabled() || c.Outer == nil {
+		return nil
+	}
+	return c.Outer.WritePacket(time.Now(), ipv4Packet(1, src, dst, icmp))
+}
+
+func (c *Capture) Close() error {
+	var err error
+	for _, w := range []*PcapWriter{c.Inner, c.Outer} {
+		if w == nil {
+			continue
+		}
+		if cerr := w.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func captureError(ctx context.Context, ll *logLimiter, err error) {
+	if err != nil {
+		ll.log(ctx, slog.LevelError, "pcap", "pcap", errAttr(err))
+	}
+}
+
+// OpenCapture opens writers of non-empty paths, returns nil if both paths are empty
+func OpenCapture(inner string, outer string, maxSize int64, maxFiles int, on bool) (*Capture, error) {
+	if inner == "" && outer == "" {
+		return nil, nil
+	}
+	c := NewCapture(nil, nil, on)
+	var err error
+	if inner != "" {
+		if c.Inner, err = NewPcapWriter(inner, maxSize, maxFiles); err != nil {
+			return nil, err
+		}
+	}
+	if outer != "" {
+		if c.Outer, err = NewPcapWriter(outer, maxSize, maxFiles); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
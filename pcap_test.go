@@ -0,0 +1,76 @@
+package icmp_tun
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inner.pcap")
+	// room for 2 packets of 28 + 4 bytes
+	w, err := NewPcapWriter(path, kPcapHdrSize+2*(kPcapRecSize+32), 2)
+	assert.NoError(t, err)
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	dst := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	pkt := ipv4UDPPacket(src, dst, []byte("abcd"))
+	assert.Equal(t, 32, len(pkt))
+	assert.Equal(t, uint16(0), checksum(pkt[:20]))
+	assert.Equal(t, []byte{127, 0, 0, 1, 8, 8, 8, 8}, pkt[12:20])
+	assert.Equal(t, []byte{0x04, 0xd2, 0, 53, 0, 12}, pkt[20:26])
+
+	ts := time.Unix(1000, 5)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, w.WritePacket(ts, pkt))
+	}
+	assert.NoError(t, w.Close())
+	assert.Error(t, w.WritePacket(ts, pkt))
+
+	// 2 + 2 + 1
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, kPcapHdrSize+kPcapRecSize+32, len(data))
+	assert.Equal(t, uint32(kPcapMagicNano), binary.LittleEndian.Uint32(data[0:4]))
+	assert.Equal(t, uint32(kPcapLinkRaw), binary.LittleEndian.Uint32(data[20:24]))
+	rec := data[kPcapHdrSize:]
+	assert.Equal(t, uint32(1000), binary.LittleEndian.Uint32(rec[0:4]))
+	assert.Equal(t, uint32(5), binary.LittleEndian.Uint32(rec[4:8]))
+	assert.Equal(t, uint32(32), binary.LittleEndian.Uint32(rec[8:12]))
+	assert.Equal(t, pkt, rec[kPcapRecSize:])
+
+	for _, name := range []string{path + ".1", path + ".2"} {
+		data, err = os.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, kPcapHdrSize+2*(kPcapRecSize+32), len(data))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+	var c *Capture
+	assert.False(t, c.Enabled())
+	assert.NoError(t, c.outer(nil, nil, []byte{8, 0}))
+
+	c, err := OpenCapture("", filepath.Join(dir, "outer.pcap"), 0, 0, false)
+	assert.NoError(t, err)
+	assert.Nil(t, c.Inner)
+	assert.NoError(t, c.outer(net.IPv4(1, 2, 3, 4), nil, []byte{8, 0, 0, 0}))
+	c.SetEnabled(true)
+	assert.NoError(t, c.outer(net.IPv4(1, 2, 3, 4), nil, []byte{8, 0, 0, 0}))
+	assert.NoError(t, c.inner(nil, nil, []byte{1}))
+	assert.NoError(t, c.Close())
+
+	data, _ := os.ReadFile(filepath.Join(dir, "outer.pcap"))
+	assert.Equal(t, kPcapHdrSize+kPcapRecSize+24, len(data))
+
+	c, err = OpenCapture("", "", 0, 0, true)
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+}
@@ -0,0 +1,34 @@
+package icmp_tun
+
+import "sync"
+
+// pooled packet buffers in two size classes, most packets fit in the small one
+const kSmallBufSize = 2048
+
+type smallBuf [kSmallBufSize]byte
+type packetBuf [kPacketBufSize]byte
+
+var (
+	smallBufPool  = sync.Pool{New: func() any { return new(smallBuf) }}
+	packetBufPool = sync.Pool{New: func() any { return new(packetBuf) }}
+)
+
+// returns a buffer of at least n bytes, n <= kPacketBufSize
+func getBuf(n int) []byte {
+	if n <= kSmallBufSize {
+		return smallBufPool.Get().(*smallBuf)[:]
+	}
+	return packetBufPool.Get().(*packetBuf)[:]
+}
+
+// buf must be from getBuf()
+func putBuf(buf []byte) {
+	switch cap(buf) {
+	case kSmallBufSize:
+		smallBufPool.Put((*smallBuf)(buf[:kSmallBufSize]))
+	case kPacketBufSize:
+		packetBufPool.Put((*packetBuf)(buf[:kPacketBufSize]))
+	default:
+		panic("not a pooled buffer")
+	}
+}
@@ -0,0 +1,20 @@
+package icmp_tun
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	for _, n := range []int{0, 1, kSmallBufSize} {
+		buf := getBuf(n)
+		assert.Equal(t, kSmallBufSize, len(buf))
+		putBuf(buf)
+	}
+	for _, n := range []int{kSmallBufSize + 1, kPacketBufSize} {
+		buf := getBuf(n)
+		assert.Equal(t, kPacketBufSize, len(buf))
+		putBuf(buf[:n]) // resliced
+	}
+	assert.Panics(t, func() { putBuf(make([]byte, 100)) })
+}
@@ -0,0 +1,151 @@
+package icmp_tun
+
+import "encoding/binary"
+
+//   1B |   1B |     2B | 2B |  2B | 8B |  4B |  4B |  4B |    4B |
+// type | code | chksum | id | seq | HS | src | dst | cmd | pktid | data
+// -------------------------------
+//        ICMP ECHO HEADER
+
+// tunnel commands
+const (
+	kCmdData      = 0
+	kCmdClose     = 1 // the sender is shutting down
+	kCmdProbe     = 2 // payload: 8B sender timestamp, echoed by kCmdProbeAck
+	kCmdProbeAck  = 3
+	kCmdReport    = 4 // payload: stats of the direction received by the sender, see encodeReport()
+	kCmdReverse   = 5 // payload: 4B session id, datagram of reverse forwarding
+	kCmdKeepalive = 6 // from local, an echo request for the remote to reply on
+)
+
+// the cmd field: bits 0-7 the command, bits 8-15 the channel of data, bits 16-31 the session
+// epoch of the sender. epoch 0 is sent by versions without epochs, channel 0 by versions without channels.
+func makeCmd(cmd uint32, epoch uint16) uint32 {
+	return cmd | uint32(epoch)<<16
+}
+
+func splitCmd(field uint32) (cmd uint32, epoch uint16) {
+	return field & 0xff, uint16(field >> 16)
+}
+
+func withChannel(field uint32, ch uint8) uint32 {
+	return field | uint32(ch)<<8
+}
+
+func cmdChannel(field uint32) uint8 {
+	return uint8(field >> 8)
+}
+
+// a random nonzero epoch of each run, a new one means the sender restarted
+func newEpoch() uint16 {
+	for {
+		if epoch := uint16(Rand64ByTime() >> 48); epoch != 0 {
+			return epoch
+		}
+	}
+}
+
+// how a packet relates to the session of the peer
+const (
+	epochSame  = iota // or unknown
+	epochNew          // the peer restarted, or the first packet
+	epochStale        // sent before the restart
+)
+
+// cur is the epoch of the session, prev is the one before
+func epochState(cur uint16, prev uint16, epoch uint16) int {
+	switch {
+	case epoch == 0 || epoch == cur:
+		return epochSame
+	case epoch == prev:
+		return epochStale
+	default:
+		return epochNew
+	}
+}
+
+// encodes a control packet into a new buf, control packets have no pktid
+func encodeCtrl(
+	obfs Obfuscator, icmpType uint8, icmpID uint16, icmpSeq uint16,
+	src uint32, dst uint32, cmd uint32, payload []byte) []byte {
+	// body
+	data := make([]byte, kTunHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(data[0:4], src)
+	binary.LittleEndian.PutUint32(data[4:8], dst)
+	binary.LittleEndian.PutUint32(data[8:12], cmd)
+	binary.LittleEndian.PutUint32(data[12:16], 0)
+	copy(data[kTunHeaderSize:], payload)
+
+	header := make([]byte, ICMPEchoHeaderSize, 2*1024+len(data))
+	header[0] = icmpType
+	header[1] = 0
+	binary.BigEndian.PutUint16(header[4:6], icmpID)
+	binary.BigEndian.PutUint16(header[6:8], icmpSeq)
+
+	encoded := obfs.Encode(header, data)
+	checksumPut(encoded[2:4], encoded)
+	return encoded
+}
+
+// the src and dst of the tunnel header in icmpData, without checking the obfuscation.
+// scratch is for decoding with obfuscators other than the builtin ones.
+func peekTunHeader(obfs Obfuscator, icmpData []byte, scratch []byte) (uint32, uint32, bool) {
+	var header []byte
+	switch o := obfs.(type) {
+	case NilObfs:
+		header = icmpData
+	case *SM64CRC32Obfs:
+		w, ok := o.peek(icmpData)
+		return uint32(w), uint32(w >> 32), ok
+	case SM64CRC32Obfs:
+		w, ok := o.peek(icmpData)
+		return uint32(w), uint32(w >> 32), ok
+	default:
+		hs := obfs.HeaderSize()
+		if len(icmpData) < hs {
+			return 0, 0, false
+		}
+		n := copy(scratch, icmpData)
+		data, err := obfs.Decode(scratch[hs:n], scratch[:n])
+		if err != nil {
+			return 0, 0, false
+		}
+		header = data
+	}
+	if len(header) < kTunHeaderSize {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(header[0:4]), binary.LittleEndian.Uint32(header[4:8]), true
+}
+
+// encodes the data at buf[ICMPEchoHeaderSize+hs+kTunHeaderSize:][:n] in place, returns the ICMP packet
+func encodeData(
+	obfs Obfuscator, buf []byte, n int, icmpType uint8, icmpID uint16, icmpSeq uint16,
+	src uint32, dst uint32, cmd uint32, pktid uint32) []byte {
+	// body
+	hs := obfs.HeaderSize()
+
+	// ICMP ECHO HEADER
+	buf[0] = icmpType
+	buf[1] = 0
+	icmpData := buf[ICMPEchoHeaderSize:]
+
+	// src dst cmd pktid
+	binary.LittleEndian.PutUint32(icmpData[hs+0:hs+4], src)
+	binary.LittleEndian.PutUint32(icmpData[hs+4:hs+8], dst)
+	binary.LittleEndian.PutUint32(icmpData[hs+8:hs+12], cmd)
+	binary.LittleEndian.PutUint32(icmpData[hs+12:hs+16], pktid)
+
+	// encode
+	encoded := obfs.Encode(buf[:ICMPEchoHeaderSize], icmpData[hs:hs+kTunHeaderSize+n])
+	if &buf[0] != &encoded[0] {
+		panic("should reuse buf")
+	}
+
+	// icmp id, icmp seq
+	binary.BigEndian.PutUint16(encoded[4:6], icmpID)
+	binary.BigEndian.PutUint16(encoded[6:8], icmpSeq)
+	// checksum
+	checksumPut(encoded[2:4], encoded)
+	return encoded
+}
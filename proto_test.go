@@ -0,0 +1,53 @@
+package icmp_tun
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCmdEpoch(t *testing.T) {
+	cmd, epoch := splitCmd(makeCmd(kCmdReport, 0xabcd))
+	assert.Equal(t, uint32(kCmdReport), cmd)
+	assert.Equal(t, uint16(0xabcd), epoch)
+
+	// channel bits
+	field := withChannel(makeCmd(kCmdData, 0x1234), 0xff)
+	cmd, epoch = splitCmd(field)
+	assert.Equal(t, uint32(kCmdData), cmd)
+	assert.Equal(t, uint16(0x1234), epoch)
+	assert.Equal(t, uint8(0xff), cmdChannel(field))
+	assert.Equal(t, uint8(0), cmdChannel(makeCmd(kCmdProbe, 0x1234)))
+
+	assert.NotZero(t, newEpoch())
+}
+
+func TestEpochState(t *testing.T) {
+	assert.Equal(t, epochNew, epochState(0, 0, 1))   // first
+	assert.Equal(t, epochSame, epochState(1, 0, 1))  // same session
+	assert.Equal(t, epochSame, epochState(1, 0, 0))  // without epochs
+	assert.Equal(t, epochNew, epochState(1, 0, 2))   // restarted
+	assert.Equal(t, epochStale, epochState(2, 1, 1)) // before restart
+	assert.Equal(t, epochNew, epochState(2, 1, 3))   // restarted again
+}
+
+// decodes with NilObfs, for the generic path of peekTunHeader
+type wrappedObfs struct{ NilObfs }
+
+func TestPeekTunHeader(t *testing.T) {
+	keyed := NewSM64CRC32ObfsWithKey(ObfsKeyFromString("secret"))
+	for _, obfs := range []Obfuscator{NilObfs{}, NewSM64CRC32Obfs(), keyed, *keyed, wrappedObfs{}} {
+		for _, n := range []int{0, 1, 100} {
+			buf := make([]byte, kPacketBufSize)
+			pkt := encodeData(obfs, buf, n, ICMPTypeEcho, 1, 2, 0x11, 0x22, kCmdData, 3)
+			src, dst, ok := peekTunHeader(obfs, pkt[ICMPEchoHeaderSize:], make([]byte, kPacketBufSize))
+			assert.True(t, ok, ObfsName(obfs))
+			assert.Equal(t, uint32(0x11), src, ObfsName(obfs))
+			assert.Equal(t, uint32(0x22), dst, ObfsName(obfs))
+		}
+	}
+
+	_, _, ok := peekTunHeader(keyed, []byte{1, 2, 3}, nil)
+	assert.False(t, ok)
+	_, _, ok = peekTunHeader(NilObfs{}, make([]byte, kTunHeaderSize-1), nil)
+	assert.False(t, ok)
+}
@@ -0,0 +1,36 @@
+package icmp_tun
+
+import "time"
+
+// token bucket, burst of 1 second
+type RateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// rate in packets per second, 0 for unlimited
+func (rl *RateLimiter) Allow(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	if rl.last.IsZero() {
+		rl.tokens = burst
+	} else {
+		rl.tokens += now.Sub(rl.last).Seconds() * rate
+		if rl.tokens > burst {
+			rl.tokens = burst
+		}
+	}
+	rl.last = now
+
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
@@ -0,0 +1,27 @@
+package icmp_tun
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// waits until a packet is queued on conn without holding a buffer.
+// the read deadline of conn applies. conns without fd return immediately.
+func waitReadable(conn net.PacketConn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var b [1]byte
+	return raw.Read(func(fd uintptr) bool {
+		_, _, err := unix.Recvfrom(int(fd), b[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		// other errors are left to the following read
+		return err != unix.EAGAIN && err != unix.EINTR
+	})
+}
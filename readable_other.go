@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package icmp_tun
+
+import "net"
+
+// buffers are held while waiting on other platforms
+func waitReadable(conn net.PacketConn) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+package icmp_tun
+
+import "fmt"
+
+// collects human readable config changes for Reload()
+type confDiff []string
+
+func (d *confDiff) add(name string, old interface{}, new interface{}) {
+	if fmt.Sprint(old) != fmt.Sprint(new) {
+		*d = append(*d, fmt.Sprintf("[%s:%v] -> [%s:%v]", name, old, name, new))
+	}
+}
+
+func (d *confDiff) addObfs(old Obfuscator, new Obfuscator) {
+	if !obfsEqual(old, new) {
+		*d = append(*d, fmt.Sprintf("[obfs:%v] -> [obfs:%v]", ObfsName(old), ObfsName(new)))
+	}
+}
@@ -4,359 +4,1323 @@ import (
 	"context"
 	"encoding/binary"
 	"github.com/pkg/errors"
-	"golang.org/x/net/icmp"
-	"gopkg.in/account-login/ctxlog.v2"
+	"log/slog"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
-// TODO: expire idle peer
-
-type Remote struct {
+// RemoteConfig is the part of Remote that can be changed by Remote.Reload()
+type RemoteConfig struct {
 	Target     string
-	NodeId     uint32
-	Verbose    bool
 	EnableEcho bool
 	Obfuscator Obfuscator
+	ACL        *ACL
+	// packets per second for each peer and direction, 0 for unlimited
+	RateLimit float64
+	// relay packets between locals of this node, nil to disable
+	Routes *RouteACL
+	// more targets by channel, for the mappings of locals
+	Services []Service
+}
+
+type Remote struct {
+	NodeId uint32
+	// initial config
+	RemoteConfig
+	// wait for a quiet period and notify peers before stopping, default kShutdownTimeout
+	ShutdownTimeout time.Duration
+	// RTT probe interval, default kProbeInterval, negative to disable
+	ProbeInterval time.Duration
+	// stats report interval, default kReportInterval, negative to disable
+	ReportInterval time.Duration
+	// use SO_TIMESTAMPNS for RTT
+	KernelTimestamp bool
+	// loss windows of Stats, default 100, 1000, 10000
+	StatsWindows []uint32
+	// sockets, default OSNetwork
+	Network Network
+	// do not attach the BPF filter to the raw socket
+	NoBPF bool
+	// stop with the error instead of reopening a failed socket
+	NoReopen bool
+	// packets per syscall, default kBatchSize, each takes a 64KiB buffer while reading
+	BatchSize int
+	// decode workers, default GOMAXPROCS
+	Workers int
+	// 0 for unlimited, relay only peers are not counted
+	MaxPeers int
+	// remove peers not heard from for this long, default kPeerIdleTimeout, negative to disable
+	PeerIdleTimeout time.Duration
+	// more node ids served on the ICMP socket, packets are dispatched on the dst node id
+	Endpoints []Endpoint
+	// UDP listeners forwarded to locals of NodeId, see Local.Reverse
+	Reverse []ReverseForward
+	// optional, exposed to the admin API
+	LogLevel *slog.LevelVar
+	Capture  *Capture
+	// optional, notified of events
+	Observer Observer
+	// optional, sees inner datagrams of both directions
+	Middleware Pipeline
 	// states
-	taddr    *net.UDPAddr
-	icmpconn *icmp.PacketConn
+	ep       endpoint // of NodeId
+	icmpconn socket
+	npkt     uint64 // atomic, forwarded packets
+	cnt      counters
+	logs     logLimiter
 	mu       sync.Mutex
-	id2peer  map[uint32]*localPeer
-	quiter   Quiter
+	id2peer  map[uint64]*localPeer // by peerKey()
+	npeers   int                   // of id2peer, without relay only peers
+	eps      []*endpoint           // ep and Endpoints
+	id2ep    map[uint32]*endpoint
+	group    *runGroup
+	epoch    uint16 // of this run
+	lc       lifecycle
+	obs      Observer
+	rev      reverseTable
+	revLns   []*reverseListener
+}
+
+type remoteConf struct {
+	RemoteConfig
+	taddr   *net.UDPAddr
+	targets map[uint8]*net.UDPAddr // by channel, 0 is taddr
 }
 
 type localPeer struct {
 	r       *Remote
+	ep      *endpoint
 	id      uint32
 	mu      sync.Mutex
 	ipaddr  *net.IPAddr
 	icmpid  uint16
 	icmpseq uint16
-	lconn   *net.UDPConn
+	lconn   net.PacketConn // nil if relay only
+	closed  int32
+	verbose int32 // atomic
+	seen    int64 // atomic, unix nano of the last packet
 	pktid   uint32
 	st      Stats
+	up      trafficCounter
+	down    trafficCounter
+	// rate limit of each direction
+	uplimit   RateLimiter
+	downlimit RateLimiter
+	// epochs of the local, a restarted local is a new peer
+	epoch     uint16
+	prevEpoch uint16
+	// atomic, talks to another local through relay, not probed
+	relay int32
+	// created for relay, without the target socket and reader
+	relayOnly bool
+	// of both directions, stopped on close
+	delayed delayQueue
+}
+
+func newRemoteConf(c RemoteConfig) (*remoteConf, error) {
+	var errs OptionErrors
+	errs.checkConfig(c.Obfuscator, c.RateLimit)
+
+	// resolve target addr
+	taddr, err := net.ResolveUDPAddr("udp", c.Target)
+	if err != nil {
+		errs.add("Target", "%v", err)
+	} else if taddr.Port == 0 {
+		errs.add("Target", "no port: %q", c.Target)
+	}
+	targets := resolveServices(&errs, taddr, c.Services)
+	if err = errs.err(); err != nil {
+		return nil, err
+	}
+	return &remoteConf{RemoteConfig: c, taddr: taddr, targets: targets}, nil
+}
+
+func (r *Remote) loadConf() *remoteConf {
+	return r.ep.loadConf()
 }
 
+// Config returns the current config
+func (r *Remote) Config() RemoteConfig {
+	if conf := r.loadConf(); conf != nil {
+		return conf.RemoteConfig
+	}
+	return r.RemoteConfig
+}
+
+// Run blocks until ctx is done, Close() is called or a fatal error. see also Start().
 func (r *Remote) Run(ctx context.Context) error {
-	if r.NodeId == 0 || r.Obfuscator == nil {
-		return errors.New("r.NodeId == 0 || r.Obfuscator == nil")
+	return r.lc.run(ctx, r.run)
+}
+
+func (r *Remote) run(ctx context.Context) error {
+	if err := r.Validate(); err != nil {
+		return err
 	}
+	ctx = logWith(ctx, nodeAttr("remote", r.NodeId))
 
-	// resolve target addr
-	var err error
-	r.taddr, err = net.ResolveUDPAddr("udp", r.Target)
+	conf, err := newRemoteConf(r.RemoteConfig)
 	if err != nil {
-		return errors.Wrap(err, "resolve target")
+		return err
+	}
+	logDebug(ctx, "target resolved", "target", conf.taddr.String())
+	if err = r.initEndpoints(conf); err != nil {
+		return err
 	}
-	ctxlog.Debugf(ctx, "target resolved: %v", r.taddr)
+	r.obs = observerOrNop(r.Observer)
 
 	// ICMP Conn
-	r.icmpconn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	network := networkOrDefault(r.Network)
+	r.icmpconn.init("icmp", r.NoReopen, func() (*sockConn, error) {
+		return r.openICMP(ctx, network)
+	})
+	icmp, err := r.icmpconn.open()
 	if err != nil {
-		return errors.Wrap(err, "listen for local")
+		return err
+	}
+	r.icmpconn.set(icmp)
+	if err = r.listenReverse(ctx, network); err != nil {
+		r.icmpconn.close(ctx)
+		return err
 	}
-	defer SafeClose(ctx, r.icmpconn)
 
 	// init states
-	r.id2peer = map[uint32]*localPeer{}
-	r.quiter.Init()
+	r.id2peer = map[uint64]*localPeer{}
+	r.group = newRunGroup(ctx)
+	r.epoch = newEpoch()
+	logInfo(ctx, "start listening", "epoch", r.epoch, "endpoints", len(r.eps))
 
-	// convert ctx.Done() to quit flag
-	go func() {
-		<-ctx.Done()
-		r.quiter.Quit()
-	}()
+	// probe peers, process local input, until ctx.Done() or a fatal error
+	r.group.Go(func() error { return r.timers(ctx) })
+	r.group.Go(func() error { return r.local2remote(ctx) })
+	for _, ln := range r.revLns {
+		r.group.Go(func() error { return r.reverse2local(ctx, ln) })
+	}
+	r.lc.setReady()
+	<-r.group.Done()
 
-	// process local input
-	r.local2remote(ctx)
+	// closing sockets stops the readers
+	logDebug(ctx, "stopping")
+	r.shutdown(ctx)
+	err = r.group.Wait()
+	r.logs.flush(ctx, time.Now().Add(kLogFloodInterval))
+	if len(r.id2peer) != 0 {
+		panic("len(r.id2peer) != 0")
+	}
 
 	// done
+	if err != nil {
+		logError(ctx, "stopped by error", errAttr(err))
+		return err
+	}
 	return ctx.Err()
 }
 
-func (r *Remote) local2remote(ctx context.Context) {
-	ctxlog.Debugf(ctx, "ready to read icmp from local")
+// Reload applies the new config to the running Remote without touching sockets.
+func (r *Remote) Reload(ctx context.Context, c RemoteConfig) (changes []string, err error) {
+	return r.reload(ctx, &r.ep, c)
+}
+
+func (r *Remote) reload(ctx context.Context, ep *endpoint, c RemoteConfig) (changes []string, err error) {
+	old := ep.loadConf()
+	if old == nil {
+		return nil, errors.New("remote not running")
+	}
+
+	conf, err := newRemoteConf(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// diff
+	var diff confDiff
+	diff.add("target", old.taddr, conf.taddr)
+	diff.add("services", formatServices(old.Services), formatServices(conf.Services))
+	diff.add("echo", old.EnableEcho, conf.EnableEcho)
+	diff.addObfs(old.Obfuscator, conf.Obfuscator)
+	if !old.ACL.Equal(conf.ACL) {
+		diff.add("acl", old.ACL, conf.ACL)
+	}
+	if !old.Routes.Equal(conf.Routes) {
+		diff.add("routes", old.Routes, conf.Routes)
+	}
+	diff.add("ratelimit", old.RateLimit, conf.RateLimit)
+	if obfsEqual(old.Obfuscator, conf.Obfuscator) {
+		// keep the rand state
+		conf.Obfuscator = old.Obfuscator
+	}
+
+	// apply
+	oldSize := r.minSize()
+	atomic.StorePointer(&ep.conf, unsafe.Pointer(conf))
+	for _, change := range diff {
+		logInfo(ctx, "reload", "change", change)
+	}
+	if r.minSize() != oldSize {
+		r.attachFilter(ctx, r.icmpconn.get())
+	}
+
+	// remove peers denied by the new acl
+	for _, peer := range r.peers() {
+		if peer.ep == ep && !conf.ACL.Permit(peer.id) {
+			logInfo(ctx, "denied by acl, removing peer", nodeAttr("local", peer.id))
+			r.delPeer(ctx, peer, "acl")
+		}
+	}
+
+	return diff, nil
+}
+
+// normal pings are accepted if echo is enabled
+func remoteMinSize(conf *remoteConf) uint32 {
+	if conf.EnableEcho {
+		return 0
+	}
+	return tunnelMinSize(conf.Obfuscator)
+}
+
+// opens and sets up the ICMP socket
+func (r *Remote) openICMP(ctx context.Context, network Network) (*sockConn, error) {
+	conn, err := network.ListenICMP()
+	if err != nil {
+		return nil, errors.Wrap(err, "listen for local")
+	}
+	sc := &sockConn{PacketConn: conn}
+	r.attachFilter(ctx, sc)
+	if r.KernelTimestamp {
+		if err = enableRxTimestamp(conn); err != nil {
+			SafeClose(ctx, conn)
+			return nil, err
+		}
+	}
+	return sc, nil
+}
+
+// only the echo requests of plausible size reach user space
+func (r *Remote) attachFilter(ctx context.Context, sc *sockConn) {
+	if r.NoBPF {
+		return
+	}
+	if err := attachBPF(sc.PacketConn, remoteBPF(r.minSize())); err != nil {
+		logWarn(ctx, "bpf filter not attached", errAttr(err))
+	}
+}
+
+func (r *Remote) shutdown(ctx context.Context) {
+	timeout := r.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = kShutdownTimeout
+	}
+
+	// let the packets in flight be forwarded, unless stopped by error
+	if ctx.Err() != nil {
+		logDebug(ctx, "waiting for a quiet period")
+		waitQuiet(ctx, &r.npkt, time.Now().Add(timeout/2))
+	}
+
+	// so the locals know the peer is gone
+	for _, peer := range r.peers() {
+		peer.delayed.stop()
+		if atomic.LoadInt32(&peer.relay) != 0 {
+			// the other local closes it
+		} else if err := peer.sendCtrl(kCmdClose, nil); err != nil {
+			logError(ctx, "notify close", nodeAttr("local", peer.id), errAttr(err))
+		} else {
+			logDebug(ctx, "notified close", nodeAttr("local", peer.id))
+		}
+		r.delPeer(ctx, peer, "shutdown")
+	}
+
+	r.closeReverse(ctx)
+	r.icmpconn.close(ctx)
+}
 
-	hs := r.Obfuscator.HeaderSize()
-	buf := make([]byte, 128*1024)
+// sends RTT probes and stats reports to peers, and flushes suppressed logs
+func (r *Remote) timers(ctx context.Context) error {
+	probe := newTicker(r.ProbeInterval, kProbeInterval)
+	report := newTicker(r.ReportInterval, kReportInterval)
 	for {
-		// test for quit flag
-		if r.quiter.IsQuit() {
-			break
+		now := time.Now()
+		doProbe, doReport := probe.tick(now), report.tick(now)
+		if doProbe || doReport {
+			for _, peer := range r.peers() {
+				if atomic.LoadInt32(&peer.relay) != 0 {
+					continue
+				}
+				if doProbe {
+					if err := peer.sendCtrl(kCmdProbe, probePayload(now)); err != nil {
+						logError(ctx, "send probe", nodeAttr("local", peer.id), errAttr(err))
+					}
+				}
+				if doReport {
+					if err := peer.sendCtrl(kCmdReport, encodeReport(peer.st.Snapshot())); err != nil {
+						logError(ctx, "send report", nodeAttr("local", peer.id), errAttr(err))
+					}
+				}
+			}
+		}
+		r.expirePeers(ctx, now)
+		r.rev.expire(now)
+		r.logs.flush(ctx, now)
+
+		select {
+		case <-r.group.Done():
+			return nil
+		case <-time.After(minDuration(kIOInterval, probe.until(now), report.until(now))):
+		}
+	}
+}
+
+// a packet queued to a worker
+type remotePacket struct {
+	buf    []byte // pooled
+	n      int
+	ipaddr *net.IPAddr
+	rxts   time.Time
+}
+
+// packets are sharded by the src node id, thus the packets and the state of a peer are handled
+// by one worker in order. only the tunnel header is decoded here, the crc is checked by the worker.
+// with several obfuscators the one that decodes the dst of an endpoint, or a relayed route, is taken.
+func (r *Remote) shard(ipaddr *net.IPAddr, icmp []byte, shards int, scratch []byte) int {
+	if len(icmp) >= ICMPEchoHeaderSize {
+		icmpData := icmp[ICMPEchoHeaderSize:]
+		for i, ep := range r.eps {
+			obfs := ep.loadConf().Obfuscator
+			if r.triedObfs(i, obfs) {
+				continue
+			}
+			src, dst, ok := peekTunHeader(obfs, icmpData, scratch)
+			if ok && (len(r.eps) == 1 || r.id2ep[dst] != nil || ep.loadConf().Routes.Permit(src, dst)) {
+				return int(fmix64(uint64(src)) % uint64(shards))
+			}
 		}
+	}
+
+	// normal pings: by the ip and icmp id
+	key := uint64(1) << 63
+	if ip4 := ipaddr.IP.To4(); ip4 != nil {
+		key |= uint64(binary.BigEndian.Uint32(ip4)) << 16
+	}
+	if len(icmp) >= ICMPEchoHeaderSize {
+		key |= uint64(binary.BigEndian.Uint16(icmp[4:6]))
+	}
+	return int(fmix64(key) % uint64(shards))
+}
+
+func (r *Remote) local2remote(ctx context.Context) error {
+	logDebug(ctx, "ready to read icmp from local")
+
+	// decode workers
+	shards := make([]chan remotePacket, workersOrDefault(r.Workers))
+	for i := range shards {
+		ch := make(chan remotePacket, kWorkerQueueSize)
+		shards[i] = ch
+		r.group.Go(func() error { r.worker(ctx, ch); return nil })
+	}
 
+	oobSize := 0
+	if r.KernelTimestamp {
+		oobSize = 128
+	}
+	size := batchSizeOrDefault(r.BatchSize)
+	scratch := getBuf(kPacketBufSize)
+	defer putBuf(scratch)
+	rb := newBatchReader(r.icmpconn.get().PacketConn, size, oobSize)
+	defer func() { rb.release() }() // rb is replaced on reopen
+	defer func() {
+		for _, ch := range shards {
+			close(ch)
+		}
+	}()
+	errs := 0
+	for {
 		// read from local
-		_ = r.icmpconn.SetReadDeadline(time.Now().Add(kIOInterval))
-		n, addr, err := r.icmpconn.ReadFrom(buf)
+		cnt, err := rb.read(ctx, 0)
 		if err != nil {
-			// skip timeout
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if sc, rerr := r.icmpconn.readError(ctx, r.group, err, &errs); rerr != nil {
+				logDebug(ctx, "stopped to read icmp from local")
+				return rerr
+			} else if sc != nil {
+				rb.release()
+				rb = newBatchReader(sc.PacketConn, size, oobSize)
 				continue
 			}
 
-			ctxlog.Errorf(ctx, "local read: %v", err)
+			inc(&r.cnt.icmpRead)
+			r.logs.log(ctx, slog.LevelError, "local read", "local read", errAttr(err))
 			continue
 		}
-		ipaddr := addr.(*net.IPAddr)
-
-		/*
-			https://tools.ietf.org/html/rfc792
-			Echo or Echo Reply Message
-			    0                   1                   2                   3
-			    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
-			   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-			   |     Type      |     Code      |          Checksum             |
-			   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-			   |           Identifier          |        Sequence Number        |
-			   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-			   |     Data ...
-		*/
-		if n < ICMPEchoHeaderSize+hs {
-			ctxlog.Warnf(ctx, "icmp packet from [ip:%v] too short, length: %v", ipaddr, n)
-			continue
-		}
-		if buf[0] != ICMPTypeEcho {
-			ctxlog.Debugf(ctx, "[ip:%v] not icmp type echo: %v", ipaddr, buf[0])
-			continue
+		errs = 0
+
+		// dispatch to workers
+		for i := 0; i < cnt; i++ {
+			msg := &rb.msgs[i]
+			pkt := remotePacket{
+				buf: getBuf(msg.N), n: msg.N, ipaddr: msg.Addr.(*net.IPAddr), rxts: rxTimestamp(msg.OOB[:msg.NN]),
+			}
+			copy(pkt.buf, rb.bufs[i][:msg.N])
+			select {
+			case shards[r.shard(pkt.ipaddr, pkt.buf[:pkt.n], len(shards), scratch)] <- pkt:
+			default:
+				putBuf(pkt.buf)
+				inc(&r.cnt.queueDrops)
+				r.logs.log(ctx, slog.LevelWarn, "queue full", "worker queue full, packet dropped")
+			}
 		}
-		icmpID := binary.BigEndian.Uint16(buf[4:6])
-		icmpSeq := binary.BigEndian.Uint16(buf[6:8])
-		icmpData := buf[ICMPEchoHeaderSize:n]
+	} // for loop
+}
 
-		// decode inplace
-		data, err := r.Obfuscator.Decode(icmpData[hs:], icmpData)
-		if err != nil {
-			if r.EnableEcho {
-				// reply normal ping
-				buf[0] = ICMPTypeEchoReply
-				// update checksum
-				checksumUpdate(buf[2:4], ICMPTypeEcho, ICMPTypeEchoReply)
-				// reply echo
-				_, err = r.icmpconn.WriteTo(buf[:n], ipaddr)
-				if err != nil {
-					ctxlog.Errorf(ctx, "[ip:%v][icmpid:%v][icmpseq:%v] icmp echo reply: %v",
-						ipaddr, icmpID, icmpSeq, err)
-					continue
-				}
+func workersOrDefault(n int) int {
+	if n <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return n
+}
+
+func (r *Remote) worker(ctx context.Context, ch <-chan remotePacket) {
+	// for decoding with several obfuscators
+	var scratch []byte
+	if len(r.eps) > 1 {
+		scratch = getBuf(kPacketBufSize)
+		defer putBuf(scratch)
+	}
+	for pkt := range ch {
+		r.handleLocal(ctx, pkt.buf, pkt.n, pkt.ipaddr, pkt.rxts, scratch)
+		putBuf(pkt.buf)
+	}
+}
+
+// decodes and forwards a packet from local, called by workers concurrently
+func (r *Remote) handleLocal(
+	ctx context.Context, buf []byte, n int, ipaddr *net.IPAddr, rxts time.Time, scratch []byte) {
+	// body
+
+	/*
+		https://tools.ietf.org/html/rfc792
+		Echo or Echo Reply Message
+		    0                   1                   2                   3
+		    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |     Type      |     Code      |          Checksum             |
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |           Identifier          |        Sequence Number        |
+		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		   |     Data ...
+	*/
+	if n < ICMPEchoHeaderSize {
+		r.logs.log(ctx, slog.LevelWarn, "short:"+ipaddr.String(), "icmp packet too short", "ip", ipaddr.String(), "size", n)
+		return
+	}
+	if buf[0] != ICMPTypeEcho {
+		r.logs.log(ctx, slog.LevelDebug, "type:"+ipaddr.String(), "not icmp echo", "ip", ipaddr.String(), "icmp_type", buf[0])
+		return
+	}
+	icmpID := binary.BigEndian.Uint16(buf[4:6])
+	icmpSeq := binary.BigEndian.Uint16(buf[6:8])
+	captureError(ctx, &r.logs, r.Capture.outer(ipaddr.IP, nil, buf[:n]))
 
-				ctxlog.Debugf(ctx, "icmp echo reply to [ip:%v][icmpid:%v][icmpseq:%v] [size:%v]",
-					ipaddr, icmpID, icmpSeq, n)
-			} else {
-				ctxlog.Warnf(ctx, "[ip:%v][icmpid:%v][icmpseq:%v] Obfuscator.Decode: %v",
-					ipaddr, icmpID, icmpSeq, err)
+	// decode
+	data, ep, err := r.decode(buf[:n], scratch)
+	if err == errShortPacket {
+		r.logs.log(ctx, slog.LevelWarn, "short:"+ipaddr.String(), "icmp packet too short", "ip", ipaddr.String(), "size", n)
+		return
+	}
+	if err != nil {
+		if r.echoEnabled() {
+			// reply normal ping
+			buf[0] = ICMPTypeEchoReply
+			// update checksum
+			checksumUpdate(buf[2:4], ICMPTypeEcho, ICMPTypeEchoReply)
+			// reply echo
+			_, err = r.icmpconn.get().WriteTo(buf[:n], ipaddr)
+			if err != nil {
+				inc(&r.cnt.icmpWrite)
+				r.logs.log(ctx, slog.LevelError, "echo:"+ipaddr.String(), "icmp echo reply",
+					"ip", ipaddr.String(), "icmp_id", icmpID, "icmp_seq", icmpSeq, errAttr(err))
+				return
 			}
-			continue
-		}
-		if &icmpData[hs] != &data[0] {
-			panic("should reuse buf")
+			inc(&r.cnt.echoReplies)
+
+			r.logs.log(ctx, slog.LevelDebug, "echo:"+ipaddr.String(), "icmp echo reply",
+				"ip", ipaddr.String(), "icmp_id", icmpID, "icmp_seq", icmpSeq, "size", n)
+		} else {
+			inc(&r.cnt.decodeErrors)
+			r.logs.log(ctx, slog.LevelWarn, "decode:"+ipaddr.String(), "decode",
+				"ip", ipaddr.String(), "icmp_id", icmpID, "icmp_seq", icmpSeq, errAttr(err))
+			r.obs.DecodeError(ipaddr.IP, err)
 		}
+		return
+	}
 
-		// src dst cmd pktid
-		if len(data) < kTunHeaderSize {
-			ctxlog.Errorf(ctx, "short data, length: %v", len(data))
-			continue
+	// src dst cmd pktid
+	if len(data) < kTunHeaderSize {
+		r.logs.log(ctx, slog.LevelError, "short:"+ipaddr.String(), "short data", "ip", ipaddr.String(), "size", len(data))
+		return
+	}
+	src := binary.LittleEndian.Uint32(data[0:4])
+	dst := binary.LittleEndian.Uint32(data[4:8])
+	cmdField := binary.LittleEndian.Uint32(data[8:12])
+	cmd, epoch := splitCmd(cmdField)
+	pktid := binary.LittleEndian.Uint32(data[12:16])
+	data = data[kTunHeaderSize:]
+
+	// for the endpoint, or relayed to another local by the endpoint that decoded it
+	relay := false
+	if target := r.dispatch(ep, dst); target != nil {
+		ep = target
+	} else if ep.loadConf().Routes != nil && r.id2ep[dst] == nil {
+		relay = true
+	} else {
+		inc(&r.cnt.idMismatches)
+		r.logs.log(ctx, slog.LevelError, "mismatch:"+ipaddr.String(), "node id mismatch",
+			"ip", ipaddr.String(), nodeAttr("src", src), nodeAttr("dst", dst))
+		r.obs.NodeIDMismatch(ipaddr.IP, src, dst)
+		return
+	}
+	conf := ep.loadConf()
+
+	if !conf.ACL.Permit(src) {
+		inc(&r.cnt.aclDenied)
+		r.logs.log(ctx, slog.LevelDebug, "acl:"+ipaddr.String(), "denied by acl", nodeAttr("local", src), "ip", ipaddr.String())
+		return
+	}
+
+	// peer closing
+	switch cmd {
+	case kCmdData, kCmdProbe, kCmdProbeAck, kCmdReport, kCmdReverse, kCmdKeepalive:
+		// pass
+	case kCmdClose:
+		if peer := r.getPeer(ep.id, src); peer != nil && epochState(peer.epoch, peer.prevEpoch, epoch) == epochSame {
+			logInfo(ctx, "local is closing, removing peer", nodeAttr("local", src))
+			r.delPeer(ctx, peer, "closed")
+		}
+		if relay {
+			r.relay(ctx, ep, nil, src, dst, cmdField, pktid, data)
 		}
-		src := binary.LittleEndian.Uint32(data[0:4])
-		dst := binary.LittleEndian.Uint32(data[4:8])
-		pktid := binary.LittleEndian.Uint32(data[12:16])
-		data = data[kTunHeaderSize:]
+		return
+	default:
+		r.logs.log(ctx, slog.LevelDebug, "cmd:"+ipaddr.String(), "unknown command", nodeAttr("local", src), "cmd", cmd)
+		return
+	}
 
-		if dst != r.NodeId {
-			ctxlog.Errorf(ctx, "[dst:%v] != [myid:%v] [src:%v][ip:%v]",
-				dst, r.NodeId, src, ipaddr)
-			continue
+	// update or create peer
+	peer := r.updatePeer(ctx, ep, ipaddr, icmpID, icmpSeq, src, epoch, relay)
+	if peer == nil {
+		return
+	}
+	if !relay && peer.relayOnly {
+		r.logs.log(ctx, slog.LevelDebug, "relay only:"+nodeLabel(src), "drop from relay only local",
+			nodeAttr("local", src), "ip", ipaddr.String())
+		return
+	}
+	if relay {
+		atomic.StoreInt32(&peer.relay, 1)
+		r.relay(ctx, ep, peer, src, dst, cmdField, pktid, data)
+		return
+	}
+
+	// control packets
+	switch cmd {
+	case kCmdProbe:
+		if err := peer.sendCtrl(kCmdProbeAck, data); err != nil {
+			logError(ctx, "probe ack", nodeAttr("local", src), errAttr(err))
+		}
+		return
+	case kCmdKeepalive:
+		// the peer is updated
+		return
+	case kCmdReverse:
+		r.reverseReply(ctx, peer, data)
+		return
+	case kCmdProbeAck:
+		if rtt, ok := probeRTT(data, rxts); ok {
+			peer.st.AddRTT(rtt)
+		}
+		return
+	case kCmdReport:
+		if report, err := decodeReport(data); err != nil {
+			inc(&r.cnt.decodeErrors)
+			logError(ctx, "decode report", nodeAttr("local", src), errAttr(err))
+			r.obs.DecodeError(ipaddr.IP, err)
+		} else {
+			peer.st.SetPeer(report)
+			if level, ok := packetLogLevel(ctx, &peer.verbose); ok {
+				logAt(ctx, level, "report", nodeAttr("local", src), "stats", report)
+			}
 		}
+		return
+	}
 
-		// update or create peer
-		peer := r.updatePeer(ctx, ipaddr, icmpID, icmpSeq, src, pktid)
-		if peer == nil {
-			continue
+	// log
+	if level, ok := packetLogLevel(ctx, &peer.verbose); ok {
+		logAt(ctx, level, "recv from local", nodeAttr("local", src), "ip", ipaddr.String(), "icmp_id", icmpID,
+			"icmp_seq", icmpSeq, "pktid", pktid, "size", len(data), "wire_size", n)
+	}
+
+	// stats
+	if peer.st.Update(pktid, len(data)) {
+		snap := peer.st.Snapshot()
+		logInfo(ctx, "stats", nodeAttr("local", src), "stats", snap)
+		r.obs.LossReport(src, snap)
+	}
+
+	// rate limit
+	if !peer.uplimit.Allow(conf.RateLimit, time.Now()) {
+		inc(&r.cnt.rateLimited)
+		if level, ok := packetLogLevel(ctx, &peer.verbose); ok {
+			logAt(ctx, level, "rate limited", nodeAttr("local", src), "dir", "up", "pktid", pktid)
 		}
+		return
+	}
 
-		// log
-		if r.Verbose {
-			ctxlog.Debugf(ctx, "recv from [local:%v] [ip:%v][icmpid:%v][icmpseq:%v] [pktid:%v] [size:%v/%v]",
-				src, ipaddr, icmpID, icmpSeq, pktid, len(data), n)
+	// target of the channel
+	ch := cmdChannel(cmdField)
+	taddr := conf.targets[ch]
+	if taddr == nil {
+		inc(&r.cnt.unknownChan)
+		r.logs.log(ctx, slog.LevelWarn, "channel:"+nodeLabel(src), "unknown channel", nodeAttr("local", src), "channel", ch)
+		return
+	}
+
+	// middleware
+	meta := PacketMeta{Dir: LocalToTarget, Self: ep.id, Node: src, PktID: pktid, Channel: ch,
+		Src: peer.lconn.LocalAddr().(*net.UDPAddr), Dst: taddr}
+	data, v := r.Middleware.run(meta, data)
+	peer.mirror(ctx, data, v.Mirror)
+	if v.Drop {
+		return
+	}
+	if v.Delay > 0 {
+		if !peer.delayed.add(v.Delay, data, func(data []byte) { peer.writeTarget(ctx, data, taddr) }) {
+			inc(&r.cnt.delayDrops)
+			r.logs.log(ctx, slog.LevelWarn, "delay:"+nodeLabel(src), "delayed datagram dropped", nodeAttr("local", src))
 		}
+		return
+	}
+
+	// send data to target
+	peer.writeTarget(ctx, data, taddr)
+}
 
-		// stats
-		if peer.st.Update(pktid) {
-			ctxlog.Infof(ctx, "[local:%v] loss count: [%v/%v] [%v/%v] [%v/%v]",
-				src,
-				peer.st.Loss100, peer.st.Count100,
-				peer.st.Loss1000, peer.st.Count1000,
-				peer.st.Loss10000, peer.st.Count10000,
-			)
+func (p *localPeer) writeTarget(ctx context.Context, data []byte, taddr *net.UDPAddr) {
+	_, err := p.lconn.WriteTo(data, taddr)
+	if err != nil {
+		inc(&p.r.cnt.udpWrite)
+		p.r.logs.log(ctx, slog.LevelError, "write target", "write target", nodeAttr("local", p.id), errAttr(err))
+		return
+	}
+	atomic.AddUint64(&p.r.npkt, 1)
+	p.up.add(len(data))
+	captureError(ctx, &p.r.logs, p.r.Capture.inner(p.lconn.LocalAddr().(*net.UDPAddr), taddr, data))
+}
+
+func (p *localPeer) mirror(ctx context.Context, data []byte, addrs []*net.UDPAddr) {
+	if err := mirror(p.lconn, data, addrs); err != nil {
+		inc(&p.r.cnt.udpWrite)
+		p.r.logs.log(ctx, slog.LevelError, "mirror", "mirror", nodeAttr("local", p.id), errAttr(err))
+	}
+}
+
+// sends the datagram to local after delay
+func (p *localPeer) sendLater(ctx context.Context, delay time.Duration, data []byte, ch uint8, pktid uint32) {
+	added := p.delayed.add(delay, data, func(data []byte) {
+		conf := p.ep.loadConf()
+		buf := getBuf(kPacketBufSize)
+		defer putBuf(buf)
+
+		p.mu.Lock()
+		ipaddr, icmpid, icmpseq := p.ipaddr, p.icmpid, p.icmpseq
+		p.mu.Unlock()
+
+		n := copy(buf[ICMPEchoHeaderSize+conf.Obfuscator.HeaderSize()+kTunHeaderSize:], data)
+		encoded := encodeData(conf.Obfuscator, buf, n, ICMPTypeEchoReply, icmpid, icmpseq,
+			p.ep.id, p.id, withChannel(makeCmd(kCmdData, p.r.epoch), ch), pktid)
+		if _, err := p.r.icmpconn.get().WriteTo(encoded, ipaddr); err != nil {
+			inc(&p.r.cnt.icmpWrite)
+			p.r.logs.log(ctx, slog.LevelError, "reply local", "reply local", errAttr(err))
+			return
 		}
+		atomic.AddUint64(&p.r.npkt, 1)
+		p.down.add(n)
+	})
+	if !added {
+		inc(&p.r.cnt.delayDrops)
+		p.r.logs.log(ctx, slog.LevelWarn, "delay:"+nodeLabel(p.id), "delayed datagram dropped", nodeAttr("local", p.id))
+	}
+}
 
-		// send data to target
-		// NOTE: race with r.delPeer()
-		_, err = peer.lconn.WriteToUDP(data, r.taddr)
-		if err != nil {
-			ctxlog.Errorf(ctx, "write target for [local:%v]: %v", src, err)
-			continue
+// forwards a packet from local src to local dst of ep, as an echo reply on the latest icmp id and seq
+// of dst. the packet keeps the cmd and pktid of src, thus the locals see each other as the remote.
+func (r *Remote) relay(
+	ctx context.Context, ep *endpoint, from *localPeer,
+	src uint32, dst uint32, cmd uint32, pktid uint32, data []byte) {
+	// body
+	conf := ep.loadConf()
+	if !conf.Routes.Permit(src, dst) {
+		inc(&r.cnt.relayDrops)
+		r.logs.log(ctx, slog.LevelDebug, "route:"+nodeLabel(src), "no route", nodeAttr("src", src), nodeAttr("dst", dst))
+		return
+	}
+	to := r.getPeer(ep.id, dst)
+	if to == nil {
+		inc(&r.cnt.relayDrops)
+		r.logs.log(ctx, slog.LevelDebug, "relay:"+nodeLabel(dst), "relay to unknown local",
+			nodeAttr("src", src), nodeAttr("dst", dst))
+		return
+	}
+	if from != nil && !from.uplimit.Allow(conf.RateLimit, time.Now()) {
+		inc(&r.cnt.rateLimited)
+		if level, ok := packetLogLevel(ctx, &from.verbose); ok {
+			logAt(ctx, level, "rate limited", nodeAttr("local", src), "dir", "relay", "pktid", pktid)
 		}
+		return
+	}
 
-		// done
-	} // for loop
+	to.mu.Lock()
+	ipaddr := to.ipaddr
+	icmpid := to.icmpid
+	icmpseq := to.icmpseq
+	to.mu.Unlock()
 
-	// clean up
-	r.quiter.Wait()
-	if len(r.id2peer) != 0 {
-		panic("len(r.id2peer) != 0")
+	buf := getBuf(kPacketBufSize)
+	defer putBuf(buf)
+	n := copy(buf[ICMPEchoHeaderSize+conf.Obfuscator.HeaderSize()+kTunHeaderSize:], data)
+	encoded := encodeData(conf.Obfuscator, buf, n, ICMPTypeEchoReply, icmpid, icmpseq, src, dst, cmd, pktid)
+	if _, err := r.icmpconn.get().WriteTo(encoded, ipaddr); err != nil {
+		inc(&r.cnt.icmpWrite)
+		r.logs.log(ctx, slog.LevelError, "relay", "relay", nodeAttr("src", src), nodeAttr("dst", dst), errAttr(err))
+		return
+	}
+	inc(&r.cnt.relayed)
+	atomic.AddUint64(&r.npkt, 1)
+	if from != nil {
+		from.up.add(n)
+	}
+	to.down.add(n)
+	captureError(ctx, &r.logs, r.Capture.outer(nil, ipaddr.IP, encoded))
+
+	if level, ok := packetLogLevel(ctx, &to.verbose); ok {
+		logAt(ctx, level, "relay", nodeAttr("src", src), nodeAttr("dst", dst), "ip", ipaddr.String(),
+			"icmp_seq", icmpseq, "pktid", pktid, "size", n)
+	}
+}
+
+func (r *Remote) getPeer(ep uint32, id uint32) *localPeer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id2peer[peerKey(ep, id)]
+}
+
+// of all endpoints
+func (r *Remote) peersOf(id uint32) []*localPeer {
+	var peers []*localPeer
+	for _, peer := range r.peers() {
+		if peer.id == id {
+			peers = append(peers, peer)
+		}
 	}
+	return peers
 }
 
-func (r *Remote) getPeer(id uint32) *localPeer {
+func (r *Remote) peers() []*localPeer {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.id2peer[id]
+	peers := make([]*localPeer, 0, len(r.id2peer))
+	for _, peer := range r.id2peer {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (r *Remote) expirePeers(ctx context.Context, now time.Time) {
+	r.mu.Lock()
+	events := r.expirePeersLocked(ctx, now)
+	r.mu.Unlock()
+	for _, ev := range events {
+		ev()
+	}
 }
 
+// removes the peers not seen for PeerIdleTimeout, returns the events to notify after unlocked
+func (r *Remote) expirePeersLocked(ctx context.Context, now time.Time) []func() {
+	timeout := r.PeerIdleTimeout
+	if timeout == 0 {
+		timeout = kPeerIdleTimeout
+	}
+	if timeout < 0 {
+		return nil
+	}
+
+	var events []func()
+	for key, peer := range r.id2peer {
+		idle := now.Sub(time.Unix(0, atomic.LoadInt64(&peer.seen)))
+		if idle <= timeout {
+			continue
+		}
+		logInfo(ctx, "removing idle peer", nodeAttr("local", peer.id), nodeAttr("endpoint", peer.ep.id), "idle", idle)
+		r.removePeerLocked(key, peer)
+		peer.close(ctx)
+		peer.mu.Lock()
+		removed := peer.event("idle")
+		peer.mu.Unlock()
+		events = append(events, func() { r.obs.PeerRemoved(removed) })
+	}
+	return events
+}
+
+// guarded by r.mu
+func (r *Remote) addPeerLocked(key uint64, p *localPeer) {
+	r.id2peer[key] = p
+	if !p.relayOnly {
+		r.npeers++
+		p.ep.npeers++
+	}
+}
+
+// guarded by r.mu
+func (r *Remote) removePeerLocked(key uint64, p *localPeer) {
+	delete(r.id2peer, key)
+	if !p.relayOnly {
+		r.npeers--
+		p.ep.npeers--
+	}
+}
+
+// a new peer of relay has no target socket, and is not limited by MaxPeers
 func (r *Remote) updatePeer(
-	ctx context.Context, ipaddr *net.IPAddr,
-	icmpID uint16, icmpSeq uint16, id uint32, pktid uint32) *localPeer {
+	ctx context.Context, ep *endpoint, ipaddr *net.IPAddr,
+	icmpID uint16, icmpSeq uint16, id uint32, epoch uint16, relay bool) *localPeer {
 	// body
-	ctx = ctxlog.Pushf(ctx, "[local:%v]", id)
+	if ep == &r.ep {
+		ctx = logWith(ctx, nodeAttr("local", id))
+	} else {
+		ctx = logWith(ctx, nodeAttr("local", id), nodeAttr("endpoint", ep.id))
+	}
+	key := peerKey(ep.id, id)
+
+	// observers are notified after unlocked
+	var events []func()
+	defer func() {
+		for _, ev := range events {
+			ev()
+		}
+	}()
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	peer, ok := r.id2peer[id]
+	peer, ok := r.id2peer[key]
+	prevEpoch := uint16(0)
+	if ok {
+		switch epochState(peer.epoch, peer.prevEpoch, epoch) {
+		case epochStale:
+			inc(&r.cnt.staleEpoch)
+			r.logs.log(ctx, slog.LevelDebug, "stale epoch", "drop from previous session of local", "epoch", epoch)
+			return nil
+		case epochNew:
+			// new target socket and stats
+			inc(&r.cnt.peerRestarts)
+			logNotice(ctx, "local restarted, recreating peer", "old_epoch", peer.epoch, "epoch", epoch)
+			r.removePeerLocked(key, peer)
+			peer.close(ctx)
+			prevEpoch, ok = peer.epoch, false
+			removed := peer.event("restarted")
+			events = append(events, func() { r.obs.PeerRemoved(removed) })
+		}
+	}
 	if !ok {
+		// the idle peers not expired by timers yet
+		limited := !relay && ((r.MaxPeers > 0 && r.npeers >= r.MaxPeers) || (ep.maxPeers > 0 && ep.npeers >= ep.maxPeers))
+		if limited {
+			events = append(events, r.expirePeersLocked(ctx, time.Now())...)
+		}
+		if limited && r.MaxPeers > 0 && r.npeers >= r.MaxPeers {
+			inc(&r.cnt.peerLimit)
+			r.logs.log(ctx, slog.LevelWarn, "max peers", "too many peers", "ip", ipaddr.String(), "max_peers", r.MaxPeers)
+			return nil
+		}
+		if limited && ep.maxPeers > 0 && ep.npeers >= ep.maxPeers {
+			inc(&r.cnt.peerLimit)
+			r.logs.log(ctx, slog.LevelWarn, "max peers:"+nodeLabel(ep.id), "too many peers of endpoint",
+				"ip", ipaddr.String(), "max_peers", ep.maxPeers)
+			return nil
+		}
+
 		// new peer
-		ctxlog.Infof(ctx, "ip:id learned: %v:%v", ipaddr, icmpID)
+		logInfo(ctx, "peer learned", "ip", ipaddr.String(), "icmp_id", icmpID, "epoch", epoch)
 		peer = &localPeer{
-			r: r, id: id, ipaddr: ipaddr, icmpid: icmpID, icmpseq: icmpSeq,
-			pktid: uint32(Rand64ByTime()),
+			r: r, ep: ep, id: id, ipaddr: ipaddr, icmpid: icmpID, icmpseq: icmpSeq,
+			pktid: uint32(Rand64ByTime()), epoch: epoch, prevEpoch: prevEpoch, relayOnly: relay,
 		}
+		peer.st.Windows = r.StatsWindows
 		peer.st.Init()
 
-		var err error
-		peer.lconn, err = net.ListenUDP("udp4", nil)
-		if err != nil {
-			ctxlog.Errorf(ctx, "can not listen udp for local: %v", err)
-			return nil
-		}
-		ctxlog.Infof(ctx, "listen on [addr:%v] for target", peer.lconn.LocalAddr())
+		if !relay {
+			var err error
+			peer.lconn, err = networkOrDefault(r.Network).ListenUDP("")
+			if err != nil {
+				logError(ctx, "can not listen udp for local", errAttr(err))
+				return nil
+			}
+			logInfo(ctx, "listen for target", "addr", peer.lconn.LocalAddr().String())
 
-		// start target reader
-		if !r.quiter.Go(func() { peer.target2remote(ctx) }) {
-			ctxlog.Debugf(ctx, "quiting, can not start target reader")
-			SafeClose(ctx, peer.lconn)
-			return nil
+			// start target reader
+			if !r.group.Go(func() error { peer.target2remote(ctx); return nil }) {
+				logDebug(ctx, "quiting, can not start target reader")
+				SafeClose(ctx, peer.lconn)
+				return nil
+			}
 		}
 
 		// ok
-		r.id2peer[id] = peer
+		r.addPeerLocked(key, peer)
+		created := peer.event("")
+		events = append(events, func() { r.obs.PeerCreated(created) })
 	} else {
 		peer.mu.Lock()
 		defer peer.mu.Unlock()
 
 		if !(peer.ipaddr.IP.Equal(ipaddr.IP) && peer.icmpid == icmpID) {
 			// update local ip
-			ctxlog.Infof(ctx, "local ip:id updated [old:%v:%v] -> [new:%v:%v]",
-				peer.ipaddr, peer.icmpid, ipaddr, icmpID)
+			logInfo(ctx, "peer updated", "old_ip", peer.ipaddr.String(), "old_icmp_id", peer.icmpid,
+				"ip", ipaddr.String(), "icmp_id", icmpID)
 			peer.ipaddr = ipaddr
 			peer.icmpid = icmpID
+			updated := peer.event("")
+			events = append(events, func() { r.obs.PeerUpdated(updated) })
 		}
 		peer.icmpseq = icmpSeq
 	}
 
+	atomic.StoreInt64(&peer.seen, time.Now().UnixNano())
 	return peer
 }
 
-func (r *Remote) delPeer(ctx context.Context, id uint32) {
+// the target reader of the peer will stop
+func (r *Remote) delPeer(ctx context.Context, p *localPeer, reason string) {
+	key := peerKey(p.ep.id, p.id)
 	r.mu.Lock()
-	p := r.id2peer[id]
-	delete(r.id2peer, id)
+	removed := r.id2peer[key] == p
+	if removed {
+		r.removePeerLocked(key, p)
+	}
 	r.mu.Unlock()
-	SafeClose(ctx, p.lconn)
+	p.close(ctx)
+
+	if removed {
+		p.mu.Lock()
+		ev := p.event(reason)
+		p.mu.Unlock()
+		r.obs.PeerRemoved(ev)
+	}
+}
+
+// stops the target reader and the delayed datagrams
+func (p *localPeer) close(ctx context.Context) {
+	if atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		p.delayed.stop()
+		if p.lconn != nil {
+			SafeClose(ctx, p.lconn)
+		}
+	}
 }
 
 func (p *localPeer) target2remote(ctx context.Context) {
-	ctxlog.Debugf(ctx, "ready to read from target for local")
+	logDebug(ctx, "ready to read from target for local")
 
 	// clean up
-	defer p.r.delPeer(ctx, p.id)
+	defer p.r.delPeer(ctx, p, "target socket")
 
 	//   1B |   1B |     2B | 2B |  2B | 8B |  4B |  4B |  4B |    4B |
 	// type | code | chksum | id | seq | HS | src | dst | cmd | pktid | data
 	// -------------------------------
 	//        ICMP ECHO HEADER
-	hs := p.r.Obfuscator.HeaderSize()
-	buf := make([]byte, 128*1024)
-	buf[0] = ICMPTypeEchoReply
-	buf[1] = 0
-	icmpData := buf[ICMPEchoHeaderSize:]
+	size := batchSizeOrDefault(p.r.BatchSize)
+	rb := newBatchReader(p.lconn, size, 0)
+	defer rb.release()
+	icmp := p.r.icmpconn.get()
+	wb := newBatchWriter(icmp.PacketConn, size)
+	laddr := p.lconn.LocalAddr().(*net.UDPAddr)
 
-	for {
-		// test for quit flag
-		if p.r.quiter.IsQuit() {
-			break
+	queued := make([]queuedICMP, size)
+	done := func(i int, err error) {
+		if err != nil {
+			inc(&p.r.cnt.icmpWrite)
+			p.r.logs.log(ctx, slog.LevelError, "reply local", "reply local", errAttr(err))
+			return
 		}
+		q := &queued[i]
+		atomic.AddUint64(&p.r.npkt, 1)
+		p.down.add(q.size)
+		captureError(ctx, &p.r.logs, p.r.Capture.outer(nil, wb.msgs[i].Addr.(*net.IPAddr).IP, q.encoded))
 
-		// src dst cmd
-		binary.LittleEndian.PutUint32(icmpData[hs+0:hs+4], p.r.NodeId)
-		binary.LittleEndian.PutUint32(icmpData[hs+4:hs+8], p.id)
-		binary.LittleEndian.PutUint32(icmpData[hs+8:hs+12], 0)
+		// log
+		if level, ok := packetLogLevel(ctx, &p.verbose); ok {
+			logAt(ctx, level, "reply to local", "icmp_seq", q.icmpseq, "pktid", q.pktid, "size", q.size,
+				"wire_size", len(q.encoded))
+		}
+	}
 
-		// read from local
-		_ = p.lconn.SetReadDeadline(time.Now().Add(kIOInterval))
-		n, addr, err := p.lconn.ReadFrom(icmpData[hs+kTunHeaderSize:])
+	errs := 0
+	for {
+		conf := p.ep.loadConf()
+		hs := conf.Obfuscator.HeaderSize()
+		off := ICMPEchoHeaderSize + hs + kTunHeaderSize
+
+		// read from target, idle peers do not hold buffers
+		err := waitReadable(p.lconn)
+		cnt := 0
+		if err == nil {
+			cnt, err = rb.read(ctx, off)
+		}
 		if err != nil {
-			// skip timeout
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-				continue
+			// closed by delPeer()
+			if atomic.LoadInt32(&p.closed) != 0 {
+				return
+			}
+			// only this peer is affected by a dead socket
+			if err = p.r.group.readError(err, &errs); err != nil {
+				if err != errStopped {
+					logError(ctx, "target socket failed, removing peer", nodeAttr("local", p.id), errAttr(err))
+				}
+				return
 			}
 
-			ctxlog.Errorf(ctx, "target read: %v", err)
+			inc(&p.r.cnt.udpRead)
+			p.r.logs.log(ctx, slog.LevelError, "target read", "target read", errAttr(err))
 			continue
 		}
-		taddr := addr.(*net.UDPAddr)
+		errs = 0
 
-		// verify target addr
-		if !(taddr.IP.Equal(p.r.taddr.IP) && taddr.Port == p.r.taddr.Port) {
-			ctxlog.Warnf(ctx, "drop from [non-target:%v] [pktlen:%v]", taddr, n)
-			continue
+		// reopened by local2remote
+		if sc := p.r.icmpconn.get(); sc != icmp {
+			icmp = sc
+			wb = newBatchWriter(icmp.PacketConn, size)
 		}
 
-		// pktid
-		p.pktid++
-		binary.LittleEndian.PutUint32(icmpData[hs+12:hs+16], p.pktid)
+		for i := 0; i < cnt; i++ {
+			buf := rb.bufs[i]
+			n := rb.msgs[i].N
+			taddr := rb.msgs[i].Addr.(*net.UDPAddr)
+
+			// verify target addr
+			ch, ok := conf.channelOf(taddr)
+			if !ok {
+				inc(&p.r.cnt.nonTarget)
+				p.r.logs.log(ctx, slog.LevelWarn, "non-target:"+taddr.String(), "drop from non-target",
+					"addr", taddr.String(), "size", n)
+				continue
+			}
+
+			captureError(ctx, &p.r.logs, p.r.Capture.inner(taddr, laddr, buf[off:off+n]))
+
+			// rate limit
+			if !p.downlimit.Allow(conf.RateLimit, time.Now()) {
+				inc(&p.r.cnt.rateLimited)
+				if level, ok := packetLogLevel(ctx, &p.verbose); ok {
+					logAt(ctx, level, "rate limited", "dir", "down", "size", n)
+				}
+				continue
+			}
+
+			// middleware, dropped packets do not take pktids
+			pktid := p.pktid + 1
+			meta := PacketMeta{Dir: TargetToLocal, Self: p.ep.id, Node: p.id, PktID: pktid, Channel: ch, Src: taddr, Dst: laddr}
+			n, v := p.r.Middleware.runInPlace(meta, buf, off, n)
+			p.mirror(ctx, buf[off:off+n], v.Mirror)
+			if v.Drop {
+				continue
+			}
+			p.pktid = pktid
+			if v.Delay > 0 {
+				p.sendLater(ctx, v.Delay, buf[off:off+n], ch, pktid)
+				continue
+			}
+
+			// read local ip and icmp id
+			p.mu.Lock()
+			ipaddr := p.ipaddr
+			icmpid := p.icmpid
+			icmpseq := p.icmpseq
+			p.mu.Unlock()
+
+			// encode
+			encoded := encodeData(conf.Obfuscator, buf, n, ICMPTypeEchoReply, icmpid, icmpseq,
+				p.ep.id, p.id, withChannel(makeCmd(kCmdData, p.r.epoch), ch), pktid)
 
-		// encode
-		encoded := p.r.Obfuscator.Encode(buf[:ICMPEchoHeaderSize], icmpData[hs:hs+kTunHeaderSize+n])
-		if &buf[0] != &encoded[0] {
-			panic("should reuse buf")
+			// queue icmp reply
+			queued[wb.n] = queuedICMP{size: n, pktid: pktid, icmpseq: icmpseq, encoded: encoded}
+			wb.add(encoded, ipaddr)
 		}
 
-		// read local ip and icmp id
-		p.mu.Lock()
-		ipaddr := p.ipaddr
-		icmpid := p.icmpid
-		icmpseq := p.icmpseq
-		p.mu.Unlock()
+		// write icmp replies
+		wb.flush(done)
+		rb.release()
+	} // for loop
+}
 
-		// icmp id, icmp seq
-		binary.BigEndian.PutUint16(encoded[4:6], icmpid)
-		binary.BigEndian.PutUint16(encoded[6:8], icmpseq)
-		// checksum
-		checksumPut(encoded[2:4], encoded)
+// replies a control packet on the latest icmp id and seq
+func (p *localPeer) sendCtrl(cmd uint32, payload []byte) error {
+	p.mu.Lock()
+	ipaddr := p.ipaddr
+	icmpid := p.icmpid
+	icmpseq := p.icmpseq
+	p.mu.Unlock()
 
-		// write icmp reply
-		_, err = p.r.icmpconn.WriteTo(encoded, ipaddr)
-		if err != nil {
-			ctxlog.Errorf(ctx, "reply local error: %v", err)
-			continue
+	conf := p.ep.loadConf()
+	pkt := encodeCtrl(conf.Obfuscator, ICMPTypeEchoReply, icmpid, icmpseq,
+		p.ep.id, p.id, makeCmd(cmd, p.r.epoch), payload)
+	_, err := p.r.icmpconn.get().WriteTo(pkt, ipaddr)
+	if err != nil {
+		inc(&p.r.cnt.icmpWrite)
+		return err
+	}
+	_ = p.r.Capture.outer(nil, ipaddr.IP, pkt) // errors are logged on the data path
+	return nil
+}
+
+func (r *Remote) CollectMetrics(m *Metrics) {
+	remote := nodeLabel(r.NodeId)
+	peers := r.peers()
+	npeers := map[*endpoint]int{}
+	for _, peer := range peers {
+		npeers[peer.ep]++
+	}
+	for _, ep := range r.endpoints() {
+		m.Gauge("peers", "Active peers.", float64(npeers[ep]), "remote", nodeLabel(ep.id))
+	}
+	for _, peer := range peers {
+		labels := []string{"local", nodeLabel(peer.id), "remote", nodeLabel(peer.ep.id)}
+		peer.up.collect(m, append(labels, "dir", "up")...)
+		peer.down.collect(m, append(labels, "dir", "down")...)
+		snap := peer.st.Snapshot()
+		collectStats(m, snap, append(labels, "dir", "up")...)
+		if snap.Peer != nil {
+			collectStats(m, *snap.Peer, append(labels, "dir", "down")...)
 		}
+	}
+	if len(r.Reverse) > 0 {
+		m.Gauge("reverse_sessions", "Active senders of reverse forwarding.", float64(r.rev.len()), "remote", remote)
+	}
+	r.cnt.collect(m, "target", "remote", remote)
+	r.icmpconn.collect(m, "remote", remote)
+	r.logs.collect(m, "remote", remote)
+}
 
-		// log
-		if p.r.Verbose {
-			ctxlog.Debugf(ctx, "reply icmp packet to local [pktid:%v] [size:%v/%v]",
-				p.pktid, n, len(encoded))
+func (r *Remote) Peers() []PeerInfo {
+	var infos []PeerInfo
+	for _, peer := range r.peers() {
+		peer.mu.Lock()
+		info := PeerInfo{
+			ID:       nodeLabel(peer.id),
+			Endpoint: nodeLabel(peer.ep.id),
+			IP:       peer.ipaddr.String(),
+			ICMPID:   peer.icmpid,
+			ICMPSeq:  peer.icmpseq,
 		}
-	} // for loop
+		peer.mu.Unlock()
+
+		if peer.lconn != nil {
+			info.Socket = peer.lconn.LocalAddr().String()
+			info.Target = peer.ep.loadConf().taddr.String()
+		}
+		info.UpPackets = atomic.LoadUint64(&peer.up.packets)
+		info.UpBytes = atomic.LoadUint64(&peer.up.bytes)
+		info.DownPackets = atomic.LoadUint64(&peer.down.packets)
+		info.DownBytes = atomic.LoadUint64(&peer.down.bytes)
+		info.Stats = peer.st.Snapshot()
+		info.LastSeen = time.Unix(0, atomic.LoadInt64(&peer.seen))
+		info.Verbose = atomic.LoadInt32(&peer.verbose) != 0
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (r *Remote) DumpConfig() map[string]interface{} {
+	c := r.Config()
+	dump := dumpRemoteConfig(c)
+	dump["node_id"] = nodeLabel(r.NodeId)
+	dump["log_level"] = logLevelName(r.LogLevel)
+
+	// the first is NodeId
+	if eps := r.endpoints(); len(eps) > 1 {
+		var dumps []map[string]interface{}
+		for _, ep := range eps[1:] {
+			epDump := dumpRemoteConfig(ep.loadConf().RemoteConfig)
+			epDump["node_id"] = nodeLabel(ep.id)
+			epDump["max_peers"] = ep.maxPeers
+			dumps = append(dumps, epDump)
+		}
+		dump["endpoints"] = dumps
+	}
+	if len(r.Reverse) > 0 {
+		var rev []string
+		for _, fw := range r.Reverse {
+			rev = append(rev, fw.Listen+"->"+nodeLabel(fw.Local))
+		}
+		dump["reverse"] = rev
+	}
+	return dump
+}
+
+func dumpRemoteConfig(c RemoteConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"target":     c.Target,
+		"echo":       c.EnableEcho,
+		"obfs":       ObfsName(c.Obfuscator),
+		"acl":        c.ACL.String(),
+		"rate_limit": c.RateLimit,
+		"routes":     c.Routes.String(),
+		"services":   formatServices(c.Services),
+	}
+}
+
+// of the local on all endpoints
+func (r *Remote) SetPeerVerbose(id uint32, on bool) bool {
+	peers := r.peersOf(id)
+	var v int32
+	if on {
+		v = 1
+	}
+	for _, peer := range peers {
+		atomic.StoreInt32(&peer.verbose, v)
+	}
+	return len(peers) > 0
+}
+
+// KickPeer removes the peer from all endpoints, it will be re-created by new packets
+func (r *Remote) KickPeer(ctx context.Context, id uint32) bool {
+	peers := r.peersOf(id)
+	for _, peer := range peers {
+		r.delPeer(ctx, peer, "kicked")
+	}
+	return len(peers) > 0
+}
+
+// BanNode updates the deny list of the current ACL of all endpoints, until the next Reload() from config.
+func (r *Remote) BanNode(ctx context.Context, id uint32, ban bool) error {
+	eps := r.endpoints()
+	if len(eps) == 0 {
+		return errors.New("remote not running")
+	}
+	for _, ep := range eps {
+		c := ep.loadConf().RemoteConfig
+		c.ACL = c.ACL.WithDeny(id, ban)
+		if _, err := r.reload(ctx, ep, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Remote) LogLevelVar() *slog.LevelVar {
+	return r.LogLevel
+}
+
+func (r *Remote) CaptureControl() *Capture {
+	return r.Capture
 }
@@ -0,0 +1,36 @@
+package icmp_tun
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestRemoteShard(t *testing.T) {
+	keyed := NewSM64CRC32ObfsWithKey(ObfsKeyFromString("secret"))
+	r := &Remote{NodeId: 2}
+	r.Endpoints = []Endpoint{{NodeId: 3, RemoteConfig: RemoteConfig{Target: "127.0.0.1:53", Obfuscator: keyed}}}
+	primary, err := newRemoteConf(RemoteConfig{Target: "127.0.0.1:53", Obfuscator: NewSM64CRC32Obfs()})
+	require.NoError(t, err)
+	require.NoError(t, r.initEndpoints(primary))
+
+	const shards = 64
+	scratch := make([]byte, kPacketBufSize)
+	shard := func(obfs Obfuscator, ip string, icmpID uint16, src uint32, dst uint32) int {
+		pkt := encodeData(obfs, make([]byte, kPacketBufSize), 10, ICMPTypeEcho, icmpID, 1, src, dst, kCmdData, 1)
+		return r.shard(&net.IPAddr{IP: net.ParseIP(ip)}, pkt, shards, scratch)
+	}
+
+	// by the node id, wherever the peer sends from
+	for _, c := range []struct {
+		obfs Obfuscator
+		dst  uint32
+	}{{primary.Obfuscator, 2}, {keyed, 3}} {
+		for src := uint32(1); src < 20; src++ {
+			expected := shard(c.obfs, "10.0.0.1", 1, src, c.dst)
+			assert.Equal(t, expected, shard(c.obfs, "10.0.0.1", 2, src, c.dst))
+			assert.Equal(t, expected, shard(c.obfs, "10.0.0.2", 3, src, c.dst))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package icmp_tun
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"math"
+	"time"
+)
+
+// payload of kCmdReport, the sender's view of the direction it receives
+//
+//	1B | 12B * n                   | 8B   | 8B * 5   | 8B * 2 | 8B * 6
+//	 n | window, loss, count * n   | ewma | counters | rates  | rtt
+
+const kReportMaxWindows = 16
+const kReportFixedSize = 1 + 8 + 8*5 + 8*2 + 8*6
+
+func encodeReport(snap StatsSnapshot) []byte {
+	loss := snap.Loss
+	if len(loss) > kReportMaxWindows {
+		loss = loss[:kReportMaxWindows]
+	}
+
+	b := make([]byte, 0, kReportFixedSize+12*len(loss))
+	b = append(b, uint8(len(loss)))
+	for _, w := range loss {
+		b = binary.LittleEndian.AppendUint32(b, w.Window)
+		b = binary.LittleEndian.AppendUint32(b, w.Loss)
+		b = binary.LittleEndian.AppendUint32(b, w.Count)
+	}
+	for _, u := range []uint64{
+		math.Float64bits(snap.EWMALoss),
+		snap.Packets, snap.Bytes, snap.OutOfOrder, snap.Duplicates, snap.Resets,
+		math.Float64bits(snap.PacketRate), math.Float64bits(snap.ByteRate),
+		snap.RTT.Count, uint64(snap.RTT.Min), uint64(snap.RTT.Avg),
+		uint64(snap.RTT.Max), uint64(snap.RTT.P99), uint64(snap.RTT.Jitter),
+	} {
+		b = binary.LittleEndian.AppendUint64(b, u)
+	}
+	return b
+}
+
+func decodeReport(b []byte) (snap StatsSnapshot, err error) {
+	if len(b) < 1 {
+		return snap, errors.New("empty report")
+	}
+	n := int(b[0])
+	if n > kReportMaxWindows || len(b) < kReportFixedSize+12*n {
+		return snap, errors.Errorf("bad report [windows:%v][size:%v]", n, len(b))
+	}
+	b = b[1:]
+
+	for i := 0; i < n; i++ {
+		snap.Loss = append(snap.Loss, LossInfo{
+			Window: binary.LittleEndian.Uint32(b[0:4]),
+			Loss:   binary.LittleEndian.Uint32(b[4:8]),
+			Count:  binary.LittleEndian.Uint32(b[8:12]),
+		})
+		b = b[12:]
+	}
+	u := func() uint64 {
+		v := binary.LittleEndian.Uint64(b)
+		b = b[8:]
+		return v
+	}
+	d := func() time.Duration { return time.Duration(u()) }
+	snap.EWMALoss = math.Float64frombits(u())
+	snap.Packets, snap.Bytes, snap.OutOfOrder, snap.Duplicates, snap.Resets = u(), u(), u(), u(), u()
+	snap.PacketRate = math.Float64frombits(u())
+	snap.ByteRate = math.Float64frombits(u())
+	snap.RTT.Count = u()
+	snap.RTT.Min, snap.RTT.Avg, snap.RTT.Max, snap.RTT.P99, snap.RTT.Jitter = d(), d(), d(), d(), d()
+	return snap, nil
+}
@@ -0,0 +1,511 @@
+package icmp_tun
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reverse forwarding: datagrams to a listener of Remote are carried to a local in echo replies,
+// the local sends them to its Local.Reverse target and carries the replies back in echo requests.
+// the local sends keepalives so that Remote has echo requests to reply on.
+//
+// payload of kCmdReverse: 4B session id, data
+
+const kReverseHeaderSize = 4
+const kReverseIdle = 2 * time.Minute
+const kKeepaliveInterval = 1 * time.Second
+const kMaxReverseSessions = 256 // of a listener of Remote, or of Local
+
+// ReverseForward listens on the Remote host for the Local node
+type ReverseForward struct {
+	Listen string
+	Local  uint32
+}
+
+type reverseListener struct {
+	ReverseForward
+	conn      net.PacketConn
+	nsessions int // guarded by reverseTable.mu
+}
+
+// a sender of a reverse listener
+type reverseSession struct {
+	id   uint32
+	ln   *reverseListener
+	addr *net.UDPAddr
+	seen int64 // atomic, unix nano
+}
+
+type reverseTable struct {
+	mu     sync.Mutex
+	next   uint32
+	byID   map[uint32]*reverseSession
+	byAddr map[string]*reverseSession // by listener and sender addr
+}
+
+func (t *reverseTable) init() {
+	t.next = uint32(Rand64ByTime())
+	t.byID = map[uint32]*reverseSession{}
+	t.byAddr = map[string]*reverseSession{}
+}
+
+// nil if the listener has too many sessions
+func (t *reverseTable) get(ln *reverseListener, addr *net.UDPAddr, now time.Time) *reverseSession {
+	key := ln.Listen + "|" + addr.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.byAddr[key]
+	if s == nil {
+		if ln.nsessions >= kMaxReverseSessions {
+			return nil
+		}
+		ln.nsessions++
+		t.next++
+		s = &reverseSession{id: t.next, ln: ln, addr: addr}
+		t.byID[s.id] = s
+		t.byAddr[key] = s
+	}
+	atomic.StoreInt64(&s.seen, now.UnixNano())
+	return s
+}
+
+func (t *reverseTable) lookup(id uint32) *reverseSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.byID[id]
+}
+
+func (t *reverseTable) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, s := range t.byAddr {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&s.seen))) > kReverseIdle {
+			delete(t.byAddr, key)
+			delete(t.byID, s.id)
+			s.ln.nsessions--
+		}
+	}
+}
+
+func (t *reverseTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byID)
+}
+
+func encodeReverse(buf []byte, id uint32, n int) []byte {
+	binary.LittleEndian.PutUint32(buf[:kReverseHeaderSize], id)
+	return buf[:kReverseHeaderSize+n]
+}
+
+func decodeReverse(payload []byte) (uint32, []byte, error) {
+	if len(payload) < kReverseHeaderSize {
+		return 0, nil, errors.New("short reverse payload")
+	}
+	return binary.LittleEndian.Uint32(payload), payload[kReverseHeaderSize:], nil
+}
+
+// opens the listeners of Remote.Reverse
+func (r *Remote) listenReverse(ctx context.Context, network Network) error {
+	r.rev.init()
+	r.revLns = nil
+	for _, fw := range r.Reverse {
+		conn, err := network.ListenUDP(fw.Listen)
+		if err != nil {
+			r.closeReverse(ctx)
+			return errors.Wrapf(err, "listen for reverse %s", fw.Listen)
+		}
+		logInfo(ctx, "reverse forwarding", "addr", conn.LocalAddr().String(), nodeAttr("local", fw.Local))
+		r.revLns = append(r.revLns, &reverseListener{ReverseForward: fw, conn: conn})
+	}
+	return nil
+}
+
+// stops the reverse readers
+func (r *Remote) closeReverse(ctx context.Context) {
+	for _, ln := range r.revLns {
+		SafeClose(ctx, ln.conn)
+	}
+}
+
+// carries the datagrams to the listener to the local, in replies of its latest echo request
+func (r *Remote) reverse2local(ctx context.Context, ln *reverseListener) error {
+	ctx = logWith(ctx, "reverse", ln.conn.LocalAddr().String(), nodeAttr("local", ln.Local))
+	logDebug(ctx, "ready to read for reverse forwarding")
+
+	buf := getBuf(kPacketBufSize)
+	defer putBuf(buf)
+	laddr := ln.conn.LocalAddr().(*net.UDPAddr)
+	errs := 0
+	for {
+		// read into the payload of kCmdReverse
+		conf := r.ep.loadConf()
+		off := ICMPEchoHeaderSize + conf.Obfuscator.HeaderSize() + kTunHeaderSize + kReverseHeaderSize
+		n, addr, err := ln.conn.ReadFrom(buf[off:])
+		if err != nil {
+			if err = r.group.readError(err, &errs); err != nil {
+				logDebug(ctx, "stopped to read for reverse forwarding")
+				return err
+			}
+			inc(&r.cnt.udpRead)
+			r.logs.log(ctx, slog.LevelError, "reverse read", "reverse read", errAttr(err))
+			continue
+		}
+		errs = 0
+		saddr := addr.(*net.UDPAddr)
+		captureError(ctx, &r.logs, r.Capture.inner(saddr, laddr, buf[off:off+n]))
+
+		peer := r.getPeer(r.NodeId, ln.Local)
+		if peer == nil {
+			inc(&r.cnt.reverseDrops)
+			r.logs.log(ctx, slog.LevelDebug, "reverse:"+nodeLabel(ln.Local), "reverse to unknown local",
+				"addr", saddr.String())
+			continue
+		}
+		s := r.rev.get(ln, saddr, time.Now())
+		if s == nil {
+			inc(&r.cnt.reverseDrops)
+			r.logs.log(ctx, slog.LevelWarn, "reverse sessions:"+ln.Listen, "too many reverse sessions",
+				"addr", saddr.String(), "max", kMaxReverseSessions)
+			continue
+		}
+
+		// rate limit
+		if !peer.downlimit.Allow(conf.RateLimit, time.Now()) {
+			inc(&r.cnt.rateLimited)
+			if level, ok := packetLogLevel(ctx, &peer.verbose); ok {
+				logAt(ctx, level, "rate limited", "dir", "down", "session", s.id, "size", n)
+			}
+			continue
+		}
+
+		// middleware
+		meta := PacketMeta{Dir: TargetToLocal, Self: r.NodeId, Node: ln.Local, Src: saddr, Dst: laddr}
+		n, v := r.Middleware.runInPlace(meta, buf, off, n)
+		if err = mirror(ln.conn, buf[off:off+n], v.Mirror); err != nil {
+			inc(&r.cnt.udpWrite)
+			r.logs.log(ctx, slog.LevelError, "mirror", "mirror", errAttr(err))
+		}
+		if v.Drop {
+			continue
+		}
+		payload := encodeReverse(buf[off-kReverseHeaderSize:], s.id, n)
+		if v.Delay > 0 {
+			if !peer.delayed.add(v.Delay, payload, func(payload []byte) { r.sendReverseLater(ctx, peer, payload) }) {
+				inc(&r.cnt.delayDrops)
+				r.logs.log(ctx, slog.LevelWarn, "delay:"+nodeLabel(peer.id), "delayed datagram dropped", nodeAttr("local", peer.id))
+			}
+			continue
+		}
+		r.sendReverse(ctx, peer, conf, buf, len(payload))
+
+		if level, ok := packetLogLevel(ctx, &peer.verbose); ok {
+			logAt(ctx, level, "reverse to local", "addr", saddr.String(), "session", s.id, "size", n)
+		}
+	}
+}
+
+// encodes the kCmdReverse payload of n bytes in buf in place, and sends it to the local
+func (r *Remote) sendReverse(ctx context.Context, peer *localPeer, conf *remoteConf, buf []byte, n int) {
+	peer.mu.Lock()
+	ipaddr, icmpid, icmpseq := peer.ipaddr, peer.icmpid, peer.icmpseq
+	peer.mu.Unlock()
+
+	encoded := encodeData(conf.Obfuscator, buf, n, ICMPTypeEchoReply, icmpid, icmpseq,
+		peer.ep.id, peer.id, makeCmd(kCmdReverse, r.epoch), 0)
+	if _, err := r.icmpconn.get().WriteTo(encoded, ipaddr); err != nil {
+		inc(&r.cnt.icmpWrite)
+		r.logs.log(ctx, slog.LevelError, "reverse to local", "reverse to local", errAttr(err))
+		return
+	}
+	inc(&r.cnt.reversed)
+	atomic.AddUint64(&r.npkt, 1)
+	peer.down.add(n - kReverseHeaderSize)
+	captureError(ctx, &r.logs, r.Capture.outer(nil, ipaddr.IP, encoded))
+}
+
+func (r *Remote) sendReverseLater(ctx context.Context, peer *localPeer, payload []byte) {
+	conf := peer.ep.loadConf()
+	buf := getBuf(kPacketBufSize)
+	defer putBuf(buf)
+	n := copy(buf[ICMPEchoHeaderSize+conf.Obfuscator.HeaderSize()+kTunHeaderSize:], payload)
+	r.sendReverse(ctx, peer, conf, buf, n)
+}
+
+// sends a reply from the reverse target of the local back to the sender
+func (r *Remote) reverseReply(ctx context.Context, peer *localPeer, payload []byte) {
+	id, data, err := decodeReverse(payload)
+	if err != nil {
+		inc(&r.cnt.decodeErrors)
+		r.logs.log(ctx, slog.LevelWarn, "reverse:"+nodeLabel(peer.id), "decode reverse", nodeAttr("local", peer.id), errAttr(err))
+		return
+	}
+	s := r.rev.lookup(id)
+	if s == nil || s.ln.Local != peer.id || peer.ep != &r.ep {
+		inc(&r.cnt.reverseDrops)
+		r.logs.log(ctx, slog.LevelDebug, "reverse:"+nodeLabel(peer.id), "unknown reverse session",
+			nodeAttr("local", peer.id), "session", id)
+		return
+	}
+	atomic.StoreInt64(&s.seen, time.Now().UnixNano())
+
+	// rate limit
+	if !peer.uplimit.Allow(peer.ep.loadConf().RateLimit, time.Now()) {
+		inc(&r.cnt.rateLimited)
+		if level, ok := packetLogLevel(ctx, &peer.verbose); ok {
+			logAt(ctx, level, "rate limited", nodeAttr("local", peer.id), "dir", "up", "session", id)
+		}
+		return
+	}
+
+	// middleware
+	meta := PacketMeta{Dir: LocalToTarget, Self: r.NodeId, Node: peer.id, Src: s.ln.conn.LocalAddr().(*net.UDPAddr), Dst: s.addr}
+	data, v := r.Middleware.run(meta, data)
+	if err = mirror(s.ln.conn, data, v.Mirror); err != nil {
+		inc(&r.cnt.udpWrite)
+		r.logs.log(ctx, slog.LevelError, "mirror", "mirror", nodeAttr("local", peer.id), errAttr(err))
+	}
+	if v.Drop {
+		return
+	}
+	if v.Delay > 0 {
+		if !peer.delayed.add(v.Delay, data, func(data []byte) { r.writeReverse(ctx, peer, s, data) }) {
+			inc(&r.cnt.delayDrops)
+			r.logs.log(ctx, slog.LevelWarn, "delay:"+nodeLabel(peer.id), "delayed datagram dropped", nodeAttr("local", peer.id))
+		}
+		return
+	}
+	r.writeReverse(ctx, peer, s, data)
+}
+
+func (r *Remote) writeReverse(ctx context.Context, peer *localPeer, s *reverseSession, data []byte) {
+	if _, err := s.ln.conn.WriteTo(data, s.addr); err != nil {
+		inc(&r.cnt.udpWrite)
+		r.logs.log(ctx, slog.LevelError, "reverse reply", "reverse reply", nodeAttr("local", peer.id), errAttr(err))
+		return
+	}
+	inc(&r.cnt.reversed)
+	atomic.AddUint64(&r.npkt, 1)
+	peer.up.add(len(data))
+	captureError(ctx, &r.logs, r.Capture.inner(s.ln.conn.LocalAddr().(*net.UDPAddr), s.addr, data))
+}
+
+// a socket of the local to the reverse target for a session of Remote
+type reverseConn struct {
+	id     uint32
+	conn   net.PacketConn
+	seen   int64 // atomic, unix nano
+	closed int32
+}
+
+// sends the datagram of the remote to the reverse target
+func (l *Local) handleReverse(ctx context.Context, payload []byte) {
+	id, data, err := decodeReverse(payload)
+	if err != nil {
+		inc(&l.cnt.decodeErrors)
+		l.logs.log(ctx, slog.LevelWarn, "reverse", "decode reverse", errAttr(err))
+		return
+	}
+	if l.rtaddr == nil {
+		inc(&l.cnt.reverseDrops)
+		l.logs.log(ctx, slog.LevelWarn, "reverse", "reverse forwarding not enabled")
+		return
+	}
+
+	// rate limit
+	if !l.downlimit.Allow(l.loadConf().RateLimit, time.Now()) {
+		inc(&l.cnt.rateLimited)
+		if level, ok := packetLogLevel(ctx, &l.verbose); ok {
+			logAt(ctx, level, "rate limited", "dir", "down", "session", id)
+		}
+		return
+	}
+
+	rc := l.reverseConn(ctx, id)
+	if rc == nil {
+		inc(&l.cnt.reverseDrops)
+		return
+	}
+	atomic.StoreInt64(&rc.seen, time.Now().UnixNano())
+
+	// middleware
+	meta := PacketMeta{Dir: RemoteToClient, Self: l.LocalID, Node: l.RemoteID, Src: rc.conn.LocalAddr().(*net.UDPAddr), Dst: l.rtaddr}
+	data, v := l.Middleware.run(meta, data)
+	l.mirror(ctx, rc.conn, data, v.Mirror)
+	if v.Drop {
+		return
+	}
+	if v.Delay > 0 {
+		if !l.delayed.add(v.Delay, data, func(data []byte) { l.writeReverse(ctx, rc, data) }) {
+			inc(&l.cnt.delayDrops)
+			l.logs.log(ctx, slog.LevelWarn, "delay", "delayed datagram dropped")
+		}
+		return
+	}
+	l.writeReverse(ctx, rc, data)
+
+	if level, ok := packetLogLevel(ctx, &l.verbose); ok {
+		logAt(ctx, level, "reverse to target", "session", id, "size", len(data))
+	}
+}
+
+func (l *Local) writeReverse(ctx context.Context, rc *reverseConn, data []byte) {
+	if _, err := rc.conn.WriteTo(data, l.rtaddr); err != nil {
+		inc(&l.cnt.udpWrite)
+		l.logs.log(ctx, slog.LevelError, "write reverse target", "write reverse target", errAttr(err))
+		return
+	}
+	inc(&l.cnt.reversed)
+	atomic.AddUint64(&l.npkt, 1)
+	l.down.add(len(data))
+	captureError(ctx, &l.logs, l.Capture.inner(rc.conn.LocalAddr().(*net.UDPAddr), l.rtaddr, data))
+}
+
+// the socket of the session, opened on the first datagram
+func (l *Local) reverseConn(ctx context.Context, id uint32) *reverseConn {
+	l.revMu.Lock()
+	defer l.revMu.Unlock()
+	if rc := l.revConns[id]; rc != nil {
+		return rc
+	}
+	if len(l.revConns) >= kMaxReverseSessions {
+		l.logs.log(ctx, slog.LevelWarn, "reverse sessions", "too many reverse sessions", "max", kMaxReverseSessions)
+		return nil
+	}
+
+	conn, err := networkOrDefault(l.Network).ListenUDP("")
+	if err != nil {
+		logError(ctx, "can not listen udp for reverse target", errAttr(err))
+		return nil
+	}
+	rc := &reverseConn{id: id, conn: conn, seen: time.Now().UnixNano()}
+	if !l.group.Go(func() error { l.reverse2remote(ctx, rc); return nil }) {
+		SafeClose(ctx, conn)
+		return nil
+	}
+	logDebug(ctx, "reverse session", "session", id, "addr", conn.LocalAddr().String())
+	l.revConns[id] = rc
+	return rc
+}
+
+// carries the replies of the reverse target to the remote, limited by the rate limit of channel 0
+func (l *Local) reverse2remote(ctx context.Context, rc *reverseConn) {
+	defer l.dropReverse(ctx, rc)
+
+	buf := getBuf(kPacketBufSize)
+	defer putBuf(buf)
+	laddr := rc.conn.LocalAddr().(*net.UDPAddr)
+	errs := 0
+	for {
+		// read into the payload of kCmdReverse
+		conf := l.loadConf()
+		off := ICMPEchoHeaderSize + conf.Obfuscator.HeaderSize() + kTunHeaderSize + kReverseHeaderSize
+		n, addr, err := rc.conn.ReadFrom(buf[off:])
+		if err != nil {
+			// closed by dropReverse()
+			if atomic.LoadInt32(&rc.closed) != 0 {
+				return
+			}
+			if err = l.group.readError(err, &errs); err != nil {
+				logError(ctx, "reverse socket failed", "session", rc.id, errAttr(err))
+				return
+			}
+			inc(&l.cnt.udpRead)
+			l.logs.log(ctx, slog.LevelError, "reverse read", "reverse read", errAttr(err))
+			continue
+		}
+		errs = 0
+
+		taddr := addr.(*net.UDPAddr)
+		if !(taddr.IP.Equal(l.rtaddr.IP) && taddr.Port == l.rtaddr.Port) {
+			inc(&l.cnt.nonTarget)
+			l.logs.log(ctx, slog.LevelWarn, "non-target:"+taddr.String(), "drop from non-target",
+				"addr", taddr.String(), "size", n)
+			continue
+		}
+		atomic.StoreInt64(&rc.seen, time.Now().UnixNano())
+		captureError(ctx, &l.logs, l.Capture.inner(taddr, laddr, buf[off:off+n]))
+
+		// rate limit
+		if !l.uplimit.Allow(conf.RateLimit, time.Now()) {
+			inc(&l.cnt.rateLimited)
+			if level, ok := packetLogLevel(ctx, &l.verbose); ok {
+				logAt(ctx, level, "rate limited", "dir", "up", "session", rc.id, "size", n)
+			}
+			continue
+		}
+
+		// middleware
+		meta := PacketMeta{Dir: ClientToRemote, Self: l.LocalID, Node: l.RemoteID, Src: taddr, Dst: laddr}
+		n, v := l.Middleware.runInPlace(meta, buf, off, n)
+		l.mirror(ctx, rc.conn, buf[off:off+n], v.Mirror)
+		if v.Drop {
+			continue
+		}
+		payload := encodeReverse(buf[off-kReverseHeaderSize:], rc.id, n)
+		if v.Delay > 0 {
+			if !l.delayed.add(v.Delay, payload, func(payload []byte) { l.sendReverseLater(ctx, payload) }) {
+				inc(&l.cnt.delayDrops)
+				l.logs.log(ctx, slog.LevelWarn, "delay", "delayed datagram dropped")
+			}
+			continue
+		}
+		l.sendReverse(ctx, conf, buf, len(payload))
+	}
+}
+
+// encodes the kCmdReverse payload of n bytes in buf in place, and sends it to the remote
+func (l *Local) sendReverse(ctx context.Context, conf *localConf, buf []byte, n int) {
+	icmp := l.icmp.get()
+	encoded := encodeData(conf.Obfuscator, buf, n, ICMPTypeEcho, icmp.icmpid, l.nextICMPSeq(),
+		l.LocalID, l.RemoteID, makeCmd(kCmdReverse, l.epoch), 0)
+	if _, err := icmp.WriteTo(encoded, conf.raddr); err != nil {
+		inc(&l.cnt.icmpWrite)
+		l.logs.log(ctx, slog.LevelError, "reverse to remote", "reverse to remote", errAttr(err))
+		return
+	}
+	inc(&l.cnt.reversed)
+	atomic.AddUint64(&l.npkt, 1)
+	l.up.add(n - kReverseHeaderSize)
+	captureError(ctx, &l.logs, l.Capture.outer(nil, conf.raddr.IP, encoded))
+}
+
+func (l *Local) sendReverseLater(ctx context.Context, payload []byte) {
+	conf := l.loadConf()
+	buf := getBuf(kPacketBufSize)
+	defer putBuf(buf)
+	n := copy(buf[ICMPEchoHeaderSize+conf.Obfuscator.HeaderSize()+kTunHeaderSize:], payload)
+	l.sendReverse(ctx, conf, buf, n)
+}
+
+func (l *Local) dropReverse(ctx context.Context, rc *reverseConn) {
+	l.revMu.Lock()
+	if l.revConns[rc.id] == rc {
+		delete(l.revConns, rc.id)
+	}
+	l.revMu.Unlock()
+	if atomic.CompareAndSwapInt32(&rc.closed, 0, 1) {
+		SafeClose(ctx, rc.conn)
+	}
+}
+
+// closes idle sessions, or all if now is zero
+func (l *Local) expireReverse(ctx context.Context, now time.Time) {
+	l.revMu.Lock()
+	var idle []*reverseConn
+	for _, rc := range l.revConns {
+		if now.IsZero() || now.Sub(time.Unix(0, atomic.LoadInt64(&rc.seen))) > kReverseIdle {
+			idle = append(idle, rc)
+		}
+	}
+	l.revMu.Unlock()
+	for _, rc := range idle {
+		l.dropReverse(ctx, rc)
+	}
+}
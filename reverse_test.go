@@ -0,0 +1,37 @@
+package icmp_tun
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReverseTable(t *testing.T) {
+	var tab reverseTable
+	tab.init()
+	ln := &reverseListener{ReverseForward: ReverseForward{Listen: ":2222", Local: 1}}
+	other := &reverseListener{ReverseForward: ReverseForward{Listen: ":3333", Local: 1}}
+	now := time.Now()
+	addr := func(port int) *net.UDPAddr { return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: port} }
+
+	first := tab.get(ln, addr(1), now)
+	require.NotNil(t, first)
+	assert.Equal(t, first, tab.get(ln, addr(1), now))
+	assert.Equal(t, first, tab.lookup(first.id))
+
+	// limited by listener
+	for port := 2; port <= kMaxReverseSessions; port++ {
+		require.NotNil(t, tab.get(ln, addr(port), now))
+	}
+	assert.Nil(t, tab.get(ln, addr(kMaxReverseSessions+1), now))
+	assert.Equal(t, first, tab.get(ln, addr(1), now))
+	assert.NotNil(t, tab.get(other, addr(1), now))
+
+	// idle sessions expire
+	tab.expire(now.Add(kReverseIdle + time.Second))
+	assert.Equal(t, 0, tab.len())
+	assert.Nil(t, tab.lookup(first.id))
+	assert.NotNil(t, tab.get(ln, addr(kMaxReverseSessions+1), now))
+}
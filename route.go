@@ -0,0 +1,111 @@
+package icmp_tun
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// Route permits the packets from local Src to local Dst, 0 for any node-id
+type Route struct {
+	Src uint32
+	Dst uint32
+}
+
+func (r Route) String() string {
+	return formatRouteNode(r.Src) + ":" + formatRouteNode(r.Dst)
+}
+
+func formatRouteNode(id uint32) string {
+	if id == 0 {
+		return "*"
+	}
+	return fmt.Sprintf("0x%08X", id)
+}
+
+// RouteACL filters the packets Remote relays between its locals. A nil RouteACL disables relay.
+type RouteACL struct {
+	routes map[Route]bool
+}
+
+func NewRouteACL(routes []Route) *RouteACL {
+	acl := &RouteACL{routes: map[Route]bool{}}
+	for _, r := range routes {
+		acl.routes[r] = true
+	}
+	return acl
+}
+
+func (acl *RouteACL) Permit(src uint32, dst uint32) bool {
+	if acl == nil {
+		return false
+	}
+	return acl.routes[Route{src, dst}] || acl.routes[Route{0, dst}] ||
+		acl.routes[Route{src, 0}] || acl.routes[Route{0, 0}]
+}
+
+func (acl *RouteACL) Routes() []Route {
+	if acl == nil {
+		return nil
+	}
+	routes := make([]Route, 0, len(acl.routes))
+	for r := range acl.routes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Src != routes[j].Src {
+			return routes[i].Src < routes[j].Src
+		}
+		return routes[i].Dst < routes[j].Dst
+	})
+	return routes
+}
+
+func (acl *RouteACL) Equal(other *RouteACL) bool {
+	return acl.String() == other.String()
+}
+
+func (acl *RouteACL) String() string {
+	if acl == nil {
+		return "disabled"
+	}
+	strs := []string{}
+	for _, r := range acl.Routes() {
+		strs = append(strs, r.String())
+	}
+	return "[" + strings.Join(strs, ",") + "]"
+}
+
+// comma separated src:dst of 0x-prefixed hex or decimal node-ids, * for any node-id
+func ParseRoutes(s string) (*RouteACL, error) {
+	var routes []Route
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		src, dst, ok := strings.Cut(f, ":")
+		if !ok {
+			return nil, errors.Errorf("invalid route: %v", f)
+		}
+		var route Route
+		var err error
+		if route.Src, err = parseRouteNode(src); err == nil {
+			route.Dst, err = parseRouteNode(dst)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid route: %v", f)
+		}
+		routes = append(routes, route)
+	}
+	return NewRouteACL(routes), nil
+}
+
+func parseRouteNode(s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return 0, nil
+	}
+	return parseNodeIDStrict(s)
+}
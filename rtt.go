@@ -0,0 +1,76 @@
+package icmp_tun
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const kRTTSamples = 1024
+
+// RTTStats keeps the latest RTT samples, not goroutine safe
+type RTTStats struct {
+	samples [kRTTSamples]time.Duration
+	count   uint64
+	last    time.Duration
+	jitter  float64 // smoothed as RFC 3550
+}
+
+type RTTSummary struct {
+	Count  uint64        `json:"count"`
+	Min    time.Duration `json:"min"`
+	Avg    time.Duration `json:"avg"`
+	Max    time.Duration `json:"max"`
+	P99    time.Duration `json:"p99"`
+	Jitter time.Duration `json:"jitter"`
+}
+
+func (rs *RTTStats) Add(rtt time.Duration) {
+	if rs.count > 0 {
+		d := rtt - rs.last
+		if d < 0 {
+			d = -d
+		}
+		rs.jitter += (float64(d) - rs.jitter) / 16
+	}
+	rs.samples[rs.count%kRTTSamples] = rtt
+	rs.count++
+	rs.last = rtt
+}
+
+// over the latest kRTTSamples samples
+func (rs *RTTStats) Summary() RTTSummary {
+	n := rs.count
+	if n > kRTTSamples {
+		n = kRTTSamples
+	}
+	if n == 0 {
+		return RTTSummary{}
+	}
+
+	sorted := make([]time.Duration, n)
+	copy(sorted, rs.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	sum := time.Duration(0)
+	for _, rtt := range sorted {
+		sum += rtt
+	}
+	return RTTSummary{
+		Count:  rs.count,
+		Min:    sorted[0],
+		Avg:    sum / time.Duration(n),
+		Max:    sorted[n-1],
+		P99:    sorted[(n*99+99)/100-1],
+		Jitter: time.Duration(rs.jitter),
+	}
+}
+
+func (s RTTSummary) String() string {
+	if s.Count == 0 {
+		return "[rtt:-]"
+	}
+	r := func(d time.Duration) time.Duration { return d.Round(10 * time.Microsecond) }
+	return fmt.Sprintf("[rtt min/avg/max/p99:%v/%v/%v/%v][jitter:%v]",
+		r(s.Min), r(s.Avg), r(s.Max), r(s.P99), r(s.Jitter))
+}
@@ -0,0 +1,56 @@
+package icmp_tun
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRTTStats(t *testing.T) {
+	rs := RTTStats{}
+	assert.Equal(t, RTTSummary{}, rs.Summary())
+
+	for i := 1; i <= 100; i++ {
+		rs.Add(time.Duration(i) * time.Millisecond)
+	}
+	s := rs.Summary()
+	assert.Equal(t, uint64(100), s.Count)
+	assert.Equal(t, 1*time.Millisecond, s.Min)
+	assert.Equal(t, 50500*time.Microsecond, s.Avg)
+	assert.Equal(t, 100*time.Millisecond, s.Max)
+	assert.Equal(t, 99*time.Millisecond, s.P99)
+	assert.True(t, s.Jitter > 0 && s.Jitter <= time.Millisecond)
+
+	// only the latest samples
+	for i := 0; i < kRTTSamples; i++ {
+		rs.Add(5 * time.Millisecond)
+	}
+	s = rs.Summary()
+	assert.Equal(t, 5*time.Millisecond, s.Min)
+	assert.Equal(t, 5*time.Millisecond, s.Max)
+}
+
+func TestProbeRTT(t *testing.T) {
+	now := time.Now()
+	rtt, ok := probeRTT(probePayload(now), now.Add(3*time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Millisecond, rtt)
+
+	_, ok = probeRTT(probePayload(now), now.Add(-time.Millisecond))
+	assert.False(t, ok)
+	_, ok = probeRTT([]byte{1, 2}, now)
+	assert.False(t, ok)
+}
+
+func TestStripIPv4Header(t *testing.T) {
+	buf := make([]byte, 32)
+	buf[0] = 0x45
+	buf[20] = ICMPTypeEchoReply
+	buf[21] = 7
+	assert.Equal(t, 12, stripIPv4Header(buf, 32))
+	assert.Equal(t, byte(7), buf[1])
+
+	// not ipv4
+	buf[0] = 0x08
+	assert.Equal(t, 32, stripIPv4Header(buf, 32))
+}
@@ -0,0 +1,42 @@
+package icmp_tun
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// the kernel receive timestamp in the control messages, or now
+func rxTimestamp(oob []byte) time.Time {
+	if ts, ok := parseRxTimestamp(oob); ok {
+		return ts
+	}
+	return time.Now()
+}
+
+// recvmsg on raw sockets does not strip the IPv4 header like ReadFrom
+func stripIPv4Header(buf []byte, n int) int {
+	if n < 20 || buf[0]>>4 != 4 {
+		return n
+	}
+	hlen := int(buf[0]&0x0f) << 2
+	if hlen < 20 || hlen > n {
+		return n
+	}
+	copy(buf, buf[hlen:n])
+	return n - hlen
+}
+
+// probe payload: sender wall clock in ns
+func probePayload(now time.Time) []byte {
+	payload := make([]byte, 8)
+	binary.LittleEndian.PutUint64(payload, uint64(now.UnixNano()))
+	return payload
+}
+
+func probeRTT(payload []byte, rxts time.Time) (time.Duration, bool) {
+	if len(payload) < 8 {
+		return 0, false
+	}
+	rtt := rxts.Sub(time.Unix(0, int64(binary.LittleEndian.Uint64(payload))))
+	return rtt, rtt >= 0 && rtt < time.Minute
+}
@@ -0,0 +1,46 @@
+package icmp_tun
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// SO_TIMESTAMPNS
+func enableRxTimestamp(conn net.PacketConn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("kernel timestamp not supported by conn")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(serr, "setsockopt SO_TIMESTAMPNS")
+}
+
+func parseRxTimestamp(oob []byte) (time.Time, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SCM_TIMESTAMPNS &&
+			len(msg.Data) >= int(unsafe.Sizeof(unix.Timespec{})) {
+			ts := *(*unix.Timespec)(unsafe.Pointer(&msg.Data[0]))
+			return time.Unix(ts.Unix()), true
+		}
+	}
+	return time.Time{}, false
+}
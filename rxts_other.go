@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package icmp_tun
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+func enableRxTimestamp(conn net.PacketConn) error {
+	return errors.New("kernel timestamp only supported on linux")
+}
+
+func parseRxTimestamp(oob []byte) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,122 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// backoff of reopening a failed socket
+const kReopenMinBackoff = 100 * time.Millisecond
+const kReopenMaxBackoff = 10 * time.Second
+
+// a conn with what was set up when opening it
+type sockConn struct {
+	net.PacketConn
+	icmpid uint16 // of ICMP sockets
+	ping   bool   // a ping socket, icmpid is assigned by kernel
+}
+
+// socket is a conn shared by goroutines. the goroutine reading it replaces the conn
+// after persistent errors, others pick up the new conn with get().
+type socket struct {
+	name     string
+	open     func() (*sockConn, error)
+	noReopen bool // stop with the error instead
+	// states
+	mu      sync.Mutex
+	conn    unsafe.Pointer // current conn: *sockConn
+	closed  bool
+	down    int32  // atomic, 1 while reopening
+	reopens uint64 // atomic
+}
+
+// before open()
+func (s *socket) init(name string, noReopen bool, open func() (*sockConn, error)) {
+	s.name, s.noReopen, s.open = name, noReopen, open
+}
+
+// nil before opened
+func (s *socket) get() *sockConn {
+	return (*sockConn)(atomic.LoadPointer(&s.conn))
+}
+
+// returns false and closes sc if the socket is closed
+func (s *socket) set(sc *sockConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		_ = sc.Close()
+		return false
+	}
+	atomic.StorePointer(&s.conn, unsafe.Pointer(sc))
+	return true
+}
+
+// closes the current conn, reopen() stops
+func (s *socket) close(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if sc := s.get(); sc != nil {
+		SafeClose(ctx, sc)
+	}
+}
+
+// handles an error of the reader of s. returns nil to keep reading, the new conn if reopened,
+// or the error to stop the group with.
+func (s *socket) readError(ctx context.Context, g *runGroup, err error, streak *int) (*sockConn, error) {
+	err = g.readError(err, streak)
+	if err == nil {
+		return nil, nil
+	}
+	if err == errStopped || s.noReopen {
+		return nil, errors.Wrap(err, s.name+" read")
+	}
+
+	*streak = 0
+	return s.reopen(ctx, g, err)
+}
+
+// replaces the failed conn with backoff until opened or the group stops
+func (s *socket) reopen(ctx context.Context, g *runGroup, cause error) (*sockConn, error) {
+	logError(ctx, "socket failed, reopening", "socket", s.name, errAttr(cause))
+	atomic.StoreInt32(&s.down, 1)
+	defer atomic.StoreInt32(&s.down, 0)
+	_ = s.get().Close() // may be closed already
+
+	start := time.Now()
+	backoff := kReopenMinBackoff
+	for {
+		select {
+		case <-g.Done():
+			return nil, errStopped
+		case <-time.After(backoff):
+		}
+
+		sc, err := s.open()
+		if err != nil {
+			backoff = minDuration(2*backoff, kReopenMaxBackoff)
+			logError(ctx, "reopen socket", "socket", s.name, errAttr(err), "retry_in", backoff)
+			continue
+		}
+		if !s.set(sc) {
+			return nil, errStopped
+		}
+		inc(&s.reopens)
+		logInfo(ctx, "socket reopened", "socket", s.name, "addr", sc.LocalAddr().String(),
+			"outage", time.Since(start))
+		return sc, nil
+	}
+}
+
+func (s *socket) collect(m *Metrics, labels ...string) {
+	labels = append(labels[:len(labels):len(labels)], "socket", s.name)
+	m.Counter("socket_reopens_total", "Sockets reopened after persistent errors.",
+		atomic.LoadUint64(&s.reopens), labels...)
+	m.Gauge("socket_down", "1 while the socket is being reopened.", float64(atomic.LoadInt32(&s.down)), labels...)
+}
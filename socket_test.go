@@ -0,0 +1,67 @@
+package icmp_tun
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSocket_Reopen(t *testing.T) {
+	ctx := context.Background()
+	h := NewSimNet(1).Host("10.0.0.1")
+	fails := 2
+	s := &socket{name: "test", open: func() (*sockConn, error) {
+		if fails > 0 {
+			fails--
+			return nil, errors.New("no network")
+		}
+		conn, err := h.ListenUDP("")
+		if err != nil {
+			return nil, err
+		}
+		return &sockConn{PacketConn: conn}, nil
+	}}
+	conn, err := h.ListenUDP("")
+	require.NoError(t, err)
+	s.set(&sockConn{PacketConn: conn})
+
+	// transient
+	g := newRunGroup(ctx)
+	streak := 0
+	sc, err := s.readError(ctx, g, syscall.ECONNREFUSED, &streak)
+	assert.NoError(t, err)
+	assert.Nil(t, sc)
+
+	// reopened after failures, the old conn is closed
+	start := time.Now()
+	sc, err = s.readError(ctx, g, net.ErrClosed, &streak)
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) >= 7*kReopenMinBackoff)
+	assert.Same(t, sc, s.get())
+	assert.Equal(t, uint64(1), s.reopens)
+	assert.Equal(t, 0, streak)
+	_, err = conn.WriteTo([]byte("x"), sc.LocalAddr())
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	// closed on shutdown
+	g.cancel()
+	s.close(ctx)
+	sc, err = s.readError(ctx, g, net.ErrClosed, &streak)
+	assert.Nil(t, sc)
+	assert.ErrorIs(t, err, errStopped)
+	_, err = s.reopen(ctx, g, net.ErrClosed)
+	assert.Equal(t, errStopped, err)
+}
+
+func TestSocket_NoReopen(t *testing.T) {
+	ctx := context.Background()
+	s := &socket{name: "test", noReopen: true}
+	streak := 0
+	_, err := s.readError(ctx, newRunGroup(ctx), syscall.EBADF, &streak)
+	assert.ErrorIs(t, err, syscall.EBADF)
+}
@@ -1,22 +1,166 @@
 package icmp_tun
 
-import "time"
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
+// Stats of the received direction, keyed by pktid.
+// Update() is called by the reader, other methods are safe on other goroutines.
 type Stats struct {
-	Loss100    uint32
-	Count100   uint32
-	Loss1000   uint32
-	Count1000  uint32
-	Loss10000  uint32
-	Count10000 uint32
+	// config, set before Init()
+	// loss windows in pktids, default 100, 1000, 10000
+	Windows []uint32
+	// report at most every ReportInterval and ReportPackets pktids, default 1s and 100
+	ReportInterval time.Duration
+	ReportPackets  uint32
+	// weight of the latest report in EWMALoss, default 0.1
+	EWMAAlpha float64
 	// states
+	mu        sync.Mutex
 	bm        RingBitmap
+	rtt       RTTStats
+	snap      StatsSnapshot // counters and the latest report
 	lastpktid uint32
 	lastts    time.Time
+	lastpkts  uint64
+	lastbytes uint64
+	peer      *StatsSnapshot // reported by the peer
+}
+
+type StatsSnapshot struct {
+	// loss of windows, from the latest report
+	Loss []LossInfo `json:"loss"`
+	// loss ratio smoothed over reports
+	EWMALoss float64 `json:"ewma_loss"`
+	// counters
+	Packets    uint64 `json:"packets"`
+	Bytes      uint64 `json:"bytes"`
+	OutOfOrder uint64 `json:"out_of_order"`
+	Duplicates uint64 `json:"duplicates"`
+	Resets     uint64 `json:"resets"`
+	// per second, between the latest 2 reports
+	PacketRate float64 `json:"packet_rate"`
+	ByteRate   float64 `json:"byte_rate"`
+	// probes
+	RTT RTTSummary `json:"rtt"`
+	// the other direction, as reported by the peer with kCmdReport
+	Peer *StatsSnapshot `json:"peer,omitempty"`
+	// when Peer is received
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+type LossInfo struct {
+	Window uint32 `json:"window"`
+	Loss   uint32 `json:"loss"`
+	Count  uint32 `json:"count"`
+}
+
+var kDefaultStatsWindows = []uint32{100, 1000, 10000}
+
+// ParseStatsWindows parses comma separated window sizes
+func ParseStatsWindows(s string) ([]uint32, error) {
+	var windows []uint32
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		w, err := strconv.ParseUint(f, 10, 32)
+		if err != nil || w == 0 || w > 1<<24 {
+			return nil, errors.Errorf("invalid stats window: %v", f)
+		}
+		windows = append(windows, uint32(w))
+	}
+	return windows, nil
 }
 
 func (st *Stats) Init() {
-	st.bm.Init(kBitmapSize)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if len(st.Windows) == 0 {
+		st.Windows = kDefaultStatsWindows
+	}
+	if st.ReportInterval == 0 {
+		st.ReportInterval = 1 * time.Second
+	}
+	if st.ReportPackets == 0 {
+		st.ReportPackets = 100
+	}
+	if st.EWMAAlpha == 0 {
+		st.EWMAAlpha = 0.1
+	}
+
+	// the bitmap holds at least 4 times of the largest window
+	size := uint32(kBitmapSize)
+	for _, w := range st.Windows {
+		for size/4 < w {
+			size *= 2
+		}
+	}
+	st.bm.Init(size)
+
+	st.rtt = RTTStats{}
+	st.snap = StatsSnapshot{}
+	st.lastpktid = 0
+	st.lastts = time.Time{}
+	st.lastpkts = 0
+	st.lastbytes = 0
+	st.peer = nil
+}
+
+// Reset forgets pktids, e.g. when the peer restarted
+func (st *Stats) Reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reset()
+}
+
+func (st *Stats) reset() {
+	st.bm.Clear()
+	st.snap.Loss = nil
+	st.snap.Resets++
+	st.lastpktid = 0
+	st.peer = nil
+}
+
+func (st *Stats) AddRTT(rtt time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.rtt.Add(rtt)
+}
+
+func (st *Stats) RTT() RTTSummary {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.rtt.Summary()
+}
+
+func (st *Stats) Snapshot() StatsSnapshot {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	snap := st.snap
+	snap.Loss = append([]LossInfo(nil), st.snap.Loss...)
+	snap.RTT = st.rtt.Summary()
+	if st.peer != nil {
+		peer := *st.peer
+		snap.Peer = &peer
+	}
+	return snap
+}
+
+// SetPeer saves the report of the peer
+func (st *Stats) SetPeer(peer StatsSnapshot) {
+	peer.Peer = nil
+	peer.ReportedAt = time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.peer = &peer
 }
 
 func (st *Stats) tail(length uint32) (loss uint32, count uint32) {
@@ -26,26 +170,81 @@ func (st *Stats) tail(length uint32) (loss uint32, count uint32) {
 
 const kPktidBreakThreshold = 1000
 
-func (st *Stats) Update(pktid uint32) (updated bool) {
-	if st.bm.Last()-pktid > kPktidBreakThreshold && pktid-st.bm.Last() > kPktidBreakThreshold {
-		st.bm.Clear()
+// returns true if a new loss report is produced
+func (st *Stats) Update(pktid uint32, size int) (updated bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.snap.Packets++
+	st.snap.Bytes += uint64(size)
+
+	last := st.bm.Last()
+	if last != kBitmapEmpty && last-pktid > kPktidBreakThreshold && pktid-last > kPktidBreakThreshold {
+		st.reset()
+	} else if st.bm.Has(pktid) {
+		st.snap.Duplicates++
+		return false
+	} else if last != kBitmapEmpty && last-pktid < 1<<31 {
+		st.snap.OutOfOrder++
 	}
 
 	st.bm.Set(pktid)
 	logdiff := st.bm.Last() - st.lastpktid
 	now := time.Now()
-	if logdiff < 100 || now.Sub(st.lastts) < 1*time.Second {
+	if logdiff < st.ReportPackets || now.Sub(st.lastts) < st.ReportInterval {
 		// pass
 		return false
-	} else if st.lastpktid != 0 && 100 <= logdiff && logdiff < kBitmapSize/4 {
-		st.Loss100, st.Count100 = st.tail(100)
-		st.Loss1000, st.Count1000 = st.tail(1000)
-		st.Loss10000, st.Count10000 = st.tail(10000)
-		st.lastpktid = st.bm.Last()
-		st.lastts = now
+	} else if st.lastpktid != 0 && st.ReportPackets <= logdiff && logdiff < st.bm.Size()/4 {
+		st.report(logdiff, now)
 		return true
 	} else {
 		st.lastpktid = st.bm.Last()
 		return false
 	}
 }
+
+func (st *Stats) report(logdiff uint32, now time.Time) {
+	// windows
+	st.snap.Loss = st.snap.Loss[:0]
+	for _, w := range st.Windows {
+		loss, count := st.tail(w)
+		st.snap.Loss = append(st.snap.Loss, LossInfo{Window: w, Loss: loss, Count: count})
+	}
+
+	// ewma of the loss since the last report
+	if loss, count := st.tail(logdiff); count > 0 {
+		ratio := float64(loss) / float64(count)
+		if st.lastts.IsZero() {
+			st.snap.EWMALoss = ratio
+		} else {
+			st.snap.EWMALoss += st.EWMAAlpha * (ratio - st.snap.EWMALoss)
+		}
+	}
+
+	// rates
+	if !st.lastts.IsZero() {
+		secs := now.Sub(st.lastts).Seconds()
+		st.snap.PacketRate = float64(st.snap.Packets-st.lastpkts) / secs
+		st.snap.ByteRate = float64(st.snap.Bytes-st.lastbytes) / secs
+	}
+
+	st.lastpktid = st.bm.Last()
+	st.lastts = now
+	st.lastpkts = st.snap.Packets
+	st.lastbytes = st.snap.Bytes
+}
+
+// for logging
+func (s StatsSnapshot) String() string {
+	sb := strings.Builder{}
+	sb.WriteString("loss count:")
+	for _, w := range s.Loss {
+		fmt.Fprintf(&sb, " [%v/%v]", w.Loss, w.Count)
+	}
+	fmt.Fprintf(&sb, " [ewma:%.4f] [ooo:%v][dup:%v][reset:%v] [rate:%.0fpps/%.0fBps] %v",
+		s.EWMALoss, s.OutOfOrder, s.Duplicates, s.Resets, s.PacketRate, s.ByteRate, s.RTT)
+	if s.Peer != nil {
+		fmt.Fprintf(&sb, " [peer %v ago: %v]", time.Since(s.Peer.ReportedAt).Round(time.Second), s.Peer)
+	}
+	return sb.String()
+}
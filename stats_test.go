@@ -0,0 +1,96 @@
+package icmp_tun
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStats_Update(t *testing.T) {
+	st := Stats{Windows: []uint32{10, 50}, ReportInterval: time.Nanosecond, ReportPackets: 10}
+	st.Init()
+	assert.Equal(t, uint32(kBitmapSize), st.bm.Size())
+
+	for pktid := uint32(1); pktid <= 100; pktid++ {
+		if pktid%10 != 5 {
+			st.Update(pktid, 100)
+		}
+	}
+	snap := st.Snapshot()
+	assert.Equal(t, []LossInfo{{Window: 10, Loss: 1, Count: 10}, {Window: 50, Loss: 5, Count: 50}}, snap.Loss)
+	assert.InDelta(t, 0.1, snap.EWMALoss, 1e-9)
+	assert.Equal(t, uint64(90), snap.Packets)
+	assert.Equal(t, uint64(9000), snap.Bytes)
+	assert.Equal(t, uint64(0), snap.OutOfOrder)
+	assert.Equal(t, uint64(0), snap.Duplicates)
+
+	// duplicated
+	assert.False(t, st.Update(100, 100))
+	assert.Equal(t, uint64(1), st.Snapshot().Duplicates)
+	// late
+	st.Update(95, 100)
+	assert.Equal(t, uint64(1), st.Snapshot().OutOfOrder)
+	assert.Equal(t, uint32(100), st.bm.Last())
+
+	// reset on large jump
+	st.Update(100+kPktidBreakThreshold+1, 100)
+	snap = st.Snapshot()
+	assert.Equal(t, uint64(1), snap.Resets)
+	assert.Empty(t, snap.Loss)
+	assert.Equal(t, uint64(93), snap.Packets)
+
+	// the snapshot is a copy
+	st.Init()
+	snap.Loss = append(snap.Loss, LossInfo{})
+	assert.Empty(t, st.Snapshot().Loss)
+}
+
+func TestStats_Windows(t *testing.T) {
+	st := Stats{Windows: []uint32{100, 100000}}
+	st.Init()
+	assert.Equal(t, uint32(1<<19), st.bm.Size())
+	assert.Equal(t, 1*time.Second, st.ReportInterval)
+	assert.Equal(t, uint32(100), st.ReportPackets)
+}
+
+func TestParseStatsWindows(t *testing.T) {
+	windows, err := ParseStatsWindows("100, 1000,")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{100, 1000}, windows)
+	_, err = ParseStatsWindows("0")
+	assert.Error(t, err)
+	_, err = ParseStatsWindows("abc")
+	assert.Error(t, err)
+}
+
+func TestReport(t *testing.T) {
+	snap := StatsSnapshot{
+		Loss:     []LossInfo{{Window: 100, Loss: 1, Count: 100}, {Window: 1000, Loss: 12, Count: 998}},
+		EWMALoss: 0.0125, Packets: 12345, Bytes: 1234567, OutOfOrder: 3, Duplicates: 2, Resets: 1,
+		PacketRate: 100.5, ByteRate: 10000.25,
+		RTT: RTTSummary{Count: 10, Min: time.Millisecond, Avg: 2 * time.Millisecond,
+			Max: 3 * time.Millisecond, P99: 3 * time.Millisecond, Jitter: 100 * time.Microsecond},
+	}
+	b := encodeReport(snap)
+	assert.Equal(t, kReportFixedSize+12*2, len(b))
+	decoded, err := decodeReport(b)
+	assert.NoError(t, err)
+	assert.Equal(t, snap, decoded)
+
+	_, err = decodeReport(b[:len(b)-1])
+	assert.Error(t, err)
+	_, err = decodeReport(nil)
+	assert.Error(t, err)
+
+	// combined view
+	st := Stats{}
+	st.Init()
+	st.SetPeer(decoded)
+	peer := st.Snapshot().Peer
+	assert.NotNil(t, peer)
+	assert.Equal(t, uint64(12345), peer.Packets)
+	assert.False(t, peer.ReportedAt.IsZero())
+	assert.Contains(t, st.Snapshot().String(), "[peer ")
+	st.Reset()
+	assert.Nil(t, st.Snapshot().Peer)
+}
@@ -2,15 +2,16 @@ package icmp_tun
 
 import (
 	"context"
-	"gopkg.in/account-login/ctxlog.v2"
 	"io"
+	"math"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
 func SafeClose(ctx context.Context, closer io.Closer) {
 	if err := closer.Close(); err != nil {
-		ctxlog.Errorf(ctx, "close: %v", err)
+		logError(ctx, "close", errAttr(err))
 	}
 }
 
@@ -19,3 +20,55 @@ var procPID = os.Getpid()
 func Rand64ByTime() uint64 {
 	return fmix64(uint64(time.Now().UnixNano() ^ int64(procPID)))
 }
+
+// waits for a quiet period: until the counter of forwarded packets stops increasing for
+// kQuietPeriod, or the deadline. packets still queued or delayed at the end are not waited for.
+func waitQuiet(ctx context.Context, counter *uint64, deadline time.Time) {
+	last := atomic.LoadUint64(counter)
+	for time.Now().Before(deadline) {
+		time.Sleep(kQuietPeriod)
+		cur := atomic.LoadUint64(counter)
+		if cur == last {
+			return
+		}
+		last = cur
+	}
+	logWarn(ctx, "still forwarding at the shutdown deadline")
+}
+
+func minDuration(a time.Duration, others ...time.Duration) time.Duration {
+	for _, b := range others {
+		if b < a {
+			a = b
+		}
+	}
+	return a
+}
+
+// fires every interval, never fires if interval < 0
+type ticker struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newTicker(interval time.Duration, def time.Duration) ticker {
+	if interval == 0 {
+		interval = def
+	}
+	return ticker{interval: interval}
+}
+
+func (t *ticker) tick(now time.Time) bool {
+	if t.interval < 0 || now.Before(t.next) {
+		return false
+	}
+	t.next = now.Add(t.interval)
+	return true
+}
+
+func (t *ticker) until(now time.Time) time.Duration {
+	if t.interval < 0 {
+		return math.MaxInt64
+	}
+	return t.next.Sub(now)
+}